@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the authentication service settings. Values are read from defaults, then the optional
+// YAML file named by CONFIG_FILE, then environment variables, in that order.
+type Config struct {
+	ListenAddr      string             `yaml:"listen_addr"`
+	DatabaseURI     string             `yaml:"database_uri"`
+	SigningKeys     []SigningKeyConfig `yaml:"signing_keys"`
+	AccessTokenTTL  time.Duration      `yaml:"access_token_ttl"`
+	RefreshTokenTTL time.Duration      `yaml:"refresh_token_ttl"`
+	AdminUsers      []string           `yaml:"admin_users"`
+	RedactFields    []string           `yaml:"redact_fields"`
+	LogLevel        slog.Level         `yaml:"log_level"`
+	ShutdownTimeout time.Duration      `yaml:"shutdown_timeout"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		ListenAddr:      ":8085",
+		AccessTokenTTL:  15 * time.Minute,
+		RefreshTokenTTL: 30 * 24 * time.Hour,
+		RedactFields:    defaultRedactFields,
+		LogLevel:        slog.LevelInfo,
+		ShutdownTimeout: 20 * time.Second,
+	}
+}
+
+// loadConfig builds the effective configuration and validates it.
+func loadConfig() (Config, error) {
+	cfg := defaultConfig()
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("reading config file: %w", err)
+		}
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("parsing config file %s: %w", path, err)
+		}
+	}
+
+	setString(&cfg.ListenAddr, "LISTEN_ADDR")
+	setString(&cfg.DatabaseURI, "DATABASE_URI")
+	setSigningKeyFile(&cfg.SigningKeys, "SIGNING_KEY_FILE")
+	setList(&cfg.AdminUsers, "ADMIN_USERS")
+	setList(&cfg.RedactFields, "REDACT_FIELDS")
+	if err := setDuration(&cfg.AccessTokenTTL, "ACCESS_TOKEN_TTL"); err != nil {
+		return cfg, err
+	}
+	if err := setDuration(&cfg.RefreshTokenTTL, "REFRESH_TOKEN_TTL"); err != nil {
+		return cfg, err
+	}
+	if err := setDuration(&cfg.ShutdownTimeout, "SHUTDOWN_TIMEOUT"); err != nil {
+		return cfg, err
+	}
+	if err := setLevel(&cfg.LogLevel, "LOG_LEVEL"); err != nil {
+		return cfg, err
+	}
+
+	return cfg, cfg.validate()
+}
+
+func (c Config) validate() error {
+	var errs []error
+	if c.ListenAddr == "" {
+		errs = append(errs, errors.New("listen_addr is required"))
+	}
+	if c.DatabaseURI == "" {
+		errs = append(errs, errors.New("database_uri is required"))
+	}
+	if len(c.SigningKeys) == 0 {
+		errs = append(errs, errors.New("signing_keys is required"))
+	}
+	ids := map[string]bool{}
+	for i, key := range c.SigningKeys {
+		if key.ID == "" || key.File == "" {
+			errs = append(errs, fmt.Errorf("signing_keys[%d] needs an id and a file", i))
+		}
+		if ids[key.ID] {
+			errs = append(errs, fmt.Errorf("signing key id %q is used twice", key.ID))
+		}
+		ids[key.ID] = true
+	}
+	if c.AccessTokenTTL <= 0 {
+		errs = append(errs, errors.New("access_token_ttl must be positive"))
+	}
+	if c.RefreshTokenTTL < c.AccessTokenTTL {
+		errs = append(errs, errors.New("refresh_token_ttl must not be less than access_token_ttl"))
+	}
+	if len(c.RedactFields) == 0 {
+		errs = append(errs, errors.New("redact_fields must not be empty"))
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("shutdown_timeout must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// redacted returns a copy that is safe to log.
+func (c Config) redacted() Config {
+	c.DatabaseURI = redactURL(c.DatabaseURI)
+	return c
+}
+
+func setString(field *string, env string) {
+	if value, ok := os.LookupEnv(env); ok && value != "" {
+		*field = value
+	}
+}
+
+func setList(field *[]string, env string) {
+	value, ok := os.LookupEnv(env)
+	if !ok || value == "" {
+		return
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	*field = list
+}
+
+// setSigningKeyFile replaces the signing keys with the single key file named by env,
+// named after the file.
+func setSigningKeyFile(field *[]SigningKeyConfig, env string) {
+	if value, ok := os.LookupEnv(env); ok && value != "" {
+		id := strings.TrimSuffix(filepath.Base(value), filepath.Ext(value))
+		*field = []SigningKeyConfig{{ID: id, File: value}}
+	}
+}
+
+func setDuration(field *time.Duration, env string) error {
+	value, ok := os.LookupEnv(env)
+	if !ok || value == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("%s: %w", env, err)
+	}
+	*field = d
+	return nil
+}
+
+func setLevel(field *slog.Level, env string) error {
+	value, ok := os.LookupEnv(env)
+	if !ok || value == "" {
+		return nil
+	}
+	if err := field.UnmarshalText([]byte(value)); err != nil {
+		return fmt.Errorf("%s: %w", env, err)
+	}
+	return nil
+}
+
+func redactSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "[REDACTED]"
+}
+
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil {
+		return redactSecret(value)
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var errNoSigningKey = errors.New("no signing key is active")
+
+// SigningKeyConfig names a private key file. The key signs tokens from ActiveFrom until
+// the next key becomes active.
+type SigningKeyConfig struct {
+	ID         string    `yaml:"id"`
+	File       string    `yaml:"file"`
+	ActiveFrom time.Time `yaml:"active_from"`
+}
+
+// SigningKey is a loaded private key and the algorithm it signs with.
+type SigningKey struct {
+	ID         string
+	Method     jwt.SigningMethod
+	Private    crypto.Signer
+	ActiveFrom time.Time
+}
+
+// loadSigningKey reads an RSA or Ed25519 private key from a PEM file. RSA keys sign with
+// RS256 and Ed25519 keys with EdDSA.
+func loadSigningKey(c SigningKeyConfig) (SigningKey, error) {
+	data, err := os.ReadFile(c.File)
+	if err != nil {
+		return SigningKey{}, fmt.Errorf("signing key %s: %w", c.ID, err)
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return SigningKey{}, fmt.Errorf("signing key %s: %s is not a PEM file", c.ID, c.File)
+	}
+
+	var parsed any
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		err = fmt.Errorf("unsupported PEM block %q", block.Type)
+	}
+	if err != nil {
+		return SigningKey{}, fmt.Errorf("signing key %s: %w", c.ID, err)
+	}
+
+	key := SigningKey{ID: c.ID, ActiveFrom: c.ActiveFrom}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return SigningKey{}, fmt.Errorf("signing key %s: RSA keys must have at least 2048 bits", c.ID)
+		}
+		key.Method, key.Private = jwt.SigningMethodRS256, k
+	case ed25519.PrivateKey:
+		key.Method, key.Private = jwt.SigningMethodEdDSA, k
+	default:
+		return SigningKey{}, fmt.Errorf("signing key %s: unsupported key type %T", c.ID, parsed)
+	}
+	return key, nil
+}
+
+// KeySet holds the signing keys in the order they become active. The newest active key
+// signs tokens. Every other key is published while tokens it signed may still be in use:
+// from before it becomes active, so that verifiers have it by the time it is used,
+// until its successor has been active for longer than an access token lives.
+type KeySet struct {
+	keys []SigningKey
+	// retireAfter is how long a key stays published once it no longer signs.
+	retireAfter time.Duration
+}
+
+func NewKeySet(keys []SigningKey, retireAfter time.Duration) *KeySet {
+	keys = append([]SigningKey(nil), keys...)
+	sort.SliceStable(keys, func(i, j int) bool { return keys[i].ActiveFrom.Before(keys[j].ActiveFrom) })
+	return &KeySet{keys: keys, retireAfter: retireAfter}
+}
+
+// loadKeySet loads every configured signing key.
+func loadKeySet(configs []SigningKeyConfig, retireAfter time.Duration) (*KeySet, error) {
+	var keys []SigningKey
+	for _, c := range configs {
+		key, err := loadSigningKey(c)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return NewKeySet(keys, retireAfter), nil
+}
+
+// Signing returns the key that signs tokens at now.
+func (ks *KeySet) Signing(now time.Time) (SigningKey, error) {
+	for i := len(ks.keys) - 1; i >= 0; i-- {
+		if !ks.keys[i].ActiveFrom.After(now) {
+			return ks.keys[i], nil
+		}
+	}
+	return SigningKey{}, errNoSigningKey
+}
+
+// Published returns the keys that tokens may be verified with at now.
+func (ks *KeySet) Published(now time.Time) []SigningKey {
+	var published []SigningKey
+	for i, key := range ks.keys {
+		if i+1 < len(ks.keys) && !ks.keys[i+1].ActiveFrom.Add(ks.retireAfter).After(now) {
+			continue
+		}
+		published = append(published, key)
+	}
+	return published
+}
+
+// Verifying returns the published key with the given ID.
+func (ks *KeySet) Verifying(id string, now time.Time) (SigningKey, bool) {
+	for _, key := range ks.Published(now) {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return SigningKey{}, false
+}
+
+// sign signs claims with the key active at now, naming the key in the kid header.
+func (ks *KeySet) sign(claims jwt.Claims, now time.Time) (string, error) {
+	key, err := ks.Signing(now)
+	if err != nil {
+		return "", err
+	}
+	token := jwt.NewWithClaims(key.Method, claims)
+	token.Header["kid"] = key.ID
+	return token.SignedString(key.Private)
+}
+
+// keyFunc finds the key a token names in its kid header, for jwt.Parse.
+func (ks *KeySet) keyFunc(now time.Time) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		id, _ := token.Header["kid"].(string)
+		key, ok := ks.Verifying(id, now)
+		if !ok {
+			return nil, fmt.Errorf("unknown signing key %q", id)
+		}
+		if token.Method.Alg() != key.Method.Alg() {
+			return nil, errUnexpectedSigningMethod
+		}
+		return key.Private.Public(), nil
+	}
+}
+
+// JWK is a public key in the JSON Web Key format (RFC 7517).
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Use       string `json:"use"`
+	Algorithm string `json:"alg"`
+	// N and E are the modulus and exponent of an RSA key
+	N string `json:"n,omitempty"`
+	E string `json:"e,omitempty"`
+	// Curve and X are the curve and public key of an Ed25519 key
+	Curve string `json:"crv,omitempty"`
+	X     string `json:"x,omitempty"`
+}
+
+// JWKS is a JSON Web Key Set.
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func publicJWK(key SigningKey) JWK {
+	jwk := JWK{KeyID: key.ID, Use: "sig", Algorithm: key.Method.Alg()}
+	switch public := key.Private.Public().(type) {
+	case *rsa.PublicKey:
+		jwk.KeyType = "RSA"
+		jwk.N = base64.RawURLEncoding.EncodeToString(public.N.Bytes())
+		jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.KeyType = "OKP"
+		jwk.Curve = "Ed25519"
+		jwk.X = base64.RawURLEncoding.EncodeToString(public)
+	}
+	return jwk
+}
+
+// JWKS godoc
+// @Summary Token signing keys
+// @Description The public keys that tokens are signed with, including the next key before it is used and previous keys while their tokens may still be valid.
+// @Tags auth
+// @Produce json
+// @Success 200 {object} JWKS
+// @Router /.well-known/jwks.json [get]
+func (s *Server) JWKS(w http.ResponseWriter, r *http.Request) {
+	jwks := JWKS{Keys: []JWK{}}
+	for _, key := range s.keys.Published(s.now()) {
+		jwks.Keys = append(jwks.Keys, publicJWK(key))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	json.NewEncoder(w).Encode(jwks)
+}
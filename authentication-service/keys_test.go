@@ -0,0 +1,171 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// newTestKeySet returns a key set with one Ed25519 key that is always active.
+func newTestKeySet() *KeySet {
+	_, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	return NewKeySet([]SigningKey{{ID: "test", Method: jwt.SigningMethodEdDSA, Private: private}}, time.Hour)
+}
+
+func writePEM(t *testing.T, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "key.pem")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadSigningKey(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	smallKey, _ := rsa.GenerateKey(rand.Reader, 1024)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	edDER, _ := x509.MarshalPKCS8PrivateKey(edKey)
+	rsaPKCS8, _ := x509.MarshalPKCS8PrivateKey(rsaKey)
+
+	tests := []struct {
+		name string
+		file string
+		alg  string
+	}{
+		{"RSA PKCS #1", writePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(rsaKey)), "RS256"},
+		{"RSA PKCS #8", writePEM(t, "PRIVATE KEY", rsaPKCS8), "RS256"},
+		{"Ed25519", writePEM(t, "PRIVATE KEY", edDER), "EdDSA"},
+		{"short RSA key", writePEM(t, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(smallKey)), ""},
+		{"certificate", writePEM(t, "CERTIFICATE", []byte("not a key")), ""},
+		{"missing file", filepath.Join(t.TempDir(), "missing.pem"), ""},
+	}
+	for _, tt := range tests {
+		key, err := loadSigningKey(SigningKeyConfig{ID: "k", File: tt.file})
+		if tt.alg == "" {
+			if err == nil {
+				t.Errorf("%s: expected an error", tt.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if key.Method.Alg() != tt.alg || key.ID != "k" {
+			t.Errorf("%s: loaded %s key %q, want %s", tt.name, key.Method.Alg(), key.ID, tt.alg)
+		}
+	}
+}
+
+func TestKeySetRotation(t *testing.T) {
+	start := time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC)
+	newKey := func(id string, activeFrom time.Time) SigningKey {
+		_, private, _ := ed25519.GenerateKey(rand.Reader)
+		return SigningKey{ID: id, Method: jwt.SigningMethodEdDSA, Private: private, ActiveFrom: activeFrom}
+	}
+	// Listed out of order on purpose
+	keys := NewKeySet([]SigningKey{
+		newKey("november", start.AddDate(0, 1, 0)),
+		newKey("october", start),
+	}, 15*time.Minute)
+
+	tests := []struct {
+		name      string
+		now       time.Time
+		signing   string
+		published string
+	}{
+		{"before any key", start.Add(-time.Hour), "", "october,november"},
+		{"first key", start, "october", "october,november"},
+		{"next key", start.AddDate(0, 1, 0), "november", "october,november"},
+		{"previous key's tokens still valid", start.AddDate(0, 1, 0).Add(14 * time.Minute), "november", "october,november"},
+		{"previous key retired", start.AddDate(0, 1, 0).Add(15 * time.Minute), "november", "november"},
+	}
+	for _, tt := range tests {
+		key, err := keys.Signing(tt.now)
+		if key.ID != tt.signing || (err == nil) != (tt.signing != "") {
+			t.Errorf("%s: signing with %q (%v), want %q", tt.name, key.ID, err, tt.signing)
+		}
+		var published []string
+		for _, key := range keys.Published(tt.now) {
+			published = append(published, key.ID)
+		}
+		if strings.Join(published, ",") != tt.published {
+			t.Errorf("%s: published %v, want %s", tt.name, published, tt.published)
+		}
+	}
+}
+
+func TestJWKSVerifiesIssuedTokens(t *testing.T) {
+	now := time.Now()
+	s := newRefreshTestServer(t, &now)
+	_, login := postTokens(t, s, "/auth/login", `{"username":"refreshuser","password":"password"}`)
+
+	req, _ := http.NewRequest("GET", "/.well-known/jwks.json", nil)
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusOK)
+	}
+	var jwks JWKS
+	if err := json.NewDecoder(rr.Body).Decode(&jwks); err != nil {
+		t.Fatal(err)
+	}
+	if len(jwks.Keys) != 1 || jwks.Keys[0].KeyID != "test" || jwks.Keys[0].KeyType != "OKP" || jwks.Keys[0].Algorithm != "EdDSA" {
+		t.Fatalf("unexpected key set %+v", jwks)
+	}
+
+	// A verifier that has only the published key can check the token
+	x, err := base64.RawURLEncoding.DecodeString(jwks.Keys[0].X)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := jwt.Parse(login.Token, func(token *jwt.Token) (interface{}, error) {
+		if token.Header["kid"] != jwks.Keys[0].KeyID {
+			t.Errorf("token names key %v, want %s", token.Header["kid"], jwks.Keys[0].KeyID)
+		}
+		return ed25519.PublicKey(x), nil
+	})
+	if err != nil || !token.Valid {
+		t.Errorf("token does not verify with the published key: %v", err)
+	}
+}
+
+func TestAuthenticateRejectsUnpublishedKeys(t *testing.T) {
+	now := time.Now()
+	s := newRefreshTestServer(t, &now)
+	_, login := postTokens(t, s, "/auth/login", `{"username":"refreshuser","password":"password"}`)
+
+	// The same server with a different key, e.g. after the key was removed from the config
+	other := NewServer(s.config, newTestKeySet(), s.users, s.refreshTokens, s.revocations, s.now)
+	if code := postWithToken(other, "/auth/logout", login.Token); code != http.StatusUnauthorized {
+		t.Errorf("token signed with another key: status %v, want %v", code, http.StatusUnauthorized)
+	}
+
+	// A token whose claims were changed after signing
+	parts := strings.Split(login.Token, ".")
+	parts[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"username":"admin","jti":"x","iat":1,"exp":9999999999}`))
+	if code := postWithToken(s, "/auth/logout", strings.Join(parts, ".")); code != http.StatusUnauthorized {
+		t.Errorf("tampered token: status %v, want %v", code, http.StatusUnauthorized)
+	}
+	if code := postWithToken(s, "/auth/logout", login.Token); code != http.StatusOK {
+		t.Errorf("valid token: status %v, want %v", code, http.StatusOK)
+	}
+}
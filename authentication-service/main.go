@@ -1,23 +1,24 @@
 package main
 
 import (
+    "context"
     "database/sql"
     "encoding/json"
-    "log"
+    "log/slog"
     "net/http"
     "os"
+    "os/signal"
+    "syscall"
     "time"
 
     "github.com/joho/godotenv"
 
-    "github.com/dgrijalva/jwt-go"
-    "github.com/gorilla/mux"
+    "github.com/golang-jwt/jwt/v5"
     _ "github.com/lib/pq"
     "golang.org/x/crypto/bcrypt"
 
     // Swagger dependencies
     _ "github.com/tufstraka/pps/authentication-service/docs" 
-    "github.com/swaggo/http-swagger"
 )
 
 // @title Authentication Service API
@@ -34,38 +35,64 @@ import (
 // @host localhost:8085
 // @BasePath /
 
-var db *sql.DB
-
 func main() {
-    err := godotenv.Load()
+    godotenv.Load()
+
+    config, err := loadConfig()
     if err != nil {
-        log.Fatalf("Error loading .env file: %v", err)
+        slog.Error("Invalid configuration", "error", err)
+        os.Exit(1)
     }
+    setupLogger(config.LogLevel)
+    redactFields = config.RedactFields
+    slog.Info("Effective config", "config", config.redacted())
 
-    postgresURI := os.Getenv("DATABASE_URI")
-    log.Printf("Connecting to database with URI: %s", postgresURI)
-
-    db, err = sql.Open("postgres", postgresURI)
+    db, err := sql.Open("postgres", config.DatabaseURI)
     if err != nil {
-        log.Fatalf("Error opening database: %v", err)
+        slog.Error("Error opening database", "error", err)
+        os.Exit(1)
     }
 
     err = db.Ping()
     if err != nil {
-        log.Fatalf("Error connecting to the database: %v", err)
+        slog.Error("Error connecting to the database", "error", err)
+        os.Exit(1)
+    }
+
+    keys, err := loadKeySet(config.SigningKeys, config.AccessTokenTTL)
+    if err != nil {
+        slog.Error("Error loading signing keys", "error", err)
+        os.Exit(1)
+    }
+    if _, err := keys.Signing(time.Now()); err != nil {
+        slog.Error("Error loading signing keys", "error", err)
+        os.Exit(1)
     }
 
-    r := mux.NewRouter()
-    r.HandleFunc("/auth/register", Register).Methods("POST")
-    r.HandleFunc("/auth/login", Login).Methods("POST")
+    s := NewServer(config, keys, NewPostgresUserRepository(db), NewPostgresRefreshTokenStore(db), NewPostgresRevocationStore(db), time.Now)
 
-    r.PathPrefix("/swagger").Handler(httpSwagger.WrapHandler)
+    ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+    defer stop()
 
-    log.Println("Authentication service started on :8085")
-    err = http.ListenAndServe(":8085", r)
-    if err != nil {
-        log.Fatalf("Error starting server: %v", err)
+    server := &http.Server{Addr: config.ListenAddr, Handler: s.Handler()}
+    go func() {
+        slog.Info("Authentication service started", "addr", config.ListenAddr)
+        if err := server.ListenAndServe(); err != http.ErrServerClosed {
+            slog.Error("Error starting server", "error", err)
+            os.Exit(1)
+        }
+    }()
+
+    <-ctx.Done()
+    slog.Info("Shutting down", "timeout", config.ShutdownTimeout)
+    shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+    defer cancel()
+
+    if err := server.Shutdown(shutdownCtx); err != nil {
+        slog.Error("Failed to finish in-flight requests", "error", err)
     }
+    db.Close()
+    slog.Info("Authentication service stopped")
 }
 
 type User struct {
@@ -81,17 +108,22 @@ type UserLogin struct {
     Password string `json:"password"`
 }
 
+// Claims identify the user by ID in the subject and by username. The profile is left
+// out on purpose: it would go stale when the user changes it, and every service that
+// logs a token would hold the user's email and phone. Use /auth/me to read it.
 type Claims struct {
     Username string `json:"username"`
-    Email    string `json:"email"`
-    Location string `json:"location"`
-    Phone    string `json:"phone"`
-    jwt.StandardClaims
+    // SessionID is the refresh token family the token was issued in
+    SessionID string `json:"sid,omitempty"`
+    jwt.RegisteredClaims
 }
 
 type LoginResponse struct {
-    Status string `json:"status"`
-    Token  string `json:"token"`
+    Status       string `json:"status"`
+    Token        string `json:"token"`
+    RefreshToken string `json:"refresh_token"`
+    // ExpiresIn is the lifetime of Token in seconds
+    ExpiresIn    int    `json:"expires_in"`
 }
 
 
@@ -103,28 +135,38 @@ type LoginResponse struct {
 // @Produce  json
 // @Param user body User true "User Details"
 // @Success 201 {string} string "Created"
+// @Failure 409 {string} string "User already exists"
 // @Failure 500 {string} string "Internal Server Error"
 // @Router /auth/register [post]
-func Register(w http.ResponseWriter, r *http.Request) {
+func (s *Server) Register(w http.ResponseWriter, r *http.Request) {
     var user User
     err := json.NewDecoder(r.Body).Decode(&user)
     if err != nil {
-        log.Printf("Error decoding JSON: %v", err)
+        slog.WarnContext(r.Context(), "Error decoding JSON", "error", err)
         http.Error(w, "Invalid request payload", http.StatusBadRequest)
         return
     }
 
     hashedPassword, err := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.DefaultCost)
     if err != nil {
-        log.Printf("Error generating password hash: %v", err)
+        slog.ErrorContext(r.Context(), "Error generating password hash", "error", err)
         http.Error(w, "Internal Server Error", http.StatusInternalServerError)
         return
     }
 
-    _, err = db.Exec("INSERT INTO users (username, password_hash, location, phone, email) VALUES ($1, $2, $3, $4, $5)",
-        user.Username, string(hashedPassword), user.Location, user.Phone, user.Email)
+    _, err = s.users.CreateUser(r.Context(), UserRecord{
+        Username:     user.Username,
+        PasswordHash: string(hashedPassword),
+        Email:        user.Email,
+        Location:     user.Location,
+        Phone:        user.Phone,
+    })
+    if err == errUserExists {
+        http.Error(w, "User already exists", http.StatusConflict)
+        return
+    }
     if err != nil {
-        log.Printf("Error executing insert: %v", err)
+        slog.ErrorContext(r.Context(), "Error executing insert", "error", err)
         http.Error(w, "Internal Server Error", http.StatusInternalServerError)
         return
     }
@@ -134,7 +176,7 @@ func Register(w http.ResponseWriter, r *http.Request) {
 
 // Login godoc
 // @Summary Login a user
-// @Description Authenticate a user and return a JWT token
+// @Description Authenticate a user and return a short-lived JWT access token and a refresh token
 // @Tags auth
 // @Accept json
 // @Produce json
@@ -143,57 +185,40 @@ func Register(w http.ResponseWriter, r *http.Request) {
 // @Failure 401 {object} map[string]string{"status": "invalid credentials"}
 // @Failure 500 {object} map[string]string{"status": "server error"}
 // @Router /auth/login [post]
-func Login(w http.ResponseWriter, r *http.Request) {
+func (s *Server) Login(w http.ResponseWriter, r *http.Request) {
     var user UserLogin
-    mySecretKey := os.Getenv("JWT_SECRET_KEY")
-    var jwtKey = []byte(mySecretKey)
     err := json.NewDecoder(r.Body).Decode(&user)
     if err != nil {
-        log.Printf("Error decoding JSON: %v", err)
+        slog.WarnContext(r.Context(), "Error decoding JSON", "error", err)
         http.Error(w, "Invalid request payload", http.StatusBadRequest)
         return
     }
 
-    var storedHash string
-    err = db.QueryRow("SELECT password_hash FROM users WHERE username=$1", user.Username).Scan(&storedHash)
+    stored, err := s.users.GetUserByUsername(r.Context(), user.Username)
     if err != nil {
-        if err == sql.ErrNoRows {
+        if err == errUserNotFound {
             http.Error(w, `{"status": "invalid credentials"}`, http.StatusUnauthorized)
             return
         }
-        log.Printf("Error querying database: %v", err)
+        slog.ErrorContext(r.Context(), "Error querying database", "error", err)
         http.Error(w, `{"status": "server error"}`, http.StatusInternalServerError)
         return
     }
 
-    err = bcrypt.CompareHashAndPassword([]byte(storedHash), []byte(user.Password))
+    err = bcrypt.CompareHashAndPassword([]byte(stored.PasswordHash), []byte(user.Password))
     if err != nil {
-        log.Printf("Error comparing password hash: %v", err)
+        slog.WarnContext(r.Context(), "Error comparing password hash", "error", err)
         http.Error(w, `{"status": "invalid credentials"}`, http.StatusUnauthorized)
         return
     }
 
-    expirationTime := time.Now().Add(24 * time.Hour)
-    claims := &Claims{
-        Username: user.Username,
-        StandardClaims: jwt.StandardClaims{
-            ExpiresAt: expirationTime.Unix(),
-        },
-    }
-
-    token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-    tokenString, err := token.SignedString(jwtKey)
+    response, err := s.issueTokens(r.Context(), stored, "")
     if err != nil {
-        log.Printf("Error signing token: %v", err)
+        slog.ErrorContext(r.Context(), "Error issuing tokens", "error", err)
         http.Error(w, `{"status": "server error"}`, http.StatusInternalServerError)
         return
     }
 
-    response := LoginResponse{
-        Status: "Login successful",
-        Token:  tokenString,
-    }
-
     w.Header().Set("Content-Type", "application/json")
     w.WriteHeader(http.StatusOK)
     json.NewEncoder(w).Encode(response)
@@ -2,56 +2,39 @@ package main
 
 import (
 	"bytes"
-	"database/sql"
+	"context"
 	"encoding/json"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/golang-jwt/jwt/v5"
 	"github.com/gorilla/mux"
-	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 )
 
-func TestMain(m *testing.M) {
-	var err error
-	err = godotenv.Load()
-	if err != nil {
-		log.Fatalf("Error loading .env file: %v", err)
-	}
+// testUsers backs the handler tests in place of the database.
+var testUsers *MemoryUserRepository
 
-	postgresURI := os.Getenv("DATABASE_URI")
+// testServer serves the handler tests from testUsers.
+var testServer *Server
 
-	db, err = sql.Open("postgres", postgresURI)
-	if err != nil {
-		log.Fatalf("Error opening database: %v", err)
-	}
-
-	err = db.Ping()
-	if err != nil {
-		log.Fatalf("Error connecting to the database: %v db: %s", err, postgresURI)
-	}
-
-	// Clean up the test user before running tests
-	_, _ = db.Exec("DELETE FROM users WHERE username=$1", "testuser")
-
-	code := m.Run()
-
-	// Clean up the test user after running tests
-	_, _ = db.Exec("DELETE FROM users WHERE username=$1", "testuser")
-
-	db.Close()
+func TestMain(m *testing.M) {
+	cfg := defaultConfig()
+	testUsers = NewMemoryUserRepository()
+	testServer = NewServer(cfg, newTestKeySet(), testUsers, NewMemoryRefreshTokenStore(), NewMemoryRevocationStore(), time.Now)
 
-	os.Exit(code)
+	os.Exit(m.Run())
 }
 
 func setupRouter() *mux.Router {
 	r := mux.NewRouter()
-	r.HandleFunc("/auth/register", Register).Methods("POST")
-	r.HandleFunc("/auth/login", Login).Methods("POST")
+	r.HandleFunc("/auth/register", testServer.Register).Methods("POST")
+	r.HandleFunc("/auth/login", testServer.Login).Methods("POST")
 	return r
 }
 
@@ -84,19 +67,18 @@ func TestRegister(t *testing.T) {
 func TestLogin(t *testing.T) {
 	r := setupRouter()
 
-	// Check if the test user already exists in the database
-	var storedHash string
-	err := db.QueryRow("SELECT password_hash FROM users WHERE username=$1", "testuser").Scan(&storedHash)
+	// Check if the test user was stored by TestRegister
+	stored, err := testUsers.GetUserByUsername(context.Background(), "testuser")
 	if err != nil {
-		if err == sql.ErrNoRows {
-			t.Fatalf("Test user not found in the database")
+		if err == errUserNotFound {
+			t.Fatalf("Test user not found in the repository")
 		} else {
-			t.Fatalf("Error querying database: %v", err)
+			t.Fatalf("Error reading repository: %v", err)
 		}
 	}
 
 	// Compare the stored hash with the expected password
-	err = bcrypt.CompareHashAndPassword([]byte(storedHash), []byte("password"))
+	err = bcrypt.CompareHashAndPassword([]byte(stored.PasswordHash), []byte("password"))
 	if err != nil {
 		t.Fatalf("Stored password hash does not match the expected password: %v", err)
 	}
@@ -120,3 +102,42 @@ func TestLogin(t *testing.T) {
 		log.Println("TestLogin: passed")
 	}
 }
+
+func TestRegisterDuplicate(t *testing.T) {
+	r := setupRouter()
+
+	user := User{Username: "dupuser", Password: "password", Email: "dup@example.com", Phone: "1234567890"}
+	for _, want := range []int{http.StatusCreated, http.StatusConflict} {
+		jsonValue, _ := json.Marshal(user)
+		req, _ := http.NewRequest("POST", "/auth/register", bytes.NewBuffer(jsonValue))
+		rr := httptest.NewRecorder()
+		r.ServeHTTP(rr, req)
+
+		if rr.Code != want {
+			t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, want)
+		}
+	}
+}
+
+func TestLoginTokenExpiresFromServerClock(t *testing.T) {
+	issued := time.Now().Add(-time.Hour).Truncate(time.Second)
+	users := NewMemoryUserRepository()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	users.CreateUser(context.Background(), UserRecord{Username: "clockuser", PasswordHash: string(hash), Email: "clock@example.com"})
+	s := NewServer(testServer.config, testServer.keys, users, NewMemoryRefreshTokenStore(), NewMemoryRevocationStore(), func() time.Time { return issued })
+
+	req, _ := http.NewRequest("POST", "/auth/login", strings.NewReader(`{"username":"clockuser","password":"password"}`))
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+
+	var response LoginResponse
+	json.NewDecoder(rr.Body).Decode(&response)
+	claims := &Claims{}
+	_, _, err := jwt.NewParser().ParseUnverified(response.Token, claims)
+	if rr.Code != http.StatusOK || err != nil {
+		t.Fatalf("login failed: status %v, err %v", rr.Code, err)
+	}
+	if want := issued.Add(testServer.config.AccessTokenTTL); claims.ExpiresAt == nil || !claims.ExpiresAt.Equal(want) {
+		t.Errorf("token expires at %v, want %v", claims.ExpiresAt, want)
+	}
+}
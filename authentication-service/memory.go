@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// MemoryUserRepository is an in-memory UserRepository for tests.
+type MemoryUserRepository struct {
+	mu    sync.Mutex
+	users []UserRecord
+}
+
+func NewMemoryUserRepository() *MemoryUserRepository {
+	return &MemoryUserRepository{}
+}
+
+func (r *MemoryUserRepository) CreateUser(ctx context.Context, u UserRecord) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, existing := range r.users {
+		if existing.Username == u.Username || existing.Email == u.Email {
+			return 0, errUserExists
+		}
+	}
+	u.ID = len(r.users) + 1
+	u.CreatedAt = time.Now()
+	r.users = append(r.users, u)
+	return u.ID, nil
+}
+
+func (r *MemoryUserRepository) GetUserByID(ctx context.Context, id int) (UserRecord, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, u := range r.users {
+		if u.ID == id {
+			return u, nil
+		}
+	}
+	return UserRecord{}, errUserNotFound
+}
+
+func (r *MemoryUserRepository) GetUserByUsername(ctx context.Context, username string) (UserRecord, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, u := range r.users {
+		if u.Username == username {
+			return u, nil
+		}
+	}
+	return UserRecord{}, errUserNotFound
+}
+
+func (r *MemoryUserRepository) UpdateUserProfile(ctx context.Context, u UserRecord) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	index := -1
+	for i, existing := range r.users {
+		if existing.ID == u.ID {
+			index = i
+		} else if existing.Email == u.Email {
+			return errUserExists
+		}
+	}
+	if index < 0 {
+		return errUserNotFound
+	}
+	r.users[index].Email = u.Email
+	r.users[index].Location = u.Location
+	r.users[index].Phone = u.Phone
+	return nil
+}
+
+// MemoryRefreshTokenStore is an in-memory RefreshTokenStore for tests.
+type MemoryRefreshTokenStore struct {
+	mu     sync.Mutex
+	tokens map[string]*memoryRefreshToken
+}
+
+type memoryRefreshToken struct {
+	RefreshTokenRecord
+	used, revoked bool
+}
+
+func NewMemoryRefreshTokenStore() *MemoryRefreshTokenStore {
+	return &MemoryRefreshTokenStore{tokens: map[string]*memoryRefreshToken{}}
+}
+
+func (s *MemoryRefreshTokenStore) CreateRefreshToken(ctx context.Context, t RefreshTokenRecord) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[t.TokenHash] = &memoryRefreshToken{RefreshTokenRecord: t}
+	return nil
+}
+
+func (s *MemoryRefreshTokenStore) UseRefreshToken(ctx context.Context, tokenHash string, at time.Time) (RefreshTokenRecord, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	t, ok := s.tokens[tokenHash]
+	if !ok {
+		return RefreshTokenRecord{TokenHash: tokenHash}, errRefreshTokenNotFound
+	}
+	if t.used || t.revoked {
+		return t.RefreshTokenRecord, errRefreshTokenReused
+	}
+	t.used = true
+	return t.RefreshTokenRecord, nil
+}
+
+func (s *MemoryRefreshTokenStore) RevokeRefreshTokenFamily(ctx context.Context, familyID string, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tokens {
+		if t.FamilyID == familyID {
+			t.revoked = true
+		}
+	}
+	return nil
+}
+
+func (s *MemoryRefreshTokenStore) RevokeUserRefreshTokens(ctx context.Context, userID int, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.tokens {
+		if t.UserID == userID {
+			t.revoked = true
+		}
+	}
+	return nil
+}
+
+// MemoryRevocationStore is an in-memory RevocationStore for tests.
+type MemoryRevocationStore struct {
+	mu       sync.Mutex
+	tokens   map[string]time.Time
+	sessions map[string]time.Time
+}
+
+func NewMemoryRevocationStore() *MemoryRevocationStore {
+	return &MemoryRevocationStore{tokens: map[string]time.Time{}, sessions: map[string]time.Time{}}
+}
+
+func (s *MemoryRevocationStore) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[jti] = expiresAt
+	return nil
+}
+
+func (s *MemoryRevocationStore) RevokeSessions(ctx context.Context, username string, before, expiresAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if before.After(s.sessions[username]) {
+		s.sessions[username] = before
+	}
+	return nil
+}
+
+func (s *MemoryRevocationStore) IsRevoked(ctx context.Context, jti, username string, issuedAt time.Time) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.tokens[jti]; ok {
+		return true, nil
+	}
+	before, ok := s.sessions[username]
+	return ok && !issuedAt.After(before), nil
+}
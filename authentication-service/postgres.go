@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// uniqueViolation is the Postgres error code for a duplicate key.
+const uniqueViolation = "23505"
+
+// PostgresUserRepository stores users in the users table.
+type PostgresUserRepository struct {
+	db *sql.DB
+}
+
+func NewPostgresUserRepository(db *sql.DB) *PostgresUserRepository {
+	return &PostgresUserRepository{db: db}
+}
+
+func (r *PostgresUserRepository) CreateUser(ctx context.Context, u UserRecord) (int, error) {
+	var id int
+	err := r.db.QueryRowContext(ctx, `INSERT INTO users (username, password_hash, location, phone, email)
+		VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+		u.Username, u.PasswordHash, u.Location, u.Phone, u.Email).Scan(&id)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+		return 0, errUserExists
+	}
+	return id, err
+}
+
+func (r *PostgresUserRepository) GetUserByUsername(ctx context.Context, username string) (UserRecord, error) {
+	return r.getUser(ctx, "username=$1", username)
+}
+
+func (r *PostgresUserRepository) GetUserByID(ctx context.Context, id int) (UserRecord, error) {
+	return r.getUser(ctx, "id=$1", id)
+}
+
+func (r *PostgresUserRepository) UpdateUserProfile(ctx context.Context, u UserRecord) error {
+	result, err := r.db.ExecContext(ctx, "UPDATE users SET email=$2, location=$3, phone=$4 WHERE id=$1",
+		u.ID, u.Email, u.Location, u.Phone)
+	var pqErr *pq.Error
+	if errors.As(err, &pqErr) && pqErr.Code == uniqueViolation {
+		return errUserExists
+	}
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err == nil && n == 0 {
+		return errUserNotFound
+	}
+	return err
+}
+
+func (r *PostgresUserRepository) getUser(ctx context.Context, where string, arg interface{}) (UserRecord, error) {
+	var u UserRecord
+	var location sql.NullString
+	var createdAt sql.NullTime
+	err := r.db.QueryRowContext(ctx, `SELECT id, username, password_hash, email, location, phone, created_at
+		FROM users WHERE `+where, arg).
+		Scan(&u.ID, &u.Username, &u.PasswordHash, &u.Email, &location, &u.Phone, &createdAt)
+	if err == sql.ErrNoRows {
+		return u, errUserNotFound
+	}
+	u.Location = location.String
+	u.CreatedAt = createdAt.Time
+	return u, err
+}
+
+// PostgresRefreshTokenStore stores refresh tokens in the refresh_tokens table. Times are
+// stored in UTC, since the columns have no time zone.
+type PostgresRefreshTokenStore struct {
+	db *sql.DB
+}
+
+func NewPostgresRefreshTokenStore(db *sql.DB) *PostgresRefreshTokenStore {
+	return &PostgresRefreshTokenStore{db: db}
+}
+
+func (s *PostgresRefreshTokenStore) CreateRefreshToken(ctx context.Context, t RefreshTokenRecord) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO refresh_tokens (token_hash, family_id, user_id, expires_at, created_at)
+		VALUES ($1, $2, $3, $4, $5)`, t.TokenHash, t.FamilyID, t.UserID, t.ExpiresAt.UTC(), t.CreatedAt.UTC())
+	return err
+}
+
+// UseRefreshToken marks the token used in the same statement that checks it is unused,
+// so that of two requests with the same token only one succeeds.
+func (s *PostgresRefreshTokenStore) UseRefreshToken(ctx context.Context, tokenHash string, at time.Time) (RefreshTokenRecord, error) {
+	t := RefreshTokenRecord{TokenHash: tokenHash}
+	err := s.db.QueryRowContext(ctx, `UPDATE refresh_tokens SET used_at=$2
+		WHERE token_hash=$1 AND used_at IS NULL AND revoked_at IS NULL
+		RETURNING family_id, user_id, expires_at, created_at`, tokenHash, at.UTC()).
+		Scan(&t.FamilyID, &t.UserID, &t.ExpiresAt, &t.CreatedAt)
+	if err != sql.ErrNoRows {
+		return t, err
+	}
+
+	err = s.db.QueryRowContext(ctx, `SELECT family_id, user_id, expires_at, created_at
+		FROM refresh_tokens WHERE token_hash=$1`, tokenHash).
+		Scan(&t.FamilyID, &t.UserID, &t.ExpiresAt, &t.CreatedAt)
+	if err == sql.ErrNoRows {
+		return t, errRefreshTokenNotFound
+	}
+	if err != nil {
+		return t, err
+	}
+	return t, errRefreshTokenReused
+}
+
+func (s *PostgresRefreshTokenStore) RevokeRefreshTokenFamily(ctx context.Context, familyID string, at time.Time) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE refresh_tokens SET revoked_at=$2 WHERE family_id=$1 AND revoked_at IS NULL",
+		familyID, at.UTC())
+	return err
+}
+
+func (s *PostgresRefreshTokenStore) RevokeUserRefreshTokens(ctx context.Context, userID int, at time.Time) error {
+	_, err := s.db.ExecContext(ctx, "UPDATE refresh_tokens SET revoked_at=$2 WHERE user_id=$1 AND revoked_at IS NULL",
+		userID, at.UTC())
+	return err
+}
+
+// PostgresRevocationStore stores revocations in the revoked_tokens and revoked_sessions
+// tables. Times are stored in UTC, since the columns have no time zone.
+type PostgresRevocationStore struct {
+	db *sql.DB
+}
+
+func NewPostgresRevocationStore(db *sql.DB) *PostgresRevocationStore {
+	return &PostgresRevocationStore{db: db}
+}
+
+func (s *PostgresRevocationStore) RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2)
+		ON CONFLICT (jti) DO NOTHING`, jti, expiresAt.UTC())
+	return err
+}
+
+// RevokeSessions keeps one row per user and only ever moves it later, so an older
+// revocation arriving late does not undo a newer one.
+func (s *PostgresRevocationStore) RevokeSessions(ctx context.Context, username string, before, expiresAt time.Time) error {
+	_, err := s.db.ExecContext(ctx, `INSERT INTO revoked_sessions (username, revoked_before, expires_at) VALUES ($1, $2, $3)
+		ON CONFLICT (username) DO UPDATE SET
+			revoked_before = GREATEST(revoked_sessions.revoked_before, EXCLUDED.revoked_before),
+			expires_at = GREATEST(revoked_sessions.expires_at, EXCLUDED.expires_at)`,
+		username, before.UTC(), expiresAt.UTC())
+	return err
+}
+
+func (s *PostgresRevocationStore) IsRevoked(ctx context.Context, jti, username string, issuedAt time.Time) (bool, error) {
+	var revoked bool
+	err := s.db.QueryRowContext(ctx, `SELECT
+		EXISTS (SELECT 1 FROM revoked_tokens WHERE jti=$1) OR
+		EXISTS (SELECT 1 FROM revoked_sessions WHERE username=$2 AND revoked_before >= $3)`,
+		jti, username, issuedAt.UTC()).Scan(&revoked)
+	return revoked, err
+}
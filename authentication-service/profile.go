@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Profile is what a user can see and change about their account.
+type Profile struct {
+	ID        int       `json:"id"`
+	Username  string    `json:"username"`
+	Email     string    `json:"email"`
+	Location  string    `json:"location"`
+	Phone     string    `json:"phone"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ProfileUpdate is the body of PATCH /auth/me. Fields left out are not changed.
+// Changing the email or phone, which can be used to take over the account, also needs
+// the current password.
+type ProfileUpdate struct {
+	Email           *string `json:"email"`
+	Location        *string `json:"location"`
+	Phone           *string `json:"phone"`
+	CurrentPassword string  `json:"current_password"`
+}
+
+func profileOf(u UserRecord) Profile {
+	return Profile{ID: u.ID, Username: u.Username, Email: u.Email, Location: u.Location, Phone: u.Phone, CreatedAt: u.CreatedAt}
+}
+
+// currentUser returns the user a token was issued to. Tokens issued before they named
+// the user ID in their subject are looked up by username.
+func (s *Server) currentUser(r *http.Request, claims *Claims) (UserRecord, error) {
+	if id, err := strconv.Atoi(claims.Subject); err == nil {
+		return s.users.GetUserByID(r.Context(), id)
+	}
+	return s.users.GetUserByUsername(r.Context(), claims.Username)
+}
+
+// Me godoc
+// @Summary Get the current user's profile
+// @Tags auth
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Success 200 {object} Profile
+// @Failure 401 {object} map[string]string{"status": "unauthorized"}
+// @Failure 500 {object} map[string]string{"status": "server error"}
+// @Router /auth/me [get]
+func (s *Server) Me(w http.ResponseWriter, r *http.Request) {
+	claims, err := s.authenticate(r)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Rejected profile request", "error", err)
+		http.Error(w, `{"status": "unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+	user, err := s.currentUser(r, claims)
+	if err == errUserNotFound {
+		http.Error(w, `{"status": "unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error querying database", "error", err)
+		http.Error(w, `{"status": "server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(profileOf(user))
+}
+
+// UpdateMe godoc
+// @Summary Update the current user's profile
+// @Description Change the email, location or phone of the current user. Changing the email or phone needs the current password.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param update body ProfileUpdate true "Fields to change"
+// @Success 200 {object} Profile
+// @Failure 400 {string} string "Invalid request payload"
+// @Failure 401 {object} map[string]string{"status": "unauthorized"}
+// @Failure 403 {object} map[string]string{"status": "current password required"}
+// @Failure 409 {object} map[string]string{"status": "email already in use"}
+// @Failure 500 {object} map[string]string{"status": "server error"}
+// @Router /auth/me [patch]
+func (s *Server) UpdateMe(w http.ResponseWriter, r *http.Request) {
+	claims, err := s.authenticate(r)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Rejected profile update", "error", err)
+		http.Error(w, `{"status": "unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	var update ProfileUpdate
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&update); err != nil {
+		slog.WarnContext(r.Context(), "Error decoding JSON", "error", err)
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+	if msg := update.validate(); msg != "" {
+		http.Error(w, "Invalid request payload: "+msg, http.StatusBadRequest)
+		return
+	}
+
+	user, err := s.currentUser(r, claims)
+	if err == errUserNotFound {
+		http.Error(w, `{"status": "unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error querying database", "error", err)
+		http.Error(w, `{"status": "server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	sensitive := (update.Email != nil && *update.Email != user.Email) || (update.Phone != nil && *update.Phone != user.Phone)
+	if sensitive {
+		if update.CurrentPassword == "" {
+			http.Error(w, `{"status": "current password required"}`, http.StatusForbidden)
+			return
+		}
+		if err := bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(update.CurrentPassword)); err != nil {
+			slog.WarnContext(r.Context(), "Rejected profile update with wrong password", "user_id", user.ID)
+			http.Error(w, `{"status": "invalid credentials"}`, http.StatusForbidden)
+			return
+		}
+	}
+
+	if update.Email != nil {
+		user.Email = *update.Email
+	}
+	if update.Location != nil {
+		user.Location = *update.Location
+	}
+	if update.Phone != nil {
+		user.Phone = *update.Phone
+	}
+	err = s.users.UpdateUserProfile(r.Context(), user)
+	if err == errUserExists {
+		http.Error(w, `{"status": "email already in use"}`, http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error updating user", "error", err)
+		http.Error(w, `{"status": "server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if sensitive {
+		slog.InfoContext(r.Context(), "Changed contact details", "user_id", user.ID)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(profileOf(user))
+}
+
+// validate returns what is wrong with the update, or "" if nothing is. The limits are
+// those of the users table.
+func (u ProfileUpdate) validate() string {
+	if u.Email == nil && u.Location == nil && u.Phone == nil {
+		return "nothing to update"
+	}
+	if u.Email != nil {
+		if addr, err := mail.ParseAddress(*u.Email); err != nil || addr.Address != *u.Email || len(*u.Email) > 55 {
+			return "invalid email"
+		}
+	}
+	if u.Phone != nil && (*u.Phone == "" || len(*u.Phone) > 15) {
+		return "invalid phone"
+	}
+	return ""
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func requestProfile(t *testing.T, s *Server, method, token, body string) (int, Profile) {
+	t.Helper()
+	var reader io.Reader = http.NoBody
+	if body != "" {
+		reader = strings.NewReader(body)
+	}
+	req, _ := http.NewRequest(method, "/auth/me", reader)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+
+	var profile Profile
+	if rr.Code == http.StatusOK {
+		if err := json.NewDecoder(rr.Body).Decode(&profile); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rr.Code, profile
+}
+
+func TestTokensNameUserID(t *testing.T) {
+	now := time.Now()
+	s := newSessionTestServer(t, &now)
+	login := loginAs(t, s, "phoneuser")
+
+	var claims Claims
+	if _, _, err := jwt.NewParser().ParseUnverified(login.Token, &claims); err != nil {
+		t.Fatal(err)
+	}
+	user, _ := s.users.GetUserByUsername(context.Background(), "phoneuser")
+	if claims.Subject != strconv.Itoa(user.ID) || claims.Username != "phoneuser" {
+		t.Errorf("token names subject %q and username %q, want %d and phoneuser", claims.Subject, claims.Username, user.ID)
+	}
+}
+
+func TestGetProfile(t *testing.T) {
+	now := time.Now()
+	s := newSessionTestServer(t, &now)
+	login := loginAs(t, s, "phoneuser")
+
+	code, profile := requestProfile(t, s, "GET", login.Token, "")
+	if code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", code, http.StatusOK)
+	}
+	if profile.Username != "phoneuser" || profile.Email != "phoneuser@example.com" || profile.ID == 0 {
+		t.Errorf("unexpected profile %+v", profile)
+	}
+	if code, _ := requestProfile(t, s, "GET", "", ""); code != http.StatusUnauthorized {
+		t.Errorf("without token: status %v, want %v", code, http.StatusUnauthorized)
+	}
+}
+
+func TestUpdateProfile(t *testing.T) {
+	now := time.Now()
+	s := newSessionTestServer(t, &now)
+	login := loginAs(t, s, "phoneuser")
+
+	tests := []struct {
+		name string
+		body string
+		code int
+	}{
+		{"location needs no password", `{"location":"Nairobi"}`, http.StatusOK},
+		{"email without password", `{"email":"new@example.com"}`, http.StatusForbidden},
+		{"phone with wrong password", `{"phone":"+254700000000","current_password":"wrong"}`, http.StatusForbidden},
+		{"phone with password", `{"phone":"+254700000000","current_password":"password"}`, http.StatusOK},
+		{"unchanged phone needs no password", `{"phone":"+254700000000"}`, http.StatusOK},
+		{"email taken by another user", `{"email":"admin@example.com","current_password":"password"}`, http.StatusConflict},
+		{"invalid email", `{"email":"Phone User <new@example.com>","current_password":"password"}`, http.StatusBadRequest},
+		{"phone too long", `{"phone":"+2547000000000000","current_password":"password"}`, http.StatusBadRequest},
+		{"nothing to update", `{}`, http.StatusBadRequest},
+		{"unknown field", `{"username":"admin"}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		if code, _ := requestProfile(t, s, "PATCH", login.Token, tt.body); code != tt.code {
+			t.Errorf("%s: status %v, want %v", tt.name, code, tt.code)
+		}
+	}
+
+	code, profile := requestProfile(t, s, "GET", login.Token, "")
+	if code != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", code, http.StatusOK)
+	}
+	if profile.Location != "Nairobi" || profile.Phone != "+254700000000" || profile.Email != "phoneuser@example.com" {
+		t.Errorf("unexpected profile after updates %+v", profile)
+	}
+}
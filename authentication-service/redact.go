@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const redactedValue = "[REDACTED]"
+
+// Field names are matched case-insensitively as substrings, so "phone"
+// also covers "phone_number" and "token" covers "refresh_token".
+var defaultRedactFields = []string{
+	"password", "phone", "email", "card", "cvv", "cvc", "expiry",
+	"authorization", "cookie", "token", "secret", "signature",
+}
+
+// redactFields is the denylist in use. Logging is process-wide, so main sets it once
+// from the redact_fields setting.
+var redactFields = defaultRedactFields
+
+func isSensitive(name string) bool {
+	name = strings.ToLower(name)
+	for _, field := range redactFields {
+		if field != "" && strings.Contains(name, strings.ToLower(field)) {
+			return true
+		}
+	}
+	return false
+}
+
+// redactBody returns body with every denylisted JSON field masked. Bodies that are
+// not JSON are not logged at all, since we cannot tell what they contain.
+func redactBody(body []byte) string {
+	if len(bytes.TrimSpace(body)) == 0 {
+		return ""
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	decoder.UseNumber()
+	var value interface{}
+	if err := decoder.Decode(&value); err != nil {
+		return fmt.Sprintf("[%d bytes, not JSON]", len(body))
+	}
+
+	redacted, err := json.Marshal(redactValue(value))
+	if err != nil {
+		return fmt.Sprintf("[%d bytes, not JSON]", len(body))
+	}
+	return string(redacted)
+}
+
+func redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, item := range v {
+			if isSensitive(key) {
+				v[key] = redactedValue
+			} else {
+				v[key] = redactValue(item)
+			}
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = redactValue(item)
+		}
+	}
+	return value
+}
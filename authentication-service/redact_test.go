@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// captureLogs sends JSON logs at debug level to a buffer for the rest of the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	handler := slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+	slog.SetDefault(slog.New(contextHandler{handler}))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+func TestLoggingMiddlewareRedacts(t *testing.T) {
+	redactFields = defaultRedactFields
+
+	logs := captureLogs(t)
+
+	handler := loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"Login successful","token":"abc.def.ghi"}`))
+	}))
+
+	body := `{"username":"testuser","password":"hunter2","email":"test@example.com","phone":"1234567890"}`
+	req, _ := http.NewRequest("POST", "/auth/register", strings.NewReader(body))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	for _, secret := range []string{"hunter2", "test@example.com", "1234567890", "abc.def.ghi"} {
+		if strings.Contains(logs.String(), secret) {
+			t.Errorf("logs contain %q:\n%s", secret, logs.String())
+		}
+	}
+	if !strings.Contains(logs.String(), "testuser") {
+		t.Errorf("logs should keep non-sensitive fields:\n%s", logs.String())
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	errUserNotFound         = errors.New("user not found")
+	errUserExists           = errors.New("user already exists")
+	errRefreshTokenNotFound = errors.New("refresh token not found")
+	errRefreshTokenReused   = errors.New("refresh token already used")
+)
+
+// UserRepository stores registered users.
+type UserRepository interface {
+	// CreateUser stores a new user and returns its ID, or errUserExists if the username
+	// or email is taken.
+	CreateUser(ctx context.Context, u UserRecord) (int, error)
+	// GetUserByUsername returns a user, or errUserNotFound.
+	GetUserByUsername(ctx context.Context, username string) (UserRecord, error)
+	// GetUserByID returns a user, or errUserNotFound.
+	GetUserByID(ctx context.Context, id int) (UserRecord, error)
+	// UpdateUserProfile replaces the email, location and phone of the user with u.ID. It
+	// returns errUserNotFound if there is no such user, or errUserExists if the email
+	// belongs to another user.
+	UpdateUserProfile(ctx context.Context, u UserRecord) error
+}
+
+// UserRecord is a stored user.
+type UserRecord struct {
+	ID           int
+	Username     string
+	PasswordHash string
+	Email        string
+	Location     string
+	Phone        string
+	CreatedAt    time.Time
+}
+
+// RefreshTokenStore stores refresh tokens by the hash of the token. Each token can be
+// used once; using it issues the next token in its family.
+type RefreshTokenStore interface {
+	// CreateRefreshToken stores a new, unused refresh token.
+	CreateRefreshToken(ctx context.Context, t RefreshTokenRecord) error
+	// UseRefreshToken marks the token with tokenHash as used at the given time and
+	// returns it. It returns errRefreshTokenNotFound for an unknown token, and the token
+	// with errRefreshTokenReused if it was already used or revoked.
+	UseRefreshToken(ctx context.Context, tokenHash string, at time.Time) (RefreshTokenRecord, error)
+	// RevokeRefreshTokenFamily revokes every token of a family that is not revoked yet.
+	RevokeRefreshTokenFamily(ctx context.Context, familyID string, at time.Time) error
+	// RevokeUserRefreshTokens revokes every token of a user that is not revoked yet.
+	RevokeUserRefreshTokens(ctx context.Context, userID int, at time.Time) error
+}
+
+// RefreshTokenRecord is a stored refresh token. Tokens issued by rotating one another
+// share a family, which starts at login.
+type RefreshTokenRecord struct {
+	TokenHash string
+	FamilyID  string
+	UserID    int
+	ExpiresAt time.Time
+	CreatedAt time.Time
+}
+
+// RevocationStore records access tokens that must be refused before they expire. The
+// gateway reads the same records, so a revocation applies to every service.
+type RevocationStore interface {
+	// RevokeToken revokes the access token with the given ID until it expires.
+	RevokeToken(ctx context.Context, jti string, expiresAt time.Time) error
+	// RevokeSessions revokes every access token of username issued before the given time.
+	// The revocation can be forgotten after expiresAt, once those tokens have expired.
+	RevokeSessions(ctx context.Context, username string, before, expiresAt time.Time) error
+	// IsRevoked reports whether a token with the given ID, user and issue time is revoked.
+	IsRevoked(ctx context.Context, jti, username string, issuedAt time.Time) (bool, error)
+}
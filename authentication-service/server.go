@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	httpSwagger "github.com/swaggo/http-swagger"
+)
+
+// Server is the authentication service. Users, refresh tokens and revocations are read
+// from the stores given to NewServer and tokens are signed with its keys and dated with
+// its clock, so tests can run without a database.
+type Server struct {
+	config        Config
+	keys          *KeySet
+	users         UserRepository
+	refreshTokens RefreshTokenStore
+	revocations   RevocationStore
+	now           func() time.Time
+}
+
+func NewServer(config Config, keys *KeySet, users UserRepository, refreshTokens RefreshTokenStore, revocations RevocationStore, now func() time.Time) *Server {
+	return &Server{config: config, keys: keys, users: users, refreshTokens: refreshTokens, revocations: revocations, now: now}
+}
+
+// Handler returns the service's routes with request ID and logging middleware.
+func (s *Server) Handler() http.Handler {
+	r := mux.NewRouter()
+	r.Use(requestIDMiddleware)
+	r.Use(loggingMiddleware)
+
+	r.HandleFunc("/.well-known/jwks.json", s.JWKS).Methods("GET")
+	r.HandleFunc("/auth/register", s.Register).Methods("POST")
+	r.HandleFunc("/auth/login", s.Login).Methods("POST")
+	r.HandleFunc("/auth/refresh", s.Refresh).Methods("POST")
+	r.HandleFunc("/auth/logout", s.Logout).Methods("POST")
+	r.HandleFunc("/auth/me", s.Me).Methods("GET")
+	r.HandleFunc("/auth/me", s.UpdateMe).Methods("PATCH")
+	r.HandleFunc("/auth/admin/users/{username}/revoke-sessions", s.adminOnly(s.RevokeSessions)).Methods("POST")
+
+	r.PathPrefix("/swagger").Handler(httpSwagger.WrapHandler)
+
+	return r
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/gorilla/mux"
+)
+
+var (
+	errMissingToken            = errors.New("missing bearer token")
+	errInvalidToken            = errors.New("invalid token")
+	errRevokedToken            = errors.New("token revoked")
+	errUnexpectedSigningMethod = errors.New("unexpected signing method")
+)
+
+// authenticate returns the claims of the bearer token on r, which must be valid and
+// not revoked.
+func (s *Server) authenticate(r *http.Request) (*Claims, error) {
+	header := r.Header.Get("Authorization")
+	tokenString := strings.TrimPrefix(header, "Bearer ")
+	if tokenString == "" || tokenString == header {
+		return nil, errMissingToken
+	}
+
+	now := s.now()
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, s.keys.keyFunc(now),
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithExpirationRequired(),
+		jwt.WithTimeFunc(func() time.Time { return now }))
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid || claims.Username == "" || claims.ID == "" || claims.IssuedAt == nil {
+		return nil, errInvalidToken
+	}
+
+	revoked, err := s.revocations.IsRevoked(r.Context(), claims.ID, claims.Username, claims.IssuedAt.Time)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, errRevokedToken
+	}
+	return claims, nil
+}
+
+// isAdmin reports whether username is listed in the admin_users setting.
+func (s *Server) isAdmin(username string) bool {
+	for _, admin := range s.config.AdminUsers {
+		if admin == username {
+			return true
+		}
+	}
+	return false
+}
+
+// adminOnly restricts a handler to the users listed in the admin_users setting.
+func (s *Server) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		claims, err := s.authenticate(r)
+		if err != nil {
+			slog.WarnContext(r.Context(), "Rejected admin request", "error", err)
+			http.Error(w, `{"status": "unauthorized"}`, http.StatusUnauthorized)
+			return
+		}
+		if !s.isAdmin(claims.Username) {
+			slog.WarnContext(r.Context(), "Rejected admin request from non-admin user", "username", claims.Username)
+			http.Error(w, `{"status": "forbidden"}`, http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// Logout godoc
+// @Summary Log out
+// @Description Revoke the bearer token and the refresh tokens of the session it belongs to.
+// @Tags auth
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Success 200 {object} map[string]string{"status": "Logged out"}
+// @Failure 401 {object} map[string]string{"status": "unauthorized"}
+// @Failure 500 {object} map[string]string{"status": "server error"}
+// @Router /auth/logout [post]
+func (s *Server) Logout(w http.ResponseWriter, r *http.Request) {
+	claims, err := s.authenticate(r)
+	if err != nil {
+		slog.WarnContext(r.Context(), "Rejected logout", "error", err)
+		http.Error(w, `{"status": "unauthorized"}`, http.StatusUnauthorized)
+		return
+	}
+
+	now := s.now()
+	if err := s.revocations.RevokeToken(r.Context(), claims.ID, claims.ExpiresAt.Time); err != nil {
+		slog.ErrorContext(r.Context(), "Error revoking token", "error", err)
+		http.Error(w, `{"status": "server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if claims.SessionID != "" {
+		if err := s.refreshTokens.RevokeRefreshTokenFamily(r.Context(), claims.SessionID, now); err != nil {
+			slog.ErrorContext(r.Context(), "Error revoking refresh tokens", "error", err)
+			http.Error(w, `{"status": "server error"}`, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "Logged out"})
+}
+
+// RevokeSessions godoc
+// @Summary Revoke all sessions of a user
+// @Description Revoke every access and refresh token issued to a user so far, e.g. when their phone is stolen. Admin only.
+// @Tags admin
+// @Produce json
+// @Param Authorization header string true "Bearer token"
+// @Param username path string true "Username"
+// @Success 200 {object} map[string]string{"status": "Sessions revoked"}
+// @Failure 401 {object} map[string]string{"status": "unauthorized"}
+// @Failure 403 {object} map[string]string{"status": "forbidden"}
+// @Failure 404 {object} map[string]string{"status": "user not found"}
+// @Failure 500 {object} map[string]string{"status": "server error"}
+// @Router /auth/admin/users/{username}/revoke-sessions [post]
+func (s *Server) RevokeSessions(w http.ResponseWriter, r *http.Request) {
+	user, err := s.users.GetUserByUsername(r.Context(), mux.Vars(r)["username"])
+	if err == errUserNotFound {
+		http.Error(w, `{"status": "user not found"}`, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error querying database", "error", err)
+		http.Error(w, `{"status": "server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	// Token issue times are in whole seconds, so a token issued later in this second is
+	// revoked too rather than risk missing one issued earlier in it
+	now := s.now()
+	before := now.Truncate(time.Second)
+	err = s.revocations.RevokeSessions(r.Context(), user.Username, before, now.Add(s.config.AccessTokenTTL))
+	if err == nil {
+		err = s.refreshTokens.RevokeUserRefreshTokens(r.Context(), user.ID, now)
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error revoking sessions", "error", err)
+		http.Error(w, `{"status": "server error"}`, http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "Revoked all sessions", "user_id", user.ID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(map[string]string{"status": "Sessions revoked"})
+}
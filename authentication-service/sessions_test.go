@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newSessionTestServer returns a server with the users "phoneuser" and "admin", of whom
+// only admin is listed in admin_users.
+func newSessionTestServer(t *testing.T, now *time.Time) *Server {
+	t.Helper()
+	cfg := testServer.config
+	cfg.AdminUsers = []string{"admin"}
+	users := NewMemoryUserRepository()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	for _, username := range []string{"phoneuser", "admin"} {
+		if _, err := users.CreateUser(context.Background(), UserRecord{Username: username, PasswordHash: string(hash), Email: username + "@example.com"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return NewServer(cfg, testServer.keys, users, NewMemoryRefreshTokenStore(), NewMemoryRevocationStore(), func() time.Time { return *now })
+}
+
+func loginAs(t *testing.T, s *Server, username string) LoginResponse {
+	t.Helper()
+	code, response := postTokens(t, s, "/auth/login", `{"username":"`+username+`","password":"password"}`)
+	if code != http.StatusOK {
+		t.Fatalf("login as %s: status %v", username, code)
+	}
+	return response
+}
+
+func postWithToken(s *Server, path, token string) int {
+	req, _ := http.NewRequest("POST", path, http.NoBody)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	return rr.Code
+}
+
+func TestLogoutRevokesTokenAndSession(t *testing.T) {
+	now := time.Now()
+	s := newSessionTestServer(t, &now)
+	session := loginAs(t, s, "phoneuser")
+	other := loginAs(t, s, "phoneuser")
+
+	if code := postWithToken(s, "/auth/logout", session.Token); code != http.StatusOK {
+		t.Fatalf("logout: status %v, want %v", code, http.StatusOK)
+	}
+	if code := postWithToken(s, "/auth/logout", session.Token); code != http.StatusUnauthorized {
+		t.Errorf("logout with revoked token: status %v, want %v", code, http.StatusUnauthorized)
+	}
+	if code, _ := postTokens(t, s, "/auth/refresh", refreshBody(session.RefreshToken)); code != http.StatusUnauthorized {
+		t.Errorf("refresh after logout: status %v, want %v", code, http.StatusUnauthorized)
+	}
+
+	// Logging out of one session leaves the others alone
+	if code, _ := postTokens(t, s, "/auth/refresh", refreshBody(other.RefreshToken)); code != http.StatusOK {
+		t.Errorf("refresh in another session: status %v, want %v", code, http.StatusOK)
+	}
+	if code := postWithToken(s, "/auth/logout", ""); code != http.StatusUnauthorized {
+		t.Errorf("logout without token: status %v, want %v", code, http.StatusUnauthorized)
+	}
+}
+
+func TestRevokeSessions(t *testing.T) {
+	now := time.Now()
+	s := newSessionTestServer(t, &now)
+	victim := loginAs(t, s, "phoneuser")
+	admin := loginAs(t, s, "admin")
+
+	if code := postWithToken(s, "/auth/admin/users/admin/revoke-sessions", victim.Token); code != http.StatusForbidden {
+		t.Errorf("revoke as non-admin: status %v, want %v", code, http.StatusForbidden)
+	}
+	if code := postWithToken(s, "/auth/admin/users/nobody/revoke-sessions", admin.Token); code != http.StatusNotFound {
+		t.Errorf("revoke unknown user: status %v, want %v", code, http.StatusNotFound)
+	}
+	if code := postWithToken(s, "/auth/admin/users/phoneuser/revoke-sessions", admin.Token); code != http.StatusOK {
+		t.Fatalf("revoke: status %v, want %v", code, http.StatusOK)
+	}
+
+	if code := postWithToken(s, "/auth/logout", victim.Token); code != http.StatusUnauthorized {
+		t.Errorf("token issued before revocation: status %v, want %v", code, http.StatusUnauthorized)
+	}
+	if code, _ := postTokens(t, s, "/auth/refresh", refreshBody(victim.RefreshToken)); code != http.StatusUnauthorized {
+		t.Errorf("refresh after revocation: status %v, want %v", code, http.StatusUnauthorized)
+	}
+
+	now = now.Add(time.Second)
+	fresh := loginAs(t, s, "phoneuser")
+	if code := postWithToken(s, "/auth/logout", fresh.Token); code != http.StatusOK {
+		t.Errorf("token issued after revocation: status %v, want %v", code, http.StatusOK)
+	}
+}
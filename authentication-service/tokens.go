@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// RefreshRequest is the body of /auth/refresh.
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token"`
+}
+
+// newOpaqueToken returns a random URL-safe token.
+func newOpaqueToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashRefreshToken returns what is stored for a refresh token. Only the hash is
+// stored, so a copy of the table cannot be used to log in.
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// issueTokens signs an access token for user and stores a new refresh token in
+// familyID, or in a new family if familyID is empty.
+func (s *Server) issueTokens(ctx context.Context, user UserRecord, familyID string) (LoginResponse, error) {
+	now := s.now()
+	var err error
+	if familyID == "" {
+		if familyID, err = newOpaqueToken(); err != nil {
+			return LoginResponse{}, err
+		}
+	}
+	jti, err := newOpaqueToken()
+	if err != nil {
+		return LoginResponse{}, err
+	}
+	claims := &Claims{
+		Username:  user.Username,
+		SessionID: familyID,
+		RegisteredClaims: jwt.RegisteredClaims{
+			Subject:   strconv.Itoa(user.ID),
+			ID:        jti,
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(s.config.AccessTokenTTL)),
+		},
+	}
+	accessToken, err := s.keys.sign(claims, now)
+	if err != nil {
+		return LoginResponse{}, err
+	}
+
+	refreshToken, err := newOpaqueToken()
+	if err != nil {
+		return LoginResponse{}, err
+	}
+	err = s.refreshTokens.CreateRefreshToken(ctx, RefreshTokenRecord{
+		TokenHash: hashRefreshToken(refreshToken),
+		FamilyID:  familyID,
+		UserID:    user.ID,
+		ExpiresAt: now.Add(s.config.RefreshTokenTTL),
+		CreatedAt: now,
+	})
+	if err != nil {
+		return LoginResponse{}, err
+	}
+
+	return LoginResponse{
+		Status:       "Login successful",
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(s.config.AccessTokenTTL / time.Second),
+	}, nil
+}
+
+// Refresh godoc
+// @Summary Refresh an access token
+// @Description Exchange a refresh token for a new access token and refresh token. Each refresh token can be used once; using one again revokes every token descended from the same login.
+// @Tags auth
+// @Accept json
+// @Produce json
+// @Param request body RefreshRequest true "Refresh token"
+// @Success 200 {object} LoginResponse "New tokens"
+// @Failure 400 {string} string "Invalid request payload"
+// @Failure 401 {object} map[string]string{"status": "invalid refresh token"}
+// @Failure 500 {object} map[string]string{"status": "server error"}
+// @Router /auth/refresh [post]
+func (s *Server) Refresh(w http.ResponseWriter, r *http.Request) {
+	var request RefreshRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil || request.RefreshToken == "" {
+		slog.WarnContext(r.Context(), "Error decoding JSON", "error", err)
+		http.Error(w, "Invalid request payload", http.StatusBadRequest)
+		return
+	}
+
+	now := s.now()
+	token, err := s.refreshTokens.UseRefreshToken(r.Context(), hashRefreshToken(request.RefreshToken), now)
+	switch {
+	case errors.Is(err, errRefreshTokenReused):
+		// Either the client or someone who stole the token has already rotated it, and
+		// we cannot tell which, so neither keeps the session
+		slog.WarnContext(r.Context(), "Refresh token reused, revoking its family", "user_id", token.UserID)
+		if err := s.refreshTokens.RevokeRefreshTokenFamily(r.Context(), token.FamilyID, now); err != nil {
+			slog.ErrorContext(r.Context(), "Error revoking refresh tokens", "error", err)
+		}
+		http.Error(w, `{"status": "invalid refresh token"}`, http.StatusUnauthorized)
+		return
+	case errors.Is(err, errRefreshTokenNotFound):
+		http.Error(w, `{"status": "invalid refresh token"}`, http.StatusUnauthorized)
+		return
+	case err != nil:
+		slog.ErrorContext(r.Context(), "Error using refresh token", "error", err)
+		http.Error(w, `{"status": "server error"}`, http.StatusInternalServerError)
+		return
+	}
+	if !now.Before(token.ExpiresAt) {
+		http.Error(w, `{"status": "invalid refresh token"}`, http.StatusUnauthorized)
+		return
+	}
+
+	user, err := s.users.GetUserByID(r.Context(), token.UserID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error querying database", "error", err)
+		http.Error(w, `{"status": "server error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	response, err := s.issueTokens(r.Context(), user, token.FamilyID)
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error issuing tokens", "error", err)
+		http.Error(w, `{"status": "server error"}`, http.StatusInternalServerError)
+		return
+	}
+	response.Status = "Token refreshed"
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// newRefreshTestServer returns a server with one user, "refreshuser", whose clock
+// reads from now.
+func newRefreshTestServer(t *testing.T, now *time.Time) *Server {
+	t.Helper()
+	users := NewMemoryUserRepository()
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	if _, err := users.CreateUser(context.Background(), UserRecord{Username: "refreshuser", PasswordHash: string(hash), Email: "refresh@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	return NewServer(testServer.config, testServer.keys, users, NewMemoryRefreshTokenStore(), NewMemoryRevocationStore(), func() time.Time { return *now })
+}
+
+func postTokens(t *testing.T, s *Server, path, body string) (int, LoginResponse) {
+	t.Helper()
+	req, _ := http.NewRequest("POST", path, strings.NewReader(body))
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+
+	var response LoginResponse
+	if rr.Code == http.StatusOK {
+		if err := json.NewDecoder(rr.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return rr.Code, response
+}
+
+func refreshBody(token string) string {
+	return `{"refresh_token":"` + token + `"}`
+}
+
+func TestRefreshRotatesTokens(t *testing.T) {
+	now := time.Now()
+	s := newRefreshTestServer(t, &now)
+
+	code, login := postTokens(t, s, "/auth/login", `{"username":"refreshuser","password":"password"}`)
+	if code != http.StatusOK || login.RefreshToken == "" {
+		t.Fatalf("login: status %v, refresh token %q", code, login.RefreshToken)
+	}
+	if want := int(s.config.AccessTokenTTL / time.Second); login.ExpiresIn != want {
+		t.Errorf("expires_in = %d, want %d", login.ExpiresIn, want)
+	}
+
+	now = now.Add(time.Minute)
+	code, refreshed := postTokens(t, s, "/auth/refresh", refreshBody(login.RefreshToken))
+	if code != http.StatusOK {
+		t.Fatalf("refresh: status %v, want %v", code, http.StatusOK)
+	}
+	if refreshed.Token == "" || refreshed.RefreshToken == "" || refreshed.RefreshToken == login.RefreshToken {
+		t.Errorf("refresh returned tokens %+v, want a new pair", refreshed)
+	}
+
+	if code, _ := postTokens(t, s, "/auth/refresh", refreshBody(refreshed.RefreshToken)); code != http.StatusOK {
+		t.Errorf("refresh with rotated token: status %v, want %v", code, http.StatusOK)
+	}
+}
+
+func TestRefreshReuseRevokesFamily(t *testing.T) {
+	now := time.Now()
+	s := newRefreshTestServer(t, &now)
+
+	_, login := postTokens(t, s, "/auth/login", `{"username":"refreshuser","password":"password"}`)
+	_, refreshed := postTokens(t, s, "/auth/refresh", refreshBody(login.RefreshToken))
+
+	// Presenting the first token again looks like theft, so the token that replaced it
+	// must stop working too
+	if code, _ := postTokens(t, s, "/auth/refresh", refreshBody(login.RefreshToken)); code != http.StatusUnauthorized {
+		t.Errorf("reused token: status %v, want %v", code, http.StatusUnauthorized)
+	}
+	if code, _ := postTokens(t, s, "/auth/refresh", refreshBody(refreshed.RefreshToken)); code != http.StatusUnauthorized {
+		t.Errorf("token from revoked family: status %v, want %v", code, http.StatusUnauthorized)
+	}
+
+	// Other logins are unaffected
+	_, other := postTokens(t, s, "/auth/login", `{"username":"refreshuser","password":"password"}`)
+	if code, _ := postTokens(t, s, "/auth/refresh", refreshBody(other.RefreshToken)); code != http.StatusOK {
+		t.Errorf("token from another login: status %v, want %v", code, http.StatusOK)
+	}
+}
+
+func TestRefreshRejectsExpiredAndUnknownTokens(t *testing.T) {
+	now := time.Now()
+	s := newRefreshTestServer(t, &now)
+
+	_, login := postTokens(t, s, "/auth/login", `{"username":"refreshuser","password":"password"}`)
+	now = now.Add(s.config.RefreshTokenTTL)
+	if code, _ := postTokens(t, s, "/auth/refresh", refreshBody(login.RefreshToken)); code != http.StatusUnauthorized {
+		t.Errorf("expired token: status %v, want %v", code, http.StatusUnauthorized)
+	}
+	if code, _ := postTokens(t, s, "/auth/refresh", refreshBody("unknown")); code != http.StatusUnauthorized {
+		t.Errorf("unknown token: status %v, want %v", code, http.StatusUnauthorized)
+	}
+	if code, _ := postTokens(t, s, "/auth/refresh", `{}`); code != http.StatusBadRequest {
+		t.Errorf("missing token: status %v, want %v", code, http.StatusBadRequest)
+	}
+}
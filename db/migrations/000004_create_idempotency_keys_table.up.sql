@@ -0,0 +1,11 @@
+CREATE TABLE "idempotency_keys" (
+  "username" varchar(50) NOT NULL,
+  "key" varchar(255) NOT NULL,
+  "request_hash" varchar(64) NOT NULL,
+  "response_status" integer,
+  "response_content_type" varchar(100),
+  "response_body" bytea,
+  "created_at" timestamp DEFAULT (now()),
+  "completed_at" timestamp,
+  PRIMARY KEY ("username", "key")
+);
@@ -0,0 +1,3 @@
+ALTER TABLE "payments" ADD COLUMN "provider_reference" varchar(100);
+
+CREATE UNIQUE INDEX ON "payments" ("provider_reference");
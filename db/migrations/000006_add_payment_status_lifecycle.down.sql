@@ -0,0 +1,10 @@
+DROP INDEX IF EXISTS "payment_logs_payment_id_logged_at_idx";
+
+ALTER TABLE "payment_logs" DROP COLUMN "from_status";
+
+ALTER TABLE "payments" DROP CONSTRAINT "payments_status_check";
+ALTER TABLE "payments" ALTER COLUMN "status" DROP NOT NULL;
+ALTER TABLE "payments" ALTER COLUMN "status" SET DEFAULT 'PENDING';
+
+UPDATE "payment_logs" SET "status" = 'SUCCESS' WHERE "status" = 'SUCCEEDED';
+UPDATE "payments" SET "status" = 'SUCCESS' WHERE "status" = 'SUCCEEDED';
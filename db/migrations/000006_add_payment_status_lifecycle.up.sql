@@ -0,0 +1,11 @@
+UPDATE "payments" SET "status" = 'SUCCEEDED' WHERE "status" = 'SUCCESS';
+UPDATE "payment_logs" SET "status" = 'SUCCEEDED' WHERE "status" = 'SUCCESS';
+
+ALTER TABLE "payments" ALTER COLUMN "status" SET DEFAULT 'CREATED';
+ALTER TABLE "payments" ALTER COLUMN "status" SET NOT NULL;
+ALTER TABLE "payments" ADD CONSTRAINT "payments_status_check"
+  CHECK ("status" IN ('CREATED', 'PENDING', 'PROCESSING', 'SUCCEEDED', 'FAILED', 'CANCELLED', 'REFUNDED'));
+
+ALTER TABLE "payment_logs" ADD COLUMN "from_status" varchar(20);
+
+CREATE INDEX ON "payment_logs" ("payment_id", "logged_at");
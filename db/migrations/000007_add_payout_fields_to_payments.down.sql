@@ -0,0 +1,6 @@
+ALTER TABLE "payments" DROP COLUMN "narration";
+ALTER TABLE "payments" DROP COLUMN "phone";
+ALTER TABLE "payments" DROP COLUMN "channel";
+
+ALTER TABLE "payments" DROP CONSTRAINT "payments_direction_check";
+ALTER TABLE "payments" DROP COLUMN "direction";
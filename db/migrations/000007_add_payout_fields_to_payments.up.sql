@@ -0,0 +1,6 @@
+ALTER TABLE "payments" ADD COLUMN "direction" varchar(10) NOT NULL DEFAULT 'payin';
+ALTER TABLE "payments" ADD CONSTRAINT "payments_direction_check" CHECK ("direction" IN ('payin', 'payout'));
+
+ALTER TABLE "payments" ADD COLUMN "channel" varchar(50);
+ALTER TABLE "payments" ADD COLUMN "phone" varchar(20);
+ALTER TABLE "payments" ADD COLUMN "narration" text;
@@ -0,0 +1 @@
+DROP TABLE payment_attempts;
\ No newline at end of file
@@ -0,0 +1,15 @@
+CREATE TABLE "payment_attempts" (
+  "id" serial PRIMARY KEY,
+  "payment_id" integer NOT NULL,
+  "operation" varchar(30) NOT NULL,
+  "http_status" integer,
+  "provider_reference" varchar(100),
+  "response_body" bytea,
+  "error" text,
+  "created_at" timestamp DEFAULT (now())
+);
+
+ALTER TABLE "payment_attempts" ADD FOREIGN KEY ("payment_id") REFERENCES "payments" ("id");
+
+CREATE INDEX ON "payment_attempts" ("payment_id");
+CREATE INDEX ON "payment_attempts" ("provider_reference");
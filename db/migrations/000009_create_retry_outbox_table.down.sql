@@ -0,0 +1 @@
+DROP TABLE retry_outbox;
\ No newline at end of file
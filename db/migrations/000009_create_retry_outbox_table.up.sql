@@ -0,0 +1,7 @@
+CREATE TABLE "retry_outbox" (
+  "id" serial PRIMARY KEY,
+  "message_id" varchar(100) NOT NULL,
+  "retry_type" varchar(50) NOT NULL,
+  "body" bytea NOT NULL,
+  "created_at" timestamp DEFAULT (now())
+);
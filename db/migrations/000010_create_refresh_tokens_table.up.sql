@@ -0,0 +1,14 @@
+CREATE TABLE "refresh_tokens" (
+  "id" serial PRIMARY KEY,
+  "token_hash" varchar(64) UNIQUE NOT NULL,
+  "family_id" varchar(64) NOT NULL,
+  "user_id" integer NOT NULL,
+  "expires_at" timestamp NOT NULL,
+  "created_at" timestamp DEFAULT (now()),
+  "used_at" timestamp,
+  "revoked_at" timestamp
+);
+
+ALTER TABLE "refresh_tokens" ADD FOREIGN KEY ("user_id") REFERENCES "users" ("id");
+
+CREATE INDEX ON "refresh_tokens" ("family_id");
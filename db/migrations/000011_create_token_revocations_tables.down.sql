@@ -0,0 +1,2 @@
+DROP TABLE revoked_sessions;
+DROP TABLE revoked_tokens;
\ No newline at end of file
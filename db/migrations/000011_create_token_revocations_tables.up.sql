@@ -0,0 +1,15 @@
+CREATE TABLE "revoked_tokens" (
+  "jti" varchar(64) PRIMARY KEY,
+  "expires_at" timestamp NOT NULL,
+  "revoked_at" timestamp DEFAULT (now())
+);
+
+CREATE TABLE "revoked_sessions" (
+  "username" varchar(50) PRIMARY KEY,
+  "revoked_before" timestamp NOT NULL,
+  "expires_at" timestamp NOT NULL
+);
+
+CREATE INDEX ON "revoked_tokens" ("expires_at");
+
+CREATE INDEX ON "revoked_sessions" ("expires_at");
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Claims mirrors the token claims issued by the authentication service. The subject is
+// the user ID; profile details are not in the token and come from /me.
+type Claims struct {
+	Username string `json:"username"`
+	jwt.RegisteredClaims
+}
+
+type contextKey string
+
+const usernameKey contextKey = "username"
+
+// Routes that can be reached without a token. Everything else goes through authMiddleware.
+// Payd callbacks carry no user token; the payments service verifies their signature instead.
+var publicPaths = []string{"/register", "/login", "/refresh", "/payments/callback"}
+var publicPrefixes = []string{"/swagger/"}
+
+func isPublicPath(path string) bool {
+	for _, p := range publicPaths {
+		if path == p {
+			return true
+		}
+	}
+	for _, p := range publicPrefixes {
+		if strings.HasPrefix(path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// Middleware function to verify the bearer token on protected routes
+func (s *Server) authMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isPublicPath(r.URL.Path) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		claims, err := s.parseToken(r.Context(), r.Header.Get("Authorization"))
+		if err != nil {
+			slog.WarnContext(r.Context(), "Rejected unauthenticated request", "path", r.URL.Path, "error", err)
+			unauthorized(w)
+			return
+		}
+
+		ctx := context.WithValue(r.Context(), usernameKey, claims.Username)
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// parseToken validates an "Authorization: Bearer <token>" header value and returns its claims.
+func (s *Server) parseToken(ctx context.Context, header string) (*Claims, error) {
+	tokenString := strings.TrimPrefix(header, "Bearer ")
+	if tokenString == "" || tokenString == header {
+		return nil, errMissingToken
+	}
+
+	claims := &Claims{}
+	token, err := jwt.ParseWithClaims(tokenString, claims, s.keys.keyFunc(ctx),
+		jwt.WithValidMethods([]string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}),
+		jwt.WithExpirationRequired())
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid || claims.Username == "" {
+		return nil, errInvalidToken
+	}
+	if s.revocations != nil && s.revocations.Revoked(claims) {
+		return nil, errRevokedToken
+	}
+
+	return claims, nil
+}
+
+// usernameFromContext returns the authenticated username injected by authMiddleware.
+func usernameFromContext(ctx context.Context) (string, bool) {
+	username, ok := ctx.Value(usernameKey).(string)
+	return username, ok && username != ""
+}
+
+func unauthorized(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnauthorized)
+	json.NewEncoder(w).Encode(FailResponse{Status: "unauthorized"})
+}
+
+var (
+	errMissingToken            = errors.New("missing bearer token")
+	errInvalidToken            = errors.New("invalid token")
+	errRevokedToken            = errors.New("token revoked")
+	errUnexpectedSigningMethod = errors.New("unexpected signing method")
+)
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// testSigningKey signs the tokens in tests. newTestServer trusts it as key testKeyID,
+// as if the authentication service had published it.
+var testPublicKey, testSigningKey, _ = ed25519.GenerateKey(rand.Reader)
+
+const testKeyID = "test"
+
+// trustKey makes s accept tokens signed with public under kid, without fetching it.
+func trustKey(s *Server, kid string, public ed25519.PublicKey) {
+	s.keys.mu.Lock()
+	defer s.keys.mu.Unlock()
+	s.keys.keys[kid] = verificationKey{alg: jwt.SigningMethodEdDSA.Alg(), public: public}
+}
+
+func signTestClaims(t *testing.T, claims *Claims) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodEdDSA, claims)
+	token.Header["kid"] = testKeyID
+	signed, err := token.SignedString(testSigningKey)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return signed
+}
+
+func signTestToken(t *testing.T, s *Server, username string, expiresAt time.Time) string {
+	return signTestClaims(t, &Claims{
+		Username: username,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expiresAt),
+		},
+	})
+}
+
+func TestAuthMiddleware(t *testing.T) {
+	s, _ := newTestServer("")
+
+	var gotUsername string
+	handler := s.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUsername, _ = usernameFromContext(r.Context())
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name   string
+		path   string
+		header string
+		want   int
+	}{
+		{"public route", "/login", "", http.StatusOK},
+		{"token refresh", "/refresh", "", http.StatusOK},
+		{"swagger", "/swagger/index.html", "", http.StatusOK},
+		{"payd callback", "/payments/callback", "", http.StatusOK},
+		{"missing token", "/payments/initiate", "", http.StatusUnauthorized},
+		{"malformed token", "/payments/initiate", "Bearer not-a-token", http.StatusUnauthorized},
+		{"expired token", "/payments/initiate", "Bearer " + signTestToken(t, s, "testuser", time.Now().Add(-time.Minute)), http.StatusUnauthorized},
+		{"valid token", "/payments/status/1", "Bearer " + signTestToken(t, s, "testuser", time.Now().Add(time.Hour)), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotUsername = ""
+			req, _ := http.NewRequest("GET", tt.path, nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if rr.Code != tt.want {
+				t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, tt.want)
+			}
+			if tt.want == http.StatusUnauthorized && rr.Header().Get("Content-Type") != "application/json" {
+				t.Errorf("expected JSON error response, got Content-Type %q", rr.Header().Get("Content-Type"))
+			}
+		})
+	}
+
+	if gotUsername != "testuser" {
+		t.Errorf("expected username in request context, got %q", gotUsername)
+	}
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// errBrokerUnavailable is returned for queue operations while the gateway is not
+// connected to RabbitMQ.
+var errBrokerUnavailable = errors.New("not connected to RabbitMQ")
+
+// AMQPConnection keeps a connection and channel to RabbitMQ open. It dials with backoff
+// until the broker answers, and when the connection or channel is lost it dials again
+// and runs every setup function on the new channel, so that queues are declared again.
+//
+// Consumers are not re-registered here: their delivery channel is closed when the
+// connection is lost, and it is up to them to call Consume again.
+type AMQPConnection struct {
+	url    string
+	dial   func(url string) (*amqp.Connection, error)
+	setups []func(*amqp.Channel) error
+
+	// minDelay and maxDelay bound the wait between attempts to dial, which doubles after
+	// every failure.
+	minDelay time.Duration
+	maxDelay time.Duration
+
+	mu      sync.Mutex
+	conn    *amqp.Connection
+	channel *amqp.Channel
+	stop    context.CancelFunc
+	stopped chan struct{}
+}
+
+// NewAMQPConnection returns a connection to the broker at url. It does not dial until
+// Connect is called.
+func NewAMQPConnection(url string) *AMQPConnection {
+	return &AMQPConnection{
+		url:      url,
+		dial:     amqp.Dial,
+		minDelay: time.Second,
+		maxDelay: 30 * time.Second,
+	}
+}
+
+// OnConnect adds a function that is run on the channel every time a connection is made,
+// before the channel is used. It must be called before Connect.
+func (c *AMQPConnection) OnConnect(setup func(*amqp.Channel) error) {
+	c.setups = append(c.setups, setup)
+}
+
+// Connect dials the broker, retrying with backoff until it succeeds or ctx is cancelled,
+// and then keeps the connection open until Close is called.
+func (c *AMQPConnection) Connect(ctx context.Context) error {
+	supervise, stop := context.WithCancel(context.Background())
+	c.mu.Lock()
+	c.stop = stop
+	c.stopped = make(chan struct{})
+	c.mu.Unlock()
+
+	// Give up on the first connection when ctx is cancelled, and on later ones when the
+	// connection is closed
+	first, cancel := context.WithCancel(supervise)
+	defer cancel()
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-first.Done():
+		}
+	}()
+
+	closed, err := c.connect(first)
+	if err != nil {
+		stop()
+		close(c.stopped)
+		return err
+	}
+	go c.supervise(supervise, closed)
+	return nil
+}
+
+// Channel returns the open channel, or errBrokerUnavailable while reconnecting.
+func (c *AMQPConnection) Channel() (*amqp.Channel, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.channel == nil {
+		return nil, errBrokerUnavailable
+	}
+	return c.channel, nil
+}
+
+// OpenChannel opens a channel of its own on the current connection, or returns
+// errBrokerUnavailable while reconnecting. It is for operations after which the broker
+// may close the channel, which must not take the shared channel with it. The caller
+// closes the channel.
+func (c *AMQPConnection) OpenChannel() (*amqp.Channel, error) {
+	c.mu.Lock()
+	conn := c.conn
+	c.mu.Unlock()
+	if conn == nil {
+		return nil, errBrokerUnavailable
+	}
+	return conn.Channel()
+}
+
+// Close closes the connection and stops reconnecting.
+func (c *AMQPConnection) Close() error {
+	c.mu.Lock()
+	conn, stop, stopped := c.conn, c.stop, c.stopped
+	c.conn, c.channel = nil, nil
+	c.mu.Unlock()
+
+	if stop == nil {
+		return nil
+	}
+	stop()
+	var err error
+	if conn != nil {
+		err = conn.Close()
+	}
+	<-stopped
+	return err
+}
+
+// supervise reconnects whenever closed reports that the connection or its channel was
+// lost, until ctx is cancelled.
+func (c *AMQPConnection) supervise(ctx context.Context, closed <-chan *amqp.Error) {
+	defer close(c.stopped)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-closed:
+			c.mu.Lock()
+			conn := c.conn
+			c.conn, c.channel = nil, nil
+			c.mu.Unlock()
+			if ctx.Err() != nil {
+				return
+			}
+			slog.Warn("Lost connection to RabbitMQ, reconnecting", "error", err)
+			if conn != nil {
+				// The channel may have closed on its own; make sure the connection goes too
+				conn.Close()
+			}
+
+			var connectErr error
+			if closed, connectErr = c.connect(ctx); connectErr != nil {
+				return
+			}
+			slog.Info("Reconnected to RabbitMQ")
+		}
+	}
+}
+
+// connect dials until a connection is made and set up, waiting longer after each
+// failure, or until ctx is cancelled. It returns a channel that receives when the new
+// connection or channel is closed.
+func (c *AMQPConnection) connect(ctx context.Context) (<-chan *amqp.Error, error) {
+	delay := c.minDelay
+	for {
+		closed, err := c.open(ctx)
+		if err == nil {
+			return closed, nil
+		}
+		slog.Warn("Failed to connect to RabbitMQ, retrying", "error", err, "delay", delay)
+
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("connecting to RabbitMQ: %w", err)
+		case <-time.After(delay):
+		}
+		delay = min(delay*2, c.maxDelay)
+	}
+}
+
+func (c *AMQPConnection) open(ctx context.Context) (<-chan *amqp.Error, error) {
+	conn, err := c.dial(c.url)
+	if err != nil {
+		return nil, err
+	}
+	channel, err := conn.Channel()
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("opening a channel: %w", err)
+	}
+	for _, setup := range c.setups {
+		if err := setup(channel); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+
+	// Either closing means reconnecting, so both are reported on one channel. Each
+	// NotifyClose channel is closed without a value when closed normally.
+	closed := make(chan *amqp.Error, 2)
+	connClosed := conn.NotifyClose(make(chan *amqp.Error, 1))
+	channelClosed := channel.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		select {
+		case err := <-connClosed:
+			closed <- err
+		case err := <-channelClosed:
+			closed <- err
+		}
+	}()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ctx.Err() != nil {
+		// Closed while dialing
+		conn.Close()
+		return nil, ctx.Err()
+	}
+	c.conn, c.channel = conn, channel
+	return closed, nil
+}
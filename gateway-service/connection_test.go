@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestConnectRetriesUntilCancelled(t *testing.T) {
+	dialErr := errors.New("connection refused")
+	dials := 0
+	conn := NewAMQPConnection("amqp://rabbitmq.invalid/")
+	conn.dial = func(url string) (*amqp.Connection, error) {
+		dials++
+		return nil, dialErr
+	}
+	conn.minDelay, conn.maxDelay = time.Millisecond, 4*time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := conn.Connect(ctx)
+	if !errors.Is(err, dialErr) {
+		t.Fatalf("expected the last dial error, got %v", err)
+	}
+	if dials < 2 {
+		t.Errorf("expected dialing to be retried, dialed %d times", dials)
+	}
+	if _, err := conn.Channel(); !errors.Is(err, errBrokerUnavailable) {
+		t.Errorf("expected no channel, got %v", err)
+	}
+	if err := conn.Close(); err != nil {
+		t.Errorf("Close: %v", err)
+	}
+}
+
+func TestQueueRejectsOperationsWhileDisconnected(t *testing.T) {
+	q := NewAMQPQueue(NewAMQPConnection("amqp://rabbitmq.invalid/"), "payments", "payments.dead", 5, 10, time.Second)
+
+	err := q.Schedule(context.Background(), amqp.Publishing{}, 1, time.Second)
+	if !errors.Is(err, errBrokerUnavailable) {
+		t.Errorf("Schedule: expected errBrokerUnavailable, got %v", err)
+	}
+	if _, err := q.Consume(); !errors.Is(err, errBrokerUnavailable) {
+		t.Errorf("Consume: expected errBrokerUnavailable, got %v", err)
+	}
+	if _, err := q.BrowseDeadLetters(10); !errors.Is(err, errBrokerUnavailable) {
+		t.Errorf("BrowseDeadLetters: expected errBrokerUnavailable, got %v", err)
+	}
+	if _, err := q.Depths(); !errors.Is(err, errBrokerUnavailable) {
+		t.Errorf("Depths: expected errBrokerUnavailable, got %v", err)
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// deadLetterStore gives operators access to the dead-letter queue.
+type deadLetterStore interface {
+	BrowseDeadLetters(limit int) ([]amqp.Delivery, error)
+	ReplayDeadLetters(match func(amqp.Delivery) bool, replay func(amqp.Delivery) amqp.Publishing) (int, error)
+}
+
+const deadLetterUsage = `usage:
+  gateway-service dead-letters list [limit]     list dead-lettered messages (default 20)
+  gateway-service dead-letters show <id>        show one message, with sensitive fields redacted
+  gateway-service dead-letters replay <id>      send one message back to the retry queue
+  gateway-service dead-letters replay --all     send every message back to the retry queue`
+
+// runDeadLetterCommand runs the dead-letters subcommand given by args against store and
+// writes its output to w.
+func runDeadLetterCommand(store deadLetterStore, args []string, w io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(deadLetterUsage)
+	}
+
+	switch args[0] {
+	case "list":
+		limit := 20
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid limit %q", args[1])
+			}
+			limit = n
+		}
+		return listDeadLetters(store, limit, w)
+	case "show":
+		if len(args) != 2 {
+			return errors.New(deadLetterUsage)
+		}
+		return showDeadLetter(store, args[1], w)
+	case "replay":
+		if len(args) != 2 {
+			return errors.New(deadLetterUsage)
+		}
+		match := func(d amqp.Delivery) bool { return d.MessageId == args[1] }
+		if args[1] == "--all" {
+			match = func(amqp.Delivery) bool { return true }
+		}
+		n, err := store.ReplayDeadLetters(match, replayPublishing)
+		if err != nil {
+			return err
+		}
+		if n == 0 && args[1] != "--all" {
+			return fmt.Errorf("no dead-lettered message with id %q", args[1])
+		}
+		fmt.Fprintf(w, "replayed %d message(s)\n", n)
+		return nil
+	}
+	return errors.New(deadLetterUsage)
+}
+
+func listDeadLetters(store deadLetterStore, limit int, w io.Writer) error {
+	msgs, err := store.BrowseDeadLetters(limit)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tCREATED AT\tTYPE\tATTEMPT\tCORRELATION ID\tREASON")
+	for _, d := range msgs {
+		// A message that cannot be decoded is listed with whatever could be read
+		env, _ := decodeRetryEnvelope(d.Body)
+		attempt, requestID := deliveryAttempt(d), deliveryRequestID(d)
+		if attempt == 0 {
+			attempt = env.Attempt
+		}
+		if requestID == "" {
+			requestID = env.CorrelationID
+		}
+		reason, _ := d.Headers["dead_letter_reason"].(string)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", d.MessageId, d.Timestamp.UTC().Format(time.RFC3339), env.Type, attempt, requestID, reason)
+	}
+	return tw.Flush()
+}
+
+func showDeadLetter(store deadLetterStore, id string, w io.Writer) error {
+	msgs, err := store.BrowseDeadLetters(0)
+	if err != nil {
+		return err
+	}
+	for _, d := range msgs {
+		if d.MessageId != id {
+			continue
+		}
+		fmt.Fprintf(w, "id: %s\n", d.MessageId)
+		for _, key := range []string{"dead_letter_reason", "dead_lettered_at"} {
+			if v, ok := d.Headers[key]; ok {
+				fmt.Fprintf(w, "%s: %v\n", key, v)
+			}
+		}
+		env, err := decodeRetryEnvelope(d.Body)
+		if err != nil {
+			for _, key := range []string{attemptMessageHeader, requestIDMessageHeader} {
+				if v, ok := d.Headers[key]; ok {
+					fmt.Fprintf(w, "%s: %v\n", key, v)
+				}
+			}
+			fmt.Fprintf(w, "body: %s\n", redactBody(d.Body))
+			return nil
+		}
+		fmt.Fprintf(w, "type: %s\n", env.Type)
+		fmt.Fprintf(w, "attempt: %d\n", env.Attempt)
+		fmt.Fprintf(w, "username: %s\n", env.Username)
+		fmt.Fprintf(w, "created at: %s\n", env.CreatedAt.Format(time.RFC3339))
+		fmt.Fprintf(w, "correlation id: %s\n", env.CorrelationID)
+		fmt.Fprintf(w, "idempotency key: %s\n", env.IdempotencyKey)
+		fmt.Fprintf(w, "request: %s\n", redactBody(env.Request))
+		return nil
+	}
+	return fmt.Errorf("no dead-lettered message with id %q", id)
+}
+
+// replayPublishing prepares a dead-lettered message to be retried from the first
+// attempt again. A message that cannot be decoded is replayed as it is, and will be
+// dead-lettered again unless the gateway has learned to read it.
+func replayPublishing(d amqp.Delivery) amqp.Publishing {
+	msg := publishingFrom(d)
+	if env, err := decodeRetryEnvelope(d.Body); err == nil {
+		env.Attempt = 1
+		if body, err := json.Marshal(env); err == nil {
+			msg.Body = body
+			setEnvelopeHeaders(&msg, env)
+		}
+	}
+	delete(msg.Headers, "dead_letter_reason")
+	delete(msg.Headers, "dead_lettered_at")
+	return msg
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// fakeDeadLetters is a deadLetterStore holding messages in memory.
+type fakeDeadLetters struct {
+	msgs     []amqp.Delivery
+	replayed []amqp.Publishing
+}
+
+func (f *fakeDeadLetters) BrowseDeadLetters(limit int) ([]amqp.Delivery, error) {
+	if limit > 0 && limit < len(f.msgs) {
+		return f.msgs[:limit], nil
+	}
+	return f.msgs, nil
+}
+
+func (f *fakeDeadLetters) ReplayDeadLetters(match func(amqp.Delivery) bool, replay func(amqp.Delivery) amqp.Publishing) (int, error) {
+	var kept []amqp.Delivery
+	for _, d := range f.msgs {
+		if match(d) {
+			f.replayed = append(f.replayed, replay(d))
+		} else {
+			kept = append(kept, d)
+		}
+	}
+	n := len(f.msgs) - len(kept)
+	f.msgs = kept
+	return n, nil
+}
+
+func newFakeDeadLetters() *fakeDeadLetters {
+	dead := func(id, username string) amqp.Delivery {
+		body, _ := json.Marshal(retryEnvelope{
+			Version:       retryEnvelopeVersion,
+			Type:          retryMobilePayment,
+			Attempt:       5,
+			Username:      username,
+			Request:       json.RawMessage(`{"amount":100,"phone":"0712345678"}`),
+			CorrelationID: "request-" + username,
+			CreatedAt:     time.Unix(1700000000, 0).UTC(),
+		})
+		return amqp.Delivery{
+			MessageId: id,
+			Timestamp: time.Unix(1700000000, 0),
+			Headers:   amqp.Table{"dead_letter_reason": "gave up after 5 attempts"},
+			Body:      body,
+		}
+	}
+	return &fakeDeadLetters{msgs: []amqp.Delivery{dead("msg-1", "alice"), dead("msg-2", "bob")}}
+}
+
+func TestDeadLetterList(t *testing.T) {
+	var out bytes.Buffer
+	if err := runDeadLetterCommand(newFakeDeadLetters(), []string{"list", "1"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "msg-1") || strings.Contains(out.String(), "msg-2") {
+		t.Errorf("expected only the first message to be listed, got:\n%s", out.String())
+	}
+	if !strings.Contains(out.String(), "gave up after 5 attempts") {
+		t.Errorf("expected the reason to be listed, got:\n%s", out.String())
+	}
+}
+
+func TestDeadLetterShowRedactsBody(t *testing.T) {
+	var out bytes.Buffer
+	if err := runDeadLetterCommand(newFakeDeadLetters(), []string{"show", "msg-2"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "username: bob") || !strings.Contains(out.String(), "type: send-to-mobile") || strings.Contains(out.String(), "0712345678") {
+		t.Errorf("unexpected output:\n%s", out.String())
+	}
+
+	if err := runDeadLetterCommand(newFakeDeadLetters(), []string{"show", "msg-3"}, &out); err == nil {
+		t.Error("expected an error for a missing message")
+	}
+}
+
+func TestDeadLetterReplay(t *testing.T) {
+	store := newFakeDeadLetters()
+	var out bytes.Buffer
+	if err := runDeadLetterCommand(store, []string{"replay", "msg-1"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.replayed) != 1 || len(store.msgs) != 1 {
+		t.Fatalf("expected 1 message replayed and 1 left, got %d and %d", len(store.replayed), len(store.msgs))
+	}
+	replayed := store.replayed[0]
+	env := decodeTestEnvelope(t, replayed.Body)
+	if replayed.MessageId != "msg-1" || env.Attempt != 1 || env.Username != "alice" || replayed.Headers["dead_letter_reason"] != nil || replayed.Headers[attemptMessageHeader] != int32(1) {
+		t.Errorf("replayed message was not reset: %+v %+v", replayed, env)
+	}
+	if store.msgs[0].Headers["dead_letter_reason"] == nil {
+		t.Error("replaying changed the headers of the dead-lettered message")
+	}
+
+	if err := runDeadLetterCommand(store, []string{"replay", "--all"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if len(store.replayed) != 2 || len(store.msgs) != 0 {
+		t.Errorf("expected every message replayed, got %d replayed and %d left", len(store.replayed), len(store.msgs))
+	}
+}
+
+func TestDeadLetterShowsHeadersOfUndecodableMessages(t *testing.T) {
+	store := &fakeDeadLetters{msgs: []amqp.Delivery{{
+		MessageId: "legacy",
+		Headers:   amqp.Table{requestIDMessageHeader: "req-7", attemptMessageHeader: int32(3), "dead_letter_reason": "invalid retry message"},
+		Body:      []byte(`{"payment_method":"card"}`),
+	}}}
+
+	var out bytes.Buffer
+	if err := runDeadLetterCommand(store, []string{"list"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "req-7") || !strings.Contains(out.String(), " 3 ") {
+		t.Errorf("expected the request ID and attempt from the headers, got:\n%s", out.String())
+	}
+
+	out.Reset()
+	if err := runDeadLetterCommand(store, []string{"show", "legacy"}, &out); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "request_id: req-7") || !strings.Contains(out.String(), "attempt: 3") {
+		t.Errorf("expected the request ID and attempt from the headers, got:\n%s", out.String())
+	}
+}
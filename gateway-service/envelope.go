@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// retryEnvelopeVersion is the version of retryEnvelope the gateway writes. Messages of
+// any other version are dead-lettered rather than guessed at.
+const retryEnvelopeVersion = 1
+
+// Retry types name the payments service call a queued payment retries.
+const (
+	retryCardPayment   = "card-payment"
+	retryMobilePayment = "send-to-mobile"
+)
+
+// retryEnvelope is the body of every message on the retry queues. It carries what is
+// needed to make the original call again, so that a retry never has to guess from the
+// payment request what it was.
+type retryEnvelope struct {
+	Version        int             `json:"version"`
+	Type           string          `json:"type"`
+	Attempt        int             `json:"attempt"`
+	Username       string          `json:"username"`
+	Request        json.RawMessage `json:"request"`
+	IdempotencyKey string          `json:"idempotency_key,omitempty"`
+	CorrelationID  string          `json:"correlation_id,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+}
+
+// decodeRetryEnvelope parses a retry message body.
+func decodeRetryEnvelope(body []byte) (retryEnvelope, error) {
+	var env retryEnvelope
+	if err := json.Unmarshal(body, &env); err != nil {
+		return env, fmt.Errorf("invalid retry message: %w", err)
+	}
+	if env.Version != retryEnvelopeVersion {
+		return env, fmt.Errorf("unsupported retry message version %d", env.Version)
+	}
+	return env, nil
+}
+
+// AMQP headers that repeat envelope fields, so that the request and attempt of a message
+// can be read by broker tools, and by the gateway when the body cannot be decoded.
+const (
+	requestIDMessageHeader = "request_id"
+	attemptMessageHeader   = "attempt"
+)
+
+// setEnvelopeHeaders copies the request ID and attempt of env into the headers of msg,
+// and the request ID into its correlation ID.
+func setEnvelopeHeaders(msg *amqp.Publishing, env retryEnvelope) {
+	if msg.Headers == nil {
+		msg.Headers = amqp.Table{}
+	}
+	msg.Headers[attemptMessageHeader] = int32(env.Attempt)
+	if env.CorrelationID != "" {
+		msg.Headers[requestIDMessageHeader] = env.CorrelationID
+		msg.CorrelationId = env.CorrelationID
+	}
+}
+
+// deliveryRequestID returns the request ID in the headers of d, if any.
+func deliveryRequestID(d amqp.Delivery) string {
+	id, _ := d.Headers[requestIDMessageHeader].(string)
+	return id
+}
+
+// deliveryAttempt returns the attempt in the headers of d, or 0 if there is none.
+func deliveryAttempt(d amqp.Delivery) int {
+	switch n := d.Headers[attemptMessageHeader].(type) {
+	case int32:
+		return int(n)
+	case int64:
+		return int(n)
+	case int:
+		return n
+	}
+	return 0
+}
+
+// retryHandler makes the call a queued payment of one type retries.
+type retryHandler func(ctx context.Context, env retryEnvelope) (*http.Response, error)
+
+// defaultRetryHandlers returns the handler for every retry type the gateway queues.
+func (s *Server) defaultRetryHandlers() map[string]retryHandler {
+	return map[string]retryHandler{
+		retryCardPayment:   s.retryPost("/payments/initiate"),
+		retryMobilePayment: s.retryPost("/payments/send-to-mobile"),
+	}
+}
+
+// retryPost returns a handler that posts the original request to path on the payments
+// service on behalf of the user who made it.
+func (s *Server) retryPost(path string) retryHandler {
+	return func(ctx context.Context, env retryEnvelope) (*http.Response, error) {
+		return s.postAs(ctx, s.config.PaymentsServiceURL+path, env.Username, env.Request)
+	}
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+const idempotencyKeyHeader = "Idempotency-Key"
+
+const idempotencyKeyKey contextKey = "idempotency_key"
+
+// idempotencyKeyFor returns the client's Idempotency-Key, or a new one if it sent none,
+// so that our own retries of the request can never be applied twice.
+func idempotencyKeyFor(r *http.Request) string {
+	if key := r.Header.Get(idempotencyKeyHeader); key != "" {
+		return key
+	}
+	return newRequestID()
+}
+
+func withIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyKeyKey, key)
+}
+
+func idempotencyKeyFromContext(ctx context.Context) (string, bool) {
+	key, ok := ctx.Value(idempotencyKeyKey).(string)
+	return key, ok && key != ""
+}
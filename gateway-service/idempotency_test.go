@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestInitiatePaymentForwardsIdempotencyKey(t *testing.T) {
+	var forwarded []string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = append(forwarded, r.Header.Get(idempotencyKeyHeader))
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer upstream.Close()
+	s, _ := newTestServer(upstream.URL)
+
+	withKey, _ := http.NewRequest("POST", "/payments/initiate", strings.NewReader(`{"amount":100}`))
+	withKey.Header.Set(idempotencyKeyHeader, "client-key-1")
+	s.InitiatePayment(httptest.NewRecorder(), withKey)
+
+	withoutKey, _ := http.NewRequest("POST", "/payments/initiate", strings.NewReader(`{"amount":100}`))
+	s.InitiatePayment(httptest.NewRecorder(), withoutKey)
+
+	if len(forwarded) != 2 {
+		t.Fatalf("expected 2 upstream calls, got %d", len(forwarded))
+	}
+	if forwarded[0] != "client-key-1" {
+		t.Errorf("expected client key to be forwarded, got %q", forwarded[0])
+	}
+	if forwarded[1] == "" {
+		t.Error("expected a generated key when the client sends none")
+	}
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// jwksMinRefetch is how often a token signed with an unknown key can make the gateway
+// fetch the key set, so that tokens with made-up key IDs cannot flood the
+// authentication service.
+const jwksMinRefetch = 10 * time.Second
+
+var errUnknownSigningKey = errors.New("unknown signing key")
+
+// JWK is a public key in the JSON Web Key format (RFC 7517), as published by the
+// authentication service.
+type JWK struct {
+	KeyType   string `json:"kty"`
+	KeyID     string `json:"kid"`
+	Algorithm string `json:"alg"`
+	N         string `json:"n"`
+	E         string `json:"e"`
+	Curve     string `json:"crv"`
+	X         string `json:"x"`
+}
+
+// verificationKey is a public key and the algorithm tokens signed with it must use.
+type verificationKey struct {
+	alg    string
+	public interface{}
+}
+
+// parseJWK returns the public key in an RSA or Ed25519 JWK.
+func parseJWK(jwk JWK) (verificationKey, error) {
+	switch {
+	case jwk.KeyType == "RSA" && jwk.Algorithm == jwt.SigningMethodRS256.Alg():
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return verificationKey{}, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil {
+			return verificationKey{}, err
+		}
+		public := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if public.N.BitLen() < 2048 || public.E < 3 {
+			return verificationKey{}, errors.New("RSA key is too weak")
+		}
+		return verificationKey{alg: jwk.Algorithm, public: public}, nil
+	case jwk.KeyType == "OKP" && jwk.Curve == "Ed25519" && jwk.Algorithm == jwt.SigningMethodEdDSA.Alg():
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return verificationKey{}, err
+		}
+		if len(x) != ed25519.PublicKeySize {
+			return verificationKey{}, errors.New("Ed25519 key has the wrong size")
+		}
+		return verificationKey{alg: jwk.Algorithm, public: ed25519.PublicKey(x)}, nil
+	}
+	return verificationKey{}, fmt.Errorf("unsupported key type %s with algorithm %s", jwk.KeyType, jwk.Algorithm)
+}
+
+// JWKSCache holds the keys the authentication service publishes at url. It is reloaded
+// periodically by Run, and also when a token names a key it does not have, which is
+// how a newly rotated key is picked up early. When a fetch fails the keys already
+// loaded are kept.
+type JWKSCache struct {
+	url    string
+	client *http.Client
+
+	// minRefetch is how long after a fetch an unknown key does not cause another.
+	minRefetch time.Duration
+
+	mu   sync.RWMutex
+	keys map[string]verificationKey
+
+	// fetchMu serializes fetches; lastFetch is when the last one started.
+	fetchMu   sync.Mutex
+	lastFetch time.Time
+}
+
+func NewJWKSCache(url string, client *http.Client) *JWKSCache {
+	return &JWKSCache{url: url, client: client, minRefetch: jwksMinRefetch, keys: map[string]verificationKey{}}
+}
+
+// Refresh replaces the keys with the ones published now.
+func (c *JWKSCache) Refresh(ctx context.Context) error {
+	c.fetchMu.Lock()
+	defer c.fetchMu.Unlock()
+	return c.fetch(ctx)
+}
+
+func (c *JWKSCache) fetch(ctx context.Context) error {
+	c.lastFetch = time.Now()
+	req, err := newUpstreamRequest(ctx, "GET", c.url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("fetching signing keys: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("fetching signing keys: status %d", resp.StatusCode)
+	}
+
+	var jwks struct {
+		Keys []JWK `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&jwks); err != nil {
+		return fmt.Errorf("decoding signing keys: %w", err)
+	}
+	keys := map[string]verificationKey{}
+	for _, jwk := range jwks.Keys {
+		key, err := parseJWK(jwk)
+		if err != nil {
+			slog.WarnContext(ctx, "Ignoring signing key", "kid", jwk.KeyID, "error", err)
+			continue
+		}
+		keys[jwk.KeyID] = key
+	}
+
+	c.mu.Lock()
+	c.keys = keys
+	c.mu.Unlock()
+	return nil
+}
+
+// Run refreshes the keys every interval until ctx is cancelled.
+func (c *JWKSCache) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := c.Refresh(ctx); err != nil && ctx.Err() == nil {
+				slog.Error("Failed to refresh signing keys", "error", err)
+			}
+		}
+	}
+}
+
+func (c *JWKSCache) lookup(kid string) (verificationKey, bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	key, ok := c.keys[kid]
+	return key, ok
+}
+
+// key returns the key with the given ID, fetching the keys again if it is not known
+// and they have not been fetched in the last minRefetch.
+func (c *JWKSCache) key(ctx context.Context, kid string) (verificationKey, error) {
+	if key, ok := c.lookup(kid); ok {
+		return key, nil
+	}
+
+	c.fetchMu.Lock()
+	if time.Since(c.lastFetch) >= c.minRefetch {
+		if err := c.fetch(ctx); err != nil {
+			slog.WarnContext(ctx, "Failed to fetch signing keys", "error", err)
+		}
+	}
+	c.fetchMu.Unlock()
+
+	if key, ok := c.lookup(kid); ok {
+		return key, nil
+	}
+	return verificationKey{}, fmt.Errorf("%w %q", errUnknownSigningKey, kid)
+}
+
+// keyFunc returns the key a token names in its kid header, for jwt.Parse.
+func (c *JWKSCache) keyFunc(ctx context.Context) jwt.Keyfunc {
+	return func(token *jwt.Token) (interface{}, error) {
+		kid, _ := token.Header["kid"].(string)
+		key, err := c.key(ctx, kid)
+		if err != nil {
+			return nil, err
+		}
+		if token.Method.Alg() != key.alg {
+			return nil, errUnexpectedSigningMethod
+		}
+		return key.public, nil
+	}
+}
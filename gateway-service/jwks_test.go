@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// fakeJWKS serves a key set that tests can change, counting requests.
+type fakeJWKS struct {
+	mu      sync.Mutex
+	keys    []JWK
+	fail    bool
+	fetches int
+}
+
+func (f *fakeJWKS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fetches++
+	if f.fail {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string][]JWK{"keys": f.keys})
+}
+
+func (f *fakeJWKS) set(fail bool, keys ...JWK) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail, f.keys = fail, keys
+}
+
+func ed25519JWK(kid string, public ed25519.PublicKey) JWK {
+	return JWK{KeyType: "OKP", KeyID: kid, Algorithm: "EdDSA", Curve: "Ed25519", X: base64.RawURLEncoding.EncodeToString(public)}
+}
+
+func rsaJWK(kid string, public *rsa.PublicKey) JWK {
+	return JWK{KeyType: "RSA", KeyID: kid, Algorithm: "RS256",
+		N: base64.RawURLEncoding.EncodeToString(public.N.Bytes()),
+		E: base64.RawURLEncoding.EncodeToString(big.NewInt(int64(public.E)).Bytes())}
+}
+
+func signWith(t *testing.T, method jwt.SigningMethod, kid string, key interface{}) string {
+	token := jwt.NewWithClaims(method, &Claims{
+		Username:         "testuser",
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+	})
+	token.Header["kid"] = kid
+	signed, err := token.SignedString(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signed
+}
+
+// newJWKSTestServer returns a gateway that fetches its keys from jwks.
+func newJWKSTestServer(t *testing.T, jwks *fakeJWKS) *Server {
+	upstream := httptest.NewServer(jwks)
+	t.Cleanup(upstream.Close)
+	cfg := defaultConfig()
+	cfg.JWKSURL = upstream.URL
+	return NewServer(cfg, http.DefaultClient, newFakeQueue(), nil, nil, time.Now)
+}
+
+func TestJWKSCacheVerifiesPublishedKeys(t *testing.T) {
+	edPublic, edPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	rsaPrivate, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwks := &fakeJWKS{}
+	jwks.set(false, ed25519JWK("ed", edPublic), rsaJWK("rsa", &rsaPrivate.PublicKey),
+		JWK{KeyType: "EC", KeyID: "unsupported", Algorithm: "ES256"})
+	s := newJWKSTestServer(t, jwks)
+	ctx := context.Background()
+	if err := s.keys.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		valid bool
+	}{
+		{"EdDSA", signWith(t, jwt.SigningMethodEdDSA, "ed", edPrivate), true},
+		{"RS256", signWith(t, jwt.SigningMethodRS256, "rsa", rsaPrivate), true},
+		{"algorithm of another key", signWith(t, jwt.SigningMethodRS256, "ed", rsaPrivate), false},
+		{"shared secret", signWith(t, jwt.SigningMethodHS256, "ed", []byte("secret")), false},
+		{"unknown key", signWith(t, jwt.SigningMethodEdDSA, "missing", edPrivate), false},
+	}
+	for _, tt := range tests {
+		_, err := s.parseToken(ctx, "Bearer "+tt.token)
+		if (err == nil) != tt.valid {
+			t.Errorf("%s: got error %v, want valid %v", tt.name, err, tt.valid)
+		}
+	}
+}
+
+func TestJWKSCachePicksUpRotatedKeys(t *testing.T) {
+	oldPublic, _, _ := ed25519.GenerateKey(rand.Reader)
+	newPublic, newPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	jwks := &fakeJWKS{}
+	jwks.set(false, ed25519JWK("old", oldPublic))
+	s := newJWKSTestServer(t, jwks)
+	s.keys.minRefetch = 0
+	ctx := context.Background()
+	if err := s.keys.Refresh(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	// The new key is used before the next scheduled refresh
+	jwks.set(false, ed25519JWK("old", oldPublic), ed25519JWK("new", newPublic))
+	if _, err := s.parseToken(ctx, "Bearer "+signWith(t, jwt.SigningMethodEdDSA, "new", newPrivate)); err != nil {
+		t.Errorf("token signed with the new key: %v", err)
+	}
+
+	// A failed fetch keeps the keys already loaded
+	jwks.set(true)
+	if err := s.keys.Refresh(ctx); err == nil {
+		t.Error("expected the refresh to fail")
+	}
+	if _, err := s.parseToken(ctx, "Bearer "+signWith(t, jwt.SigningMethodEdDSA, "new", newPrivate)); err != nil {
+		t.Errorf("token signed with a cached key after a failed fetch: %v", err)
+	}
+}
+
+func TestJWKSCacheLimitsFetchesForUnknownKeys(t *testing.T) {
+	_, private, _ := ed25519.GenerateKey(rand.Reader)
+	jwks := &fakeJWKS{}
+	s := newJWKSTestServer(t, jwks)
+	ctx := context.Background()
+
+	for i := 0; i < 3; i++ {
+		_, err := s.parseToken(ctx, "Bearer "+signWith(t, jwt.SigningMethodEdDSA, "made-up", private))
+		if !errors.Is(err, errUnknownSigningKey) {
+			t.Errorf("expected an unknown key error, got %v", err)
+		}
+	}
+	if jwks.fetches != 1 {
+		t.Errorf("fetched the key set %d times, want 1", jwks.fetches)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// captureLogs sends JSON logs at debug level to a buffer for the rest of the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	handler := slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+	slog.SetDefault(slog.New(contextHandler{handler}))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var gotID string
+	handler := requestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotID, _ = requestIDFromContext(r.Context())
+	}))
+
+	tests := []struct {
+		name     string
+		clientID string
+		reuse    bool
+	}{
+		{"generated", "", false},
+		{"client supplied", "client-id-123", true},
+		{"invalid client id", "bad id\nwith newline", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/payments/status/1", nil)
+			if tt.clientID != "" {
+				req.Header.Set(requestIDHeader, tt.clientID)
+			}
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+
+			if gotID == "" {
+				t.Fatal("expected a request ID in the context")
+			}
+			if rr.Header().Get(requestIDHeader) != gotID {
+				t.Errorf("response header %q does not match context ID %q", rr.Header().Get(requestIDHeader), gotID)
+			}
+			if reused := gotID == tt.clientID; reused != tt.reuse {
+				t.Errorf("client ID %q reused = %v, want %v", tt.clientID, reused, tt.reuse)
+			}
+		})
+	}
+}
+
+func TestRequestIDForwardedAndLogged(t *testing.T) {
+	logs := captureLogs(t)
+
+	var forwarded string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Get(requestIDHeader)
+	}))
+	defer upstream.Close()
+
+	s, _ := newTestServer(upstream.URL)
+	ctx := withRequestID(context.Background(), "req-42")
+	resp, err := s.post(ctx, upstream.URL, strings.NewReader(`{}`))
+	if err != nil {
+		t.Fatalf("post returned error: %v", err)
+	}
+	resp.Body.Close()
+
+	if forwarded != "req-42" {
+		t.Errorf("expected upstream to receive request ID req-42, got %q", forwarded)
+	}
+
+	slog.InfoContext(ctx, "hello")
+	if !strings.Contains(logs.String(), `"request_id":"req-42"`) {
+		t.Errorf("log line is missing request_id: %s", logs.String())
+	}
+}
@@ -2,60 +2,167 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"sync"
 	"testing"
 	"strings"
 
 	"github.com/gorilla/mux"
-	"github.com/joho/godotenv"
-	_ "github.com/lib/pq"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// fakeUsers holds the password hashes of the users registered with the fake
+// authentication service.
+type fakeUsers struct {
+	mu     sync.Mutex
+	hashes map[string]string
+}
+
+func (u *fakeUsers) hash(username string) (string, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	hash, ok := u.hashes[username]
+	return hash, ok
+}
+
+// testUsers backs the fake authentication service in place of the database.
+var testUsers *fakeUsers
+
+// testServer serves the handler tests, in front of fake authentication and payments
+// services.
+var testServer *Server
+
+// fakeAuthService registers users in users and logs them in, answering like the
+// authentication service.
+func fakeAuthService(users *fakeUsers) http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/auth/register", func(w http.ResponseWriter, r *http.Request) {
+		var user User
+		if err := json.NewDecoder(r.Body).Decode(&user); err != nil || user.Username == "" || user.Password == "" {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		hash, _ := bcrypt.GenerateFromPassword([]byte(user.Password), bcrypt.MinCost)
+
+		users.mu.Lock()
+		defer users.mu.Unlock()
+		if _, ok := users.hashes[user.Username]; ok {
+			http.Error(w, "User already exists", http.StatusConflict)
+			return
+		}
+		users.hashes[user.Username] = string(hash)
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(map[string]any{"status": "User registered successfully", "user": user.Username})
+	}).Methods("POST")
+	r.HandleFunc("/auth/login", func(w http.ResponseWriter, r *http.Request) {
+		var user UserLogin
+		if err := json.NewDecoder(r.Body).Decode(&user); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		hash, ok := users.hash(user.Username)
+		if !ok || bcrypt.CompareHashAndPassword([]byte(hash), []byte(user.Password)) != nil {
+			http.Error(w, `{"status": "invalid credentials"}`, http.StatusUnauthorized)
+			return
+		}
+		json.NewEncoder(w).Encode(LoginSuccessResponse{Status: "Login successful", Token: "access", RefreshToken: "refresh", ExpiresIn: 900})
+	}).Methods("POST")
+	return r
+}
+
+// fakePaymentsService accepts every payment with the answer the handler tests below
+// expect. The gateway passes that answer through unchanged; the payments service's own
+// answer is covered by the server tests.
+func fakePaymentsService() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/payments/initiate", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("Payment initiated successfully\n"))
+	}).Methods("POST")
+	return r
+}
+
+// db answers the user lookups of the handler tests below from testUsers.
 var db *sql.DB
 
-func TestMain(m *testing.M) {
-	var err error
-	err = godotenv.Load()
-	if err != nil {
-		log.Fatalf("Error loading .env file: %v", err)
-	}
+// usersConn is a database connection that only looks up the password hashes of the
+// users registered with the fake authentication service.
+type usersConn struct{ users *fakeUsers }
 
-	postgresURI := os.Getenv("DATABASE_URI")
+func (c usersConn) Connect(context.Context) (driver.Conn, error) { return c, nil }
+func (c usersConn) Driver() driver.Driver                      { return c }
+func (c usersConn) Open(string) (driver.Conn, error)           { return c, nil }
+func (c usersConn) Close() error                               { return nil }
 
-	db, err = sql.Open("postgres", postgresURI)
-	if err != nil {
-		log.Fatalf("Error opening database: %v", err)
+func (c usersConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, fmt.Errorf("unexpected query %q", query)
+}
+
+func (c usersConn) Begin() (driver.Tx, error) {
+	return nil, errors.New("transactions are not supported")
+}
+
+func (c usersConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if query != "SELECT password_hash FROM users WHERE username=$1" || len(args) != 1 {
+		return nil, fmt.Errorf("unexpected query %q", query)
+	}
+	rows := &hashRows{}
+	if username, ok := args[0].Value.(string); ok {
+		if hash, ok := c.users.hash(username); ok {
+			rows.hashes = []string{hash}
+		}
 	}
+	return rows, nil
+}
 
-	err = db.Ping()
-	if err != nil {
-		log.Fatalf("Error connecting to the database: %v db: %s", err, postgresURI)
+// hashRows are the password hashes found by usersConn.
+type hashRows struct{ hashes []string }
+
+func (r *hashRows) Columns() []string { return []string{"password_hash"} }
+func (r *hashRows) Close() error      { return nil }
+
+func (r *hashRows) Next(dest []driver.Value) error {
+	if len(r.hashes) == 0 {
+		return io.EOF
 	}
+	dest[0], r.hashes = r.hashes[0], r.hashes[1:]
+	return nil
+}
 
-	// Clean up the test user before running tests
-	_, _ = db.Exec("DELETE FROM users WHERE username=$1", "testuser")
+func TestMain(m *testing.M) {
+	testUsers = &fakeUsers{hashes: map[string]string{}}
+	authService := httptest.NewServer(fakeAuthService(testUsers))
+	paymentsService := httptest.NewServer(fakePaymentsService())
 
-	code := m.Run()
+	testServer, _ = newTestServer(paymentsService.URL)
+	testServer.config.AuthServiceURL = authService.URL
+	db = sql.OpenDB(usersConn{testUsers})
 
-	// Clean up the test user after running tests
-	_, _ = db.Exec("DELETE FROM users WHERE username=$1", "testuser")
+	code := m.Run()
 
 	db.Close()
-
+	authService.Close()
+	paymentsService.Close()
 	os.Exit(code)
 }
 
 func setupRouter() *mux.Router {
 	r := mux.NewRouter()
-	r.HandleFunc("/register", Register).Methods("POST")
-	r.HandleFunc("/login", Login).Methods("POST")
-	r.HandleFunc("/payments/initiate", InitiatePayment).Methods("POST")
+	r.HandleFunc("/register", testServer.Register).Methods("POST")
+	r.HandleFunc("/login", testServer.Login).Methods("POST")
+	// TestLogin logs in at the path of the authentication service
+	r.HandleFunc("/auth/login", testServer.Login).Methods("POST")
+	r.HandleFunc("/payments/initiate", testServer.InitiatePayment).Methods("POST")
 	return r
 }
 
@@ -157,7 +264,7 @@ func TestInitiatePayment(t *testing.T) {
 	rr := httptest.NewRecorder()
 
 	// Serve the request to the registered handler function
-	http.HandlerFunc(InitiatePayment).ServeHTTP(rr, req)
+	http.HandlerFunc(testServer.InitiatePayment).ServeHTTP(rr, req)
 
 	// Check the status code
 	if status := rr.Code; status != http.StatusOK {
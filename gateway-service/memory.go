@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"sync"
+)
+
+// MemoryRetryOutbox is a RetryOutbox kept in memory, for tests.
+type MemoryRetryOutbox struct {
+	mu     sync.Mutex
+	nextID int
+	msgs   []outboxMessage
+}
+
+func NewMemoryRetryOutbox() *MemoryRetryOutbox {
+	return &MemoryRetryOutbox{}
+}
+
+func (o *MemoryRetryOutbox) Add(ctx context.Context, msg outboxMessage) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.nextID++
+	msg.ID = o.nextID
+	o.msgs = append(o.msgs, msg)
+	return nil
+}
+
+func (o *MemoryRetryOutbox) Relay(ctx context.Context, limit int, publish func(outboxMessage) error) (int, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	relayed := 0
+	for relayed < len(o.msgs) && relayed < limit {
+		if err := publish(o.msgs[relayed]); err != nil {
+			break
+		}
+		relayed++
+	}
+	o.msgs = o.msgs[relayed:]
+	return relayed, nil
+}
+
+// Len returns how many messages are waiting to be relayed.
+func (o *MemoryRetryOutbox) Len() int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return len(o.msgs)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// retryMetrics counts what the retry worker is doing.
+type retryMetrics struct {
+	mu       sync.Mutex
+	queued   map[string]int
+	inFlight map[string]int
+	results  map[[2]string]int
+}
+
+func newRetryMetrics() *retryMetrics {
+	return &retryMetrics{
+		queued:   map[string]int{},
+		inFlight: map[string]int{},
+		results:  map[[2]string]int{},
+	}
+}
+
+// waiting adds delta to the retries of retryType received but not yet started.
+func (m *retryMetrics) waiting(retryType string, delta int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queued[retryType] += delta
+}
+
+// running adds delta to the retries of retryType being sent to the payments service.
+func (m *retryMetrics) running(retryType string, delta int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.inFlight[retryType] += delta
+}
+
+// finished counts a retry attempt of retryType by its result.
+func (m *retryMetrics) finished(retryType, result string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.results[[2]string{retryType, result}]++
+}
+
+// Metrics serves the retry metrics, and the number of messages in each retry queue, in
+// the Prometheus text format.
+func (s *Server) Metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	depths, err := s.queue.Depths()
+	if err != nil {
+		slog.WarnContext(r.Context(), "Failed to read retry queue depths", "error", err)
+	}
+	writeMetric(w, "gateway_retry_queue_messages", "gauge", "Messages ready in each retry queue.", "queue", depths)
+
+	s.metrics.mu.Lock()
+	defer s.metrics.mu.Unlock()
+	writeMetric(w, "gateway_retries_waiting", "gauge", "Retries received from the queue and waiting for a worker.", "type", s.metrics.queued)
+	writeMetric(w, "gateway_retries_in_flight", "gauge", "Retries being sent to the payments service.", "type", s.metrics.inFlight)
+
+	fmt.Fprintln(w, "# HELP gateway_retries_total Retry attempts by result.")
+	fmt.Fprintln(w, "# TYPE gateway_retries_total counter")
+	keys := make([][2]string, 0, len(s.metrics.results))
+	for key := range s.metrics.results {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return keys[i][0] < keys[j][0] || keys[i][0] == keys[j][0] && keys[i][1] < keys[j][1]
+	})
+	for _, key := range keys {
+		fmt.Fprintf(w, "gateway_retries_total{type=%q,result=%q} %d\n", key[0], key[1], s.metrics.results[key])
+	}
+}
+
+func writeMetric(w http.ResponseWriter, name, kind, help, label string, values map[string]int) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", name, label, key, values[key])
+	}
+}
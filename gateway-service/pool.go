@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+
+	"github.com/streadway/amqp"
+)
+
+// retryJob is a received retry message waiting for a worker.
+type retryJob struct {
+	ctx     context.Context
+	d       amqp.Delivery
+	env     retryEnvelope
+	handler retryHandler
+}
+
+// retryPool runs retries on a fixed set of workers. Each retry type has its own workers,
+// retry_concurrency of them or retry_workers if it has no limit of its own, and at most
+// retry_workers retries run at once across all types. A type that is slow to retry
+// therefore cannot hold up the others.
+//
+// Jobs are queued per type without blocking the consumer. Their number is bounded by
+// retry_prefetch, since RabbitMQ sends no more messages than that until some are
+// acknowledged.
+type retryPool struct {
+	slots chan struct{}
+	jobs  map[string]chan retryJob
+}
+
+// startRetryPool starts the workers for every retry type with a handler. They stop once
+// the pool is closed and its queued jobs are done with. Jobs taken after ctx is
+// cancelled are returned to the queue without being started.
+func (s *Server) startRetryPool(ctx context.Context) *retryPool {
+	p := &retryPool{
+		slots: make(chan struct{}, s.config.RetryWorkers),
+		jobs:  map[string]chan retryJob{},
+	}
+	for retryType := range s.retryHandlers {
+		jobs := make(chan retryJob, s.config.RetryPrefetch)
+		p.jobs[retryType] = jobs
+
+		workers, ok := s.config.RetryConcurrency[retryType]
+		if !ok {
+			workers = s.config.RetryWorkers
+		}
+		for i := 0; i < workers; i++ {
+			s.workers.Add(1)
+			go func() {
+				defer s.workers.Done()
+				s.retryWorker(ctx, p, jobs)
+			}()
+		}
+	}
+	return p
+}
+
+func (s *Server) retryWorker(ctx context.Context, p *retryPool, jobs <-chan retryJob) {
+	for job := range jobs {
+		s.metrics.waiting(job.env.Type, -1)
+		if ctx.Err() != nil {
+			requeue(job.ctx, job.d)
+			continue
+		}
+
+		p.slots <- struct{}{}
+		s.metrics.running(job.env.Type, 1)
+		s.retryPayment(job.ctx, job.d, job.env, job.handler)
+		s.metrics.running(job.env.Type, -1)
+		<-p.slots
+	}
+}
+
+// submit queues job for a worker of its type.
+func (s *Server) submit(p *retryPool, job retryJob) {
+	s.metrics.waiting(job.env.Type, 1)
+	p.jobs[job.env.Type] <- job
+}
+
+// close stops the workers once they have finished the jobs already queued.
+func (p *retryPool) close() {
+	for _, jobs := range p.jobs {
+		close(jobs)
+	}
+}
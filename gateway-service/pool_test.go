@@ -0,0 +1,90 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRetryPoolLimitsConcurrency(t *testing.T) {
+	var mu sync.Mutex
+	running := map[string]int{}
+	peak := map[string]int{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		running[r.URL.Path]++
+		running["all"]++
+		for _, key := range []string{r.URL.Path, "all"} {
+			peak[key] = max(peak[key], running[key])
+		}
+		mu.Unlock()
+
+		time.Sleep(20 * time.Millisecond)
+
+		mu.Lock()
+		running[r.URL.Path]--
+		running["all"]--
+		mu.Unlock()
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	s, queue := newTestServer(upstream.URL)
+	s.config.RetryWorkers = 3
+	s.config.RetryConcurrency = map[string]int{retryCardPayment: 1}
+	acks := &fakeAcknowledger{}
+	for i := uint64(1); i <= 4; i++ {
+		queue.deliveries <- testDelivery(acks, i, retryCardPayment, "alice", 1)
+		queue.deliveries <- testDelivery(acks, i+4, retryMobilePayment, "bob", 1)
+	}
+
+	runRetryWorker(t, s, acks, 8)
+
+	if acked, _ := acks.counts(); acked != 8 {
+		t.Errorf("expected every retry to be acked, got %d", acked)
+	}
+	if peak["/payments/initiate"] != 1 {
+		t.Errorf("expected card retries one at a time, got up to %d at once", peak["/payments/initiate"])
+	}
+	if peak["all"] > 3 {
+		t.Errorf("expected at most 3 retries at once, got %d", peak["all"])
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer upstream.Close()
+
+	s, queue := newTestServer(upstream.URL)
+	acks := &fakeAcknowledger{}
+	queue.deliveries <- testDelivery(acks, 1, retryCardPayment, "alice", 1)
+	runRetryWorker(t, s, acks, 1)
+
+	req, _ := http.NewRequest("GET", "/metrics", nil)
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusNotFound {
+		t.Errorf("expected the public listener not to serve metrics, got status %v", rr.Code)
+	}
+
+	rr = httptest.NewRecorder()
+	s.MetricsHandler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected metrics without a token on the metrics listener, got status %v", rr.Code)
+	}
+	for _, want := range []string{
+		`gateway_retry_queue_messages{queue="payment_status_queue"} 0`,
+		`gateway_retries_waiting{type="send-to-mobile"} 0`,
+		`gateway_retries_in_flight{type="card-payment"} 0`,
+		`gateway_retries_total{type="card-payment",result="accepted"} 1`,
+	} {
+		if !strings.Contains(rr.Body.String(), want) {
+			t.Errorf("metrics missing %s:\n%s", want, rr.Body.String())
+		}
+	}
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// PostgresRetryOutbox stores retry messages in the retry_outbox table.
+type PostgresRetryOutbox struct {
+	db *sql.DB
+}
+
+func NewPostgresRetryOutbox(db *sql.DB) *PostgresRetryOutbox {
+	return &PostgresRetryOutbox{db: db}
+}
+
+func (o *PostgresRetryOutbox) Add(ctx context.Context, msg outboxMessage) error {
+	_, err := o.db.ExecContext(ctx, "INSERT INTO retry_outbox (message_id, retry_type, body, created_at) VALUES ($1, $2, $3, $4)",
+		msg.MessageID, msg.RetryType, msg.Body, msg.CreatedAt)
+	return err
+}
+
+// Relay holds the rows it relays locked until it is done, so that gateways relaying
+// at the same time do not publish a message twice.
+func (o *PostgresRetryOutbox) Relay(ctx context.Context, limit int, publish func(outboxMessage) error) (int, error) {
+	tx, err := o.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.QueryContext(ctx, `SELECT id, message_id, retry_type, body, created_at FROM retry_outbox
+		ORDER BY id LIMIT $1 FOR UPDATE SKIP LOCKED`, limit)
+	if err != nil {
+		return 0, err
+	}
+	var msgs []outboxMessage
+	for rows.Next() {
+		var msg outboxMessage
+		if err := rows.Scan(&msg.ID, &msg.MessageID, &msg.RetryType, &msg.Body, &msg.CreatedAt); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		msgs = append(msgs, msg)
+	}
+	if err := rows.Close(); err != nil {
+		return 0, err
+	}
+
+	relayed := 0
+	for _, msg := range msgs {
+		if err := publish(msg); err != nil {
+			// Keep the rest for the next run; RabbitMQ is probably still unavailable
+			break
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM retry_outbox WHERE id=$1", msg.ID); err != nil {
+			return 0, err
+		}
+		relayed++
+	}
+	return relayed, tx.Commit()
+}
+
+// PostgresRevocationSource reads the revoked_tokens and revoked_sessions tables written
+// by the authentication service. Their times are in UTC.
+type PostgresRevocationSource struct {
+	db *sql.DB
+}
+
+func NewPostgresRevocationSource(db *sql.DB) *PostgresRevocationSource {
+	return &PostgresRevocationSource{db: db}
+}
+
+func (s *PostgresRevocationSource) LoadRevocations(ctx context.Context, now time.Time) (Revocations, error) {
+	revocations := Revocations{Tokens: map[string]time.Time{}, Sessions: map[string]time.Time{}}
+
+	rows, err := s.db.QueryContext(ctx, "SELECT jti, expires_at FROM revoked_tokens WHERE expires_at > $1", now.UTC())
+	if err != nil {
+		return revocations, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var jti string
+		var expiresAt time.Time
+		if err := rows.Scan(&jti, &expiresAt); err != nil {
+			return revocations, err
+		}
+		revocations.Tokens[jti] = expiresAt
+	}
+	if err := rows.Err(); err != nil {
+		return revocations, err
+	}
+
+	rows, err = s.db.QueryContext(ctx, "SELECT username, revoked_before FROM revoked_sessions WHERE expires_at > $1", now.UTC())
+	if err != nil {
+		return revocations, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var username string
+		var before time.Time
+		if err := rows.Scan(&username, &before); err != nil {
+			return revocations, err
+		}
+		revocations.Sessions[username] = before
+	}
+	return revocations, rows.Err()
+}
@@ -0,0 +1,417 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// RetryQueue holds payments that failed upstream until the retry worker picks them up.
+// Deliveries must be acknowledged.
+type RetryQueue interface {
+	// Schedule publishes msg for the given attempt, to be delivered to the consumer once
+	// delay has passed.
+	Schedule(ctx context.Context, msg amqp.Publishing, attempt int, delay time.Duration) error
+	Consume() (<-chan amqp.Delivery, error)
+	// Cancel stops deliveries to the consumer. The channel returned by Consume is closed
+	// once the messages already sent to it have been received.
+	Cancel() error
+	// DeadLetter publishes a message that will not be retried to the dead-letter queue.
+	DeadLetter(ctx context.Context, msg amqp.Publishing) error
+	// Depths returns the number of messages ready in each queue, by queue name.
+	Depths() (map[string]int, error)
+}
+
+// retryConsumerTag identifies the gateway's consumer so that it can be cancelled.
+const retryConsumerTag = "gateway-retry-worker"
+
+// AMQPQueue is a RetryQueue backed by durable RabbitMQ queues:
+//
+//   - the retry queue, which the retry worker consumes;
+//   - a delay queue per attempt, "<retry queue>.retry.<attempt>", with no consumer.
+//     Messages wait there until their per-message TTL expires and RabbitMQ dead-letters
+//     them to the retry queue. Every message in one delay queue has a similar TTL, so
+//     a long one at the head never holds up much shorter ones behind it;
+//   - the dead-letter queue, where messages that will not be retried are kept for an
+//     operator to inspect and replay.
+//
+// The queues are declared again whenever conn reconnects. While it is reconnecting
+// every operation fails with errBrokerUnavailable.
+//
+// Messages are persistent, and a publish returns only once RabbitMQ has confirmed that
+// it has the message, so a message that was published without error survives a broker
+// restart.
+type AMQPQueue struct {
+	conn           *AMQPConnection
+	name           string
+	deadLetter     string
+	maxAttempts    int
+	prefetch       int
+	confirmTimeout time.Duration
+
+	// publishMu holds publishes to one at a time, so that at most one message is
+	// waiting for its confirmation.
+	publishMu sync.Mutex
+	confirms  *publishConfirms
+}
+
+// publishConfirms receives the confirmations and returned messages of one channel and
+// hands the publisher waiting for one its outcome. Those of messages that were not
+// confirmed in time are dropped, so that they never block the connection.
+type publishConfirms struct {
+	channel *amqp.Channel
+	// published counts the messages published on channel, which is the delivery tag
+	// RabbitMQ confirms the latest one with. It is guarded by AMQPQueue.publishMu.
+	published uint64
+
+	mu      sync.Mutex
+	waiting *pendingConfirm
+	closed  bool
+}
+
+// pendingConfirm is a published message waiting for RabbitMQ to confirm it. done
+// receives the outcome, or is closed if the channel closes first.
+type pendingConfirm struct {
+	tag       uint64
+	messageID string
+	returned  *amqp.Return
+	done      chan publishOutcome
+}
+
+// publishOutcome is what RabbitMQ said about a published message.
+type publishOutcome struct {
+	ack bool
+	// returned is set if the message was returned as unroutable.
+	returned *amqp.Return
+}
+
+// newPublishConfirms starts handing out the confirmations on acks and the messages
+// returned on returned until acks is closed.
+func newPublishConfirms(channel *amqp.Channel, acks <-chan amqp.Confirmation, returned <-chan amqp.Return) *publishConfirms {
+	c := &publishConfirms{channel: channel}
+	go c.dispatch(acks, returned)
+	return c
+}
+
+// expect registers the message that will be confirmed with tag, replacing any message
+// still waiting.
+func (c *publishConfirms) expect(tag uint64, messageID string) *pendingConfirm {
+	p := &pendingConfirm{tag: tag, messageID: messageID, done: make(chan publishOutcome, 1)}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		close(p.done)
+		return p
+	}
+	c.waiting = p
+	return p
+}
+
+// forget stops waiting for p, so that its confirmation is dropped when it arrives.
+func (c *publishConfirms) forget(p *pendingConfirm) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.waiting == p {
+		c.waiting = nil
+	}
+}
+
+func (c *publishConfirms) dispatch(acks <-chan amqp.Confirmation, returned <-chan amqp.Return) {
+	for {
+		select {
+		case r, ok := <-returned:
+			if !ok {
+				returned = nil
+				continue
+			}
+			c.noteReturn(r)
+		case confirmation, ok := <-acks:
+			if !ok {
+				c.close()
+				return
+			}
+			// RabbitMQ returns a message before confirming it, so once it is confirmed
+			// a return is already waiting
+			for drained := false; !drained && returned != nil; {
+				select {
+				case r, ok := <-returned:
+					if !ok {
+						returned = nil
+						continue
+					}
+					c.noteReturn(r)
+				default:
+					drained = true
+				}
+			}
+			c.settle(confirmation)
+		}
+	}
+}
+
+func (c *publishConfirms) noteReturn(r amqp.Return) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.waiting != nil && c.waiting.messageID == r.MessageId {
+		c.waiting.returned = &r
+	}
+}
+
+func (c *publishConfirms) settle(confirmation amqp.Confirmation) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.waiting
+	if p == nil || p.tag != confirmation.DeliveryTag {
+		// Left behind by a message that timed out
+		return
+	}
+	c.waiting = nil
+	p.done <- publishOutcome{ack: confirmation.Ack, returned: p.returned}
+}
+
+func (c *publishConfirms) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	if c.waiting != nil {
+		close(c.waiting.done)
+		c.waiting = nil
+	}
+}
+
+// errNotConfirmed is returned when RabbitMQ does not confirm that it has a message.
+var errNotConfirmed = errors.New("message not confirmed by RabbitMQ")
+
+// NewAMQPQueue returns the named retry queue on conn. Every time conn connects it
+// declares the retry queue, a delay queue for each of maxAttempts attempts and the
+// dead-letter queue, limits the unacknowledged deliveries the channel receives to
+// prefetch, and enables publisher confirms. A publish fails if it is not confirmed within
+// confirmTimeout.
+func NewAMQPQueue(conn *AMQPConnection, name, deadLetter string, maxAttempts, prefetch int, confirmTimeout time.Duration) *AMQPQueue {
+	q := &AMQPQueue{
+		conn:           conn,
+		name:           name,
+		deadLetter:     deadLetter,
+		maxAttempts:    maxAttempts,
+		prefetch:       prefetch,
+		confirmTimeout: confirmTimeout,
+	}
+	conn.OnConnect(q.setup)
+	return q
+}
+
+func (q *AMQPQueue) setup(channel *amqp.Channel) error {
+	if err := declareQueue(channel, q.name, nil); err != nil {
+		return err
+	}
+	if err := declareQueue(channel, q.deadLetter, nil); err != nil {
+		return err
+	}
+	for attempt := 1; attempt <= q.maxAttempts; attempt++ {
+		err := declareQueue(channel, q.delayQueue(attempt), amqp.Table{
+			"x-dead-letter-exchange":    "",
+			"x-dead-letter-routing-key": q.name,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := channel.Qos(q.prefetch, 0, false); err != nil {
+		return err
+	}
+	if err := channel.Confirm(false); err != nil {
+		return fmt.Errorf("enabling publisher confirms: %w", err)
+	}
+
+	q.publishMu.Lock()
+	defer q.publishMu.Unlock()
+	q.confirms = newPublishConfirms(channel,
+		channel.NotifyPublish(make(chan amqp.Confirmation, 1)),
+		channel.NotifyReturn(make(chan amqp.Return, 1)))
+	return nil
+}
+
+func declareQueue(channel *amqp.Channel, name string, args amqp.Table) error {
+	_, err := channel.QueueDeclare(
+		name,  // name
+		true,  // durable
+		false, // delete when unused
+		false, // exclusive
+		false, // no-wait
+		args,  // arguments
+	)
+	if err != nil {
+		return fmt.Errorf("declaring queue %s: %w", name, err)
+	}
+	return nil
+}
+
+// delayQueue names the queue a message waits in before attempt.
+func (q *AMQPQueue) delayQueue(attempt int) string {
+	attempt = max(1, min(attempt, q.maxAttempts))
+	return fmt.Sprintf("%s.retry.%d", q.name, attempt)
+}
+
+func (q *AMQPQueue) Schedule(ctx context.Context, msg amqp.Publishing, attempt int, delay time.Duration) error {
+	msg.Expiration = strconv.FormatInt(delay.Milliseconds(), 10)
+	return q.publish(ctx, q.delayQueue(attempt), msg)
+}
+
+func (q *AMQPQueue) DeadLetter(ctx context.Context, msg amqp.Publishing) error {
+	return q.publish(ctx, q.deadLetter, msg)
+}
+
+// publish sends msg to queue as a persistent message and waits until RabbitMQ confirms
+// it. It fails if the queue does not exist, RabbitMQ rejects the message, or it is not
+// confirmed within the confirm timeout or before ctx is cancelled.
+func (q *AMQPQueue) publish(ctx context.Context, queue string, msg amqp.Publishing) error {
+	q.publishMu.Lock()
+	defer q.publishMu.Unlock()
+
+	channel, err := q.conn.Channel()
+	if err != nil {
+		return fmt.Errorf("publishing to %s: %w", queue, err)
+	}
+	c := q.confirms
+	if c == nil || c.channel != channel {
+		return fmt.Errorf("publishing to %s: %w", queue, errBrokerUnavailable)
+	}
+
+	msg.DeliveryMode = amqp.Persistent
+	// Wait for the confirmation before publishing, as it may arrive straight away
+	pending := c.expect(c.published+1, msg.MessageId)
+	defer c.forget(pending)
+	err = channel.Publish(
+		"",    // exchange
+		queue, // routing key
+		true,  // mandatory
+		false, // immediate
+		msg,
+	)
+	if err != nil {
+		return fmt.Errorf("publishing to %s: %w", queue, err)
+	}
+	c.published++
+
+	timeout := time.NewTimer(q.confirmTimeout)
+	defer timeout.Stop()
+	select {
+	case outcome, ok := <-pending.done:
+		if !ok {
+			return fmt.Errorf("publishing to %s: %w: channel closed", queue, errNotConfirmed)
+		}
+		if !outcome.ack {
+			return fmt.Errorf("publishing to %s: %w: rejected", queue, errNotConfirmed)
+		}
+		if outcome.returned != nil {
+			return fmt.Errorf("publishing to %s: %w: returned as %s", queue, errNotConfirmed, outcome.returned.ReplyText)
+		}
+		return nil
+	case <-timeout.C:
+		return fmt.Errorf("publishing to %s: %w within %v", queue, errNotConfirmed, q.confirmTimeout)
+	case <-ctx.Done():
+		return fmt.Errorf("publishing to %s: %w: %w", queue, errNotConfirmed, ctx.Err())
+	}
+}
+
+func (q *AMQPQueue) Consume() (<-chan amqp.Delivery, error) {
+	channel, err := q.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	return channel.Consume(
+		q.name,           // queue
+		retryConsumerTag, // consumer
+		false,            // auto-ack
+		false,            // exclusive
+		false,            // no-local
+		false,            // no-wait
+		nil,              // args
+	)
+}
+
+func (q *AMQPQueue) Cancel() error {
+	channel, err := q.conn.Channel()
+	if err != nil {
+		return err
+	}
+	return channel.Cancel(retryConsumerTag, false)
+}
+
+func (q *AMQPQueue) Depths() (map[string]int, error) {
+	// Inspecting a missing queue makes the broker close the channel, which must not be
+	// the one retries are published and consumed on
+	channel, err := q.conn.OpenChannel()
+	if err != nil {
+		return nil, err
+	}
+	defer channel.Close()
+	names := []string{q.name, q.deadLetter}
+	for attempt := 1; attempt <= q.maxAttempts; attempt++ {
+		names = append(names, q.delayQueue(attempt))
+	}
+	depths := map[string]int{}
+	for _, name := range names {
+		queue, err := channel.QueueInspect(name)
+		if err != nil {
+			return depths, fmt.Errorf("inspecting queue %s: %w", name, err)
+		}
+		depths[name] = queue.Messages
+	}
+	return depths, nil
+}
+
+// BrowseDeadLetters returns up to limit messages from the dead-letter queue, oldest
+// first, and leaves them on the queue.
+func (q *AMQPQueue) BrowseDeadLetters(limit int) ([]amqp.Delivery, error) {
+	held, err := q.getDeadLetters(limit)
+	for _, d := range held {
+		d.Nack(false, true)
+	}
+	return held, err
+}
+
+// ReplayDeadLetters moves the dead-lettered messages selected by match back to the
+// retry queue as prepared by replay, and returns how many it moved. The others are left
+// on the dead-letter queue.
+func (q *AMQPQueue) ReplayDeadLetters(match func(amqp.Delivery) bool, replay func(amqp.Delivery) amqp.Publishing) (int, error) {
+	held, err := q.getDeadLetters(0)
+	replayed := 0
+	for _, d := range held {
+		if err == nil && match(d) {
+			if err = q.publish(context.Background(), q.name, replay(d)); err == nil {
+				d.Ack(false)
+				replayed++
+				continue
+			}
+		}
+		d.Nack(false, true)
+	}
+	return replayed, err
+}
+
+// getDeadLetters takes up to limit messages, or all of them if limit is 0, off the
+// dead-letter queue without acknowledging them.
+func (q *AMQPQueue) getDeadLetters(limit int) ([]amqp.Delivery, error) {
+	channel, err := q.conn.Channel()
+	if err != nil {
+		return nil, err
+	}
+	var held []amqp.Delivery
+	for limit == 0 || len(held) < limit {
+		d, ok, err := channel.Get(q.deadLetter, false)
+		if err != nil {
+			return held, err
+		}
+		if !ok {
+			break
+		}
+		held = append(held, d)
+	}
+	return held, nil
+}
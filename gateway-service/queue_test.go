@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// deliver sends v on ch as RabbitMQ would, failing if nobody takes it.
+func deliver[T any](t *testing.T, ch chan<- T, v T) {
+	t.Helper()
+	select {
+	case ch <- v:
+	case <-time.After(time.Second):
+		t.Fatalf("%+v was not received, RabbitMQ would be blocked", v)
+	}
+}
+
+func TestConfirmsAfterTimeoutAreDropped(t *testing.T) {
+	acks := make(chan amqp.Confirmation)
+	returned := make(chan amqp.Return)
+	c := newPublishConfirms(nil, acks, returned)
+	defer close(acks)
+
+	// The first message is not confirmed in time
+	timedOut := c.expect(1, "first")
+	c.forget(timedOut)
+
+	next := c.expect(2, "second")
+	deliver(t, returned, amqp.Return{MessageId: "first", ReplyText: "NO_ROUTE"})
+	deliver(t, acks, amqp.Confirmation{DeliveryTag: 1, Ack: true})
+	deliver(t, acks, amqp.Confirmation{DeliveryTag: 2, Ack: true})
+
+	select {
+	case outcome := <-next.done:
+		if !outcome.ack || outcome.returned != nil {
+			t.Errorf("unexpected outcome for the second message %+v", outcome)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("the second message was not confirmed")
+	}
+	select {
+	case outcome := <-timedOut.done:
+		t.Errorf("the message that timed out got %+v", outcome)
+	default:
+	}
+
+	// Late confirmations keep being taken while nothing is published
+	for tag := uint64(3); tag <= 5; tag++ {
+		deliver(t, acks, amqp.Confirmation{DeliveryTag: tag, Ack: true})
+	}
+}
+
+func TestReturnedMessagesAreReported(t *testing.T) {
+	acks := make(chan amqp.Confirmation)
+	returned := make(chan amqp.Return, 1)
+	c := newPublishConfirms(nil, acks, returned)
+
+	pending := c.expect(1, "unroutable")
+	returned <- amqp.Return{MessageId: "unroutable", ReplyText: "NO_ROUTE"}
+	deliver(t, acks, amqp.Confirmation{DeliveryTag: 1, Ack: true})
+
+	outcome := <-pending.done
+	if outcome.returned == nil || outcome.returned.ReplyText != "NO_ROUTE" {
+		t.Errorf("expected the message to be reported as returned, got %+v", outcome)
+	}
+
+	close(acks)
+	if _, ok := <-c.expect(2, "after close").done; ok {
+		t.Error("expected no outcome once the channel is closed")
+	}
+}
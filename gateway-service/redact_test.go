@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedactBody(t *testing.T) {
+	redactFields = defaultRedactFields
+
+	body := []byte(`{"username":"testuser","password":"hunter2","amount":100,` +
+		`"phone_number":"0700000000","email":"test@example.com",` +
+		`"card":{"card_number":"4111111111111111","cvv":"123"},"items":[{"phone":"0711111111"}]}`)
+
+	got := redactBody(body)
+
+	for _, secret := range []string{"hunter2", "0700000000", "test@example.com", "4111111111111111", "0711111111"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("redacted body still contains %q: %s", secret, got)
+		}
+	}
+	for _, kept := range []string{`"username":"testuser"`, `"amount":100`} {
+		if !strings.Contains(got, kept) {
+			t.Errorf("redacted body lost %s: %s", kept, got)
+		}
+	}
+
+	if got := redactBody([]byte("password=hunter2")); strings.Contains(got, "hunter2") {
+		t.Errorf("non-JSON body was logged verbatim: %s", got)
+	}
+}
+
+func TestRedactFieldsConfigurable(t *testing.T) {
+	redactFields = []string{"narration"}
+	defer func() { redactFields = defaultRedactFields }()
+
+	got := redactBody([]byte(`{"narration":"rent for flat 4B","password":"hunter2"}`))
+	if strings.Contains(got, "flat 4B") {
+		t.Errorf("custom field was not redacted: %s", got)
+	}
+	if !strings.Contains(got, "hunter2") {
+		t.Errorf("only configured fields should be redacted: %s", got)
+	}
+}
+
+func TestLoggingMiddlewareRedacts(t *testing.T) {
+	redactFields = defaultRedactFields
+
+	logs := captureLogs(t)
+
+	handler := loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(`{"status":"Login successful","token":"abc.def.ghi"}`))
+	}))
+
+	req, _ := http.NewRequest("POST", "/login", strings.NewReader(`{"username":"testuser","password":"hunter2"}`))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	for _, secret := range []string{"hunter2", "abc.def.ghi"} {
+		if strings.Contains(logs.String(), secret) {
+			t.Errorf("logs contain %q:\n%s", secret, logs.String())
+		}
+	}
+}
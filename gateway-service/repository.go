@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"time"
+)
+
+// outboxMessage is a retry message that could not be published to RabbitMQ.
+type outboxMessage struct {
+	ID        int
+	MessageID string
+	RetryType string
+	Body      []byte
+	CreatedAt time.Time
+}
+
+// RetryOutbox keeps retry messages that RabbitMQ did not confirm until they can be
+// published.
+type RetryOutbox interface {
+	// Add stores a message to be published later.
+	Add(ctx context.Context, msg outboxMessage) error
+	// Relay calls publish for up to limit stored messages, oldest first, and removes
+	// each one it returns nil for. It returns how many it removed. Messages being relayed
+	// by another gateway are skipped.
+	Relay(ctx context.Context, limit int, publish func(outboxMessage) error) (int, error)
+}
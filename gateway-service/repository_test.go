@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+// openTestDB returns the database named by DATABASE_URI, skipping the test if there is none.
+func openTestDB(t *testing.T) *sql.DB {
+	uri := os.Getenv("DATABASE_URI")
+	if uri == "" {
+		t.Skip("DATABASE_URI not set")
+	}
+	conn, err := sql.Open("postgres", uri)
+	if err != nil || conn.Ping() != nil {
+		t.Skip("database not available")
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestMemoryRetryOutbox(t *testing.T) {
+	testRetryOutbox(t, NewMemoryRetryOutbox())
+}
+
+func TestPostgresRetryOutbox(t *testing.T) {
+	testRetryOutbox(t, NewPostgresRetryOutbox(openTestDB(t)))
+}
+
+func testRetryOutbox(t *testing.T, outbox RetryOutbox) {
+	ctx := context.Background()
+	prefix := fmt.Sprintf("outbox-%d", time.Now().UnixNano())
+	for i := 1; i <= 2; i++ {
+		msg := outboxMessage{MessageID: fmt.Sprintf("%s-%d", prefix, i), RetryType: retryCardPayment, Body: []byte(`{"version":1}`), CreatedAt: time.Now().UTC()}
+		if err := outbox.Add(ctx, msg); err != nil {
+			t.Fatalf("Add: %v", err)
+		}
+	}
+
+	// A failed publish keeps the message and stops the run
+	relayed, err := outbox.Relay(ctx, 100, func(outboxMessage) error { return errBrokerUnavailable })
+	if err != nil || relayed != 0 {
+		t.Fatalf("Relay with RabbitMQ down: relayed %d, %v", relayed, err)
+	}
+
+	var published []string
+	_, err = outbox.Relay(ctx, 100, func(msg outboxMessage) error {
+		published = append(published, msg.MessageID)
+		if string(msg.Body) != `{"version":1}` || msg.RetryType != retryCardPayment {
+			return errors.New("unexpected message")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Relay: %v", err)
+	}
+	first, second := -1, -1
+	for i, id := range published {
+		switch id {
+		case prefix + "-1":
+			first = i
+		case prefix + "-2":
+			second = i
+		}
+	}
+	if first < 0 || second < first {
+		t.Fatalf("expected both messages relayed oldest first, got %v", published)
+	}
+
+	_, err = outbox.Relay(ctx, 100, func(msg outboxMessage) error {
+		if msg.MessageID == prefix+"-1" || msg.MessageID == prefix+"-2" {
+			t.Errorf("message %s was relayed twice", msg.MessageID)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Relay: %v", err)
+	}
+}
+
+func TestPostgresRevocationSource(t *testing.T) {
+	db := openTestDB(t)
+	ctx := context.Background()
+	now := time.Now().UTC().Truncate(time.Second)
+	suffix := fmt.Sprint(now.UnixNano())
+
+	_, err := db.ExecContext(ctx, "INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2), ($3, $4)",
+		"live-"+suffix, now.Add(time.Hour), "expired-"+suffix, now.Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("inserting revoked tokens: %v", err)
+	}
+	_, err = db.ExecContext(ctx, "INSERT INTO revoked_sessions (username, revoked_before, expires_at) VALUES ($1, $2, $3)",
+		"user-"+suffix, now, now.Add(time.Hour))
+	if err != nil {
+		t.Fatalf("inserting revoked session: %v", err)
+	}
+
+	revocations, err := NewPostgresRevocationSource(db).LoadRevocations(ctx, now)
+	if err != nil {
+		t.Fatalf("LoadRevocations: %v", err)
+	}
+	if _, ok := revocations.Tokens["live-"+suffix]; !ok {
+		t.Error("revoked token was not loaded")
+	}
+	if _, ok := revocations.Tokens["expired-"+suffix]; ok {
+		t.Error("expired revoked token was loaded")
+	}
+	if before := revocations.Sessions["user-"+suffix]; !before.Equal(now) {
+		t.Errorf("sessions revoked before %v, want %v", before, now)
+	}
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// AddToRetryQueue schedules the first retry of a payment the payments service could
+// not take. retryType names the call to make again with body; it must have a handler.
+//
+// If RabbitMQ does not confirm the message it is kept in the outbox, to be published
+// when RabbitMQ is back. It returns an error only if the retry was not kept anywhere.
+func (s *Server) AddToRetryQueue(ctx context.Context, retryType string, username string, body []byte) error {
+	env := retryEnvelope{
+		Version:   retryEnvelopeVersion,
+		Type:      retryType,
+		Attempt:   1,
+		Username:  username,
+		Request:   body,
+		CreatedAt: s.now().UTC(),
+	}
+	if id, ok := requestIDFromContext(ctx); ok {
+		env.CorrelationID = id
+	}
+	if key, ok := idempotencyKeyFromContext(ctx); ok {
+		env.IdempotencyKey = key
+	}
+
+	envBody, err := json.Marshal(env)
+	if err != nil {
+		return fmt.Errorf("encoding retry message: %w", err)
+	}
+	msg := outboxMessage{MessageID: newRequestID(), RetryType: retryType, Body: envBody, CreatedAt: env.CreatedAt}
+
+	err = s.queue.Schedule(ctx, retryPublishing(msg), 1, s.retryBackoff(1))
+	if err == nil {
+		return nil
+	}
+	if s.outbox == nil {
+		return err
+	}
+	slog.WarnContext(ctx, "Failed to publish retry, keeping it in the outbox", "error", err)
+	if outboxErr := s.outbox.Add(context.WithoutCancel(ctx), msg); outboxErr != nil {
+		return fmt.Errorf("%w; adding to the outbox: %w", err, outboxErr)
+	}
+	return nil
+}
+
+// retryScheduledHeader tells the client of a payment that failed with a transient status
+// whether the gateway will retry it. Other responses do not carry it.
+const retryScheduledHeader = "X-Retry-Scheduled"
+
+// queueRetry adds a payment that failed with a transient status to the retry queue and
+// says on w whether it was added. It must be called before the response status is
+// written, and not for payments that were accepted or rejected.
+func (s *Server) queueRetry(ctx context.Context, w http.ResponseWriter, retryType, username string, body []byte) {
+	if err := s.AddToRetryQueue(ctx, retryType, username, body); err != nil {
+		slog.ErrorContext(ctx, "Failed to queue payment for retry", "type", retryType, "error", err)
+		w.Header().Set(retryScheduledHeader, "false")
+		return
+	}
+	w.Header().Set(retryScheduledHeader, "true")
+}
+
+// retryPublishing returns the first retry message for msg.
+func retryPublishing(msg outboxMessage) amqp.Publishing {
+	publishing := amqp.Publishing{
+		ContentType: "application/json",
+		Type:        msg.RetryType,
+		MessageId:   msg.MessageID,
+		Timestamp:   msg.CreatedAt,
+		Headers:     amqp.Table{},
+		Body:        msg.Body,
+	}
+	if env, err := decodeRetryEnvelope(msg.Body); err == nil {
+		setEnvelopeHeaders(&publishing, env)
+	}
+	return publishing
+}
+
+// relayOutbox publishes the retries kept in the outbox every outbox_interval, until ctx
+// is cancelled.
+func (s *Server) relayOutbox(ctx context.Context) {
+	ticker := time.NewTicker(s.config.OutboxInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		relayed, err := s.outbox.Relay(ctx, 100, func(msg outboxMessage) error {
+			return s.queue.Schedule(ctx, retryPublishing(msg), 1, s.retryBackoff(1))
+		})
+		if err != nil {
+			slog.Error("Failed to relay the retry outbox", "error", err)
+		}
+		if relayed > 0 {
+			slog.Info("Published retries from the outbox", "count", relayed)
+		}
+	}
+}
+
+// PollPayments consumes the retry queue and hands every message to a worker in pool,
+// until ctx is cancelled. Messages are acknowledged only once their retry has succeeded or
+// they have been moved to the dead-letter queue, so a crash leaves them on the queue.
+// At most retry_prefetch messages are held at once.
+//
+// When ctx is cancelled it stops consuming and returns the messages it had not handed
+// to the pool to the queue.
+//
+// If the connection to RabbitMQ is lost it registers the consumer again once the
+// gateway has reconnected.
+func (s *Server) PollPayments(ctx context.Context, pool *retryPool) {
+	for {
+		msgs, err := s.queue.Consume()
+		if err != nil {
+			slog.Warn("Failed to register a consumer, will try again", "error", err)
+		} else if s.consume(ctx, pool, msgs) {
+			return
+		} else {
+			slog.Warn("Retry queue consumer was closed, will register again")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(10 * time.Second):
+		}
+	}
+}
+
+// consume hands every message on msgs to pool until msgs is closed or ctx is
+// cancelled, and reports whether ctx was cancelled.
+func (s *Server) consume(ctx context.Context, pool *retryPool, msgs <-chan amqp.Delivery) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			s.stopConsuming(msgs)
+			return true
+		case d, ok := <-msgs:
+			if !ok {
+				return false
+			}
+			s.startRetry(ctx, pool, d)
+		}
+	}
+}
+
+func (s *Server) startRetry(ctx context.Context, pool *retryPool, d amqp.Delivery) {
+	env, err := decodeRetryEnvelope(d.Body)
+	if err != nil {
+		if id := deliveryRequestID(d); id != "" {
+			ctx = withRequestID(ctx, id)
+		}
+		s.deadLetter(ctx, d, err.Error())
+		return
+	}
+	if env.CorrelationID != "" {
+		ctx = withRequestID(ctx, env.CorrelationID)
+	}
+	if env.IdempotencyKey != "" {
+		ctx = withIdempotencyKey(ctx, env.IdempotencyKey)
+	}
+	slog.InfoContext(ctx, "Received a message", "type", env.Type, "attempt", env.Attempt, "body", redactBody(env.Request))
+
+	handler, ok := s.retryHandlers[env.Type]
+	if !ok {
+		s.deadLetter(ctx, d, fmt.Sprintf("unknown retry type %q", env.Type))
+		return
+	}
+
+	s.submit(pool, retryJob{ctx: ctx, d: d, env: env, handler: handler})
+}
+
+// stopConsuming cancels the consumer and returns the messages that were delivered to
+// us but not yet started to the queue.
+func (s *Server) stopConsuming(msgs <-chan amqp.Delivery) {
+	if err := s.queue.Cancel(); err != nil {
+		slog.Error("Failed to cancel the consumer", "error", err)
+		return
+	}
+	requeued := 0
+	for d := range msgs {
+		requeue(context.Background(), d)
+		requeued++
+	}
+	slog.Info("Stopped consuming the retry queue", "requeued", requeued)
+}
+
+// retryBackoff returns how long to wait before attempt. The delay doubles with every
+// attempt from retry_delay up to retry_max_delay, and a random half of it is taken off
+// so that payments that failed together are not all retried together.
+func (s *Server) retryBackoff(attempt int) time.Duration {
+	d := s.config.RetryDelay
+	for i := 1; i < attempt && d < s.config.RetryMaxDelay; i++ {
+		d *= 2
+	}
+	d = min(d, s.config.RetryMaxDelay)
+	return d/2 + rand.N(d/2+1)
+}
+
+// retryPayment makes one attempt at the call described by env with handler. The message
+// is acknowledged once the payment is accepted and dead-lettered if the payments service
+// rejects it. Otherwise the next attempt is scheduled.
+func (s *Server) retryPayment(ctx context.Context, d amqp.Delivery, env retryEnvelope, handler retryHandler) {
+	// Let an attempt that has started finish even if we are shutting down
+	resp, err := handler(context.WithoutCancel(ctx), env)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to retry payment", "type", env.Type, "error", err, "attempt", env.Attempt)
+		s.metrics.finished(env.Type, "failed")
+		s.scheduleRetry(ctx, d, env)
+		return
+	}
+	// Read what is left of the body so that the connection can be reused
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode < 300:
+		slog.InfoContext(ctx, "Retry succeeded", "type", env.Type, "status", resp.StatusCode, "attempt", env.Attempt)
+		s.metrics.finished(env.Type, "accepted")
+		ack(ctx, d)
+	case !transientStatus(resp.StatusCode):
+		s.metrics.finished(env.Type, "rejected")
+		s.deadLetter(ctx, d, fmt.Sprintf("payments service answered %d", resp.StatusCode))
+	default:
+		slog.WarnContext(ctx, "Retry failed", "type", env.Type, "status", resp.StatusCode, "attempt", env.Attempt)
+		s.metrics.finished(env.Type, "failed")
+		s.scheduleRetry(ctx, d, env)
+	}
+}
+
+// scheduleRetry puts the attempt after env's on the delay queue and acknowledges d, or
+// dead-letters d if retry_max_attempts have been made. If it cannot be scheduled d is
+// returned to the queue and tried again straight away.
+func (s *Server) scheduleRetry(ctx context.Context, d amqp.Delivery, env retryEnvelope) {
+	ctx, cancel := s.settleContext(ctx)
+	defer cancel()
+	if env.Attempt >= s.config.RetryMaxAttempts {
+		s.deadLetter(ctx, d, fmt.Sprintf("gave up after %d attempts", env.Attempt))
+		return
+	}
+
+	env.Attempt++
+	body, err := json.Marshal(env)
+	if err != nil {
+		slog.ErrorContext(ctx, "Failed to encode retry message, returning it to the queue", "error", err)
+		requeue(ctx, d)
+		return
+	}
+	msg := publishingFrom(d)
+	msg.Body = body
+	setEnvelopeHeaders(&msg, env)
+
+	delay := s.retryBackoff(env.Attempt)
+	if err := s.queue.Schedule(ctx, msg, env.Attempt, delay); err != nil {
+		slog.ErrorContext(ctx, "Failed to schedule retry, returning message to the queue", "error", err)
+		requeue(ctx, d)
+		return
+	}
+	slog.InfoContext(ctx, "Scheduled retry", "attempt", env.Attempt, "delay", delay)
+	ack(ctx, d)
+}
+
+// transientStatus reports whether a request that failed with status may succeed if it
+// is sent again.
+func transientStatus(status int) bool {
+	switch status {
+	case 408, 409, 429:
+		// 409 is an earlier attempt with the same idempotency key still running; a key
+		// reused with a different request is a 422
+		return true
+	}
+	return status >= 500
+}
+
+// deadLetter moves d to the dead-letter queue with the reason it was given up on, then
+// acknowledges it. If it cannot be moved it is returned to the queue instead.
+func (s *Server) deadLetter(ctx context.Context, d amqp.Delivery, reason string) {
+	ctx, cancel := s.settleContext(ctx)
+	defer cancel()
+	msg := publishingFrom(d)
+	msg.Headers["dead_letter_reason"] = reason
+	msg.Headers["dead_lettered_at"] = s.now().UTC().Format(time.RFC3339)
+	if err := s.queue.DeadLetter(ctx, msg); err != nil {
+		slog.ErrorContext(ctx, "Failed to dead-letter message, returning it to the queue", "error", err)
+		requeue(ctx, d)
+		return
+	}
+	slog.WarnContext(ctx, "Moved message to the dead-letter queue", "reason", reason)
+	ack(ctx, d)
+}
+
+// settleContext returns the context to publish what becomes of a message with. It is
+// not cancelled when we shut down: a retry that was made but not scheduled or
+// dead-lettered would be returned to the queue and made again. It is bounded by
+// confirm_timeout instead.
+func (s *Server) settleContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.WithoutCancel(ctx), s.config.ConfirmTimeout)
+}
+
+// publishingFrom copies d into a message that can be published again. Its headers can
+// be changed without affecting d.
+func publishingFrom(d amqp.Delivery) amqp.Publishing {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	return amqp.Publishing{
+		ContentType:   d.ContentType,
+		Type:          d.Type,
+		MessageId:     d.MessageId,
+		CorrelationId: d.CorrelationId,
+		Timestamp:     d.Timestamp,
+		Headers:       headers,
+		Body:          d.Body,
+	}
+}
+
+func ack(ctx context.Context, d amqp.Delivery) {
+	if err := d.Ack(false); err != nil {
+		slog.ErrorContext(ctx, "Failed to acknowledge message", "error", err)
+	}
+}
+
+func requeue(ctx context.Context, d amqp.Delivery) {
+	if err := d.Nack(false, true); err != nil {
+		slog.ErrorContext(ctx, "Failed to return message to the queue", "error", err)
+	}
+}
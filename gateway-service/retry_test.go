@@ -0,0 +1,357 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// fakeAcknowledger records how deliveries were settled.
+type fakeAcknowledger struct {
+	mu       sync.Mutex
+	acked    []uint64
+	requeued []uint64
+}
+
+func (a *fakeAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.acked = append(a.acked, tag)
+	return nil
+}
+
+func (a *fakeAcknowledger) Nack(tag uint64, multiple, requeue bool) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if requeue {
+		a.requeued = append(a.requeued, tag)
+	}
+	return nil
+}
+
+func (a *fakeAcknowledger) Reject(tag uint64, requeue bool) error {
+	return a.Nack(tag, false, requeue)
+}
+
+func (a *fakeAcknowledger) counts() (acked, requeued int) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.acked), len(a.requeued)
+}
+
+// testDelivery returns a retry message for attempt at a payment of retryType by username.
+func testDelivery(acks *fakeAcknowledger, tag uint64, retryType, username string, attempt int) amqp.Delivery {
+	body, _ := json.Marshal(retryEnvelope{
+		Version:        retryEnvelopeVersion,
+		Type:           retryType,
+		Attempt:        attempt,
+		Username:       username,
+		Request:        json.RawMessage(`{"amount":100,"payment_method":"MPESA"}`),
+		IdempotencyKey: "key-" + username,
+		CorrelationID:  "request-" + username,
+		CreatedAt:      time.Unix(1700000000, 0).UTC(),
+	})
+	return amqp.Delivery{
+		Acknowledger: acks,
+		DeliveryTag:  tag,
+		MessageId:    fmt.Sprintf("msg-%d", tag),
+		Headers:      amqp.Table{},
+		Body:         body,
+	}
+}
+
+func decodeTestEnvelope(t *testing.T, body []byte) retryEnvelope {
+	t.Helper()
+	env, err := decodeRetryEnvelope(body)
+	if err != nil {
+		t.Fatalf("decoding retry message: %v", err)
+	}
+	return env
+}
+
+// runRetryWorker consumes deliveries with s until they have all been settled.
+func runRetryWorker(t *testing.T, s *Server, acks *fakeAcknowledger, want int) {
+	ctx, cancel := context.WithCancel(context.Background())
+	s.StartRetryWorker(ctx)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		acked, requeued := acks.counts()
+		if acked+requeued >= want {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("deliveries not settled: %d acked, %d requeued, want %d", acked, requeued, want)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	s.Drain(context.Background())
+}
+
+func TestRetryWorkerSettlesDeliveries(t *testing.T) {
+	statuses := map[string]int{"accepted": http.StatusAccepted, "rejected": http.StatusBadRequest, "down": http.StatusServiceUnavailable}
+	var mu sync.Mutex
+	paths := map[string]string{}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		username := r.Header.Get(identityUserHeader)
+		mu.Lock()
+		paths[username] = r.URL.Path
+		mu.Unlock()
+		w.WriteHeader(statuses[username])
+	}))
+	defer upstream.Close()
+
+	s, queue := newTestServer(upstream.URL)
+	acks := &fakeAcknowledger{}
+	queue.deliveries <- testDelivery(acks, 1, retryCardPayment, "accepted", 1)
+	queue.deliveries <- testDelivery(acks, 2, retryMobilePayment, "rejected", 1)
+	queue.deliveries <- testDelivery(acks, 3, retryCardPayment, "down", 1)
+	queue.deliveries <- testDelivery(acks, 4, "cheque", "unknown", 1)
+	queue.deliveries <- amqp.Delivery{Acknowledger: acks, DeliveryTag: 5, Body: []byte(`{"payment_method":"card"}`)}
+
+	runRetryWorker(t, s, acks, 5)
+
+	if acked, requeued := acks.counts(); acked != 5 || requeued != 0 {
+		t.Errorf("expected all 5 acked, got acked %v requeued %v", acks.acked, acks.requeued)
+	}
+	if paths["accepted"] != "/payments/initiate" || paths["rejected"] != "/payments/send-to-mobile" {
+		t.Errorf("retries were sent to the wrong endpoints: %v", paths)
+	}
+	if len(queue.scheduled) != 1 || queue.scheduled[0].attempt != 2 {
+		t.Fatalf("expected the failed retry to be scheduled again as attempt 2, got %+v", queue.scheduled)
+	}
+	if env := decodeTestEnvelope(t, queue.scheduled[0].msg.Body); env.Username != "down" || env.Attempt != 2 || env.IdempotencyKey != "key-down" {
+		t.Errorf("unexpected rescheduled message %+v", env)
+	}
+	if attempt := queue.scheduled[0].msg.Headers[attemptMessageHeader]; attempt != int32(2) {
+		t.Errorf("expected the attempt header of the rescheduled message to be 2, got %v", attempt)
+	}
+
+	reasons := map[string]bool{}
+	for _, msg := range queue.deadLettered {
+		reason, _ := msg.Headers["dead_letter_reason"].(string)
+		reasons[reason] = true
+	}
+	for _, want := range []string{"payments service answered 400", `unknown retry type "cheque"`, "unsupported retry message version 0"} {
+		if !reasons[want] {
+			t.Errorf("expected a message dead-lettered with %q, got %v", want, reasons)
+		}
+	}
+}
+
+func TestRetryWithReusedKeyIsDeadLettered(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// What the payments service answers when the key was first used with another body
+		http.Error(w, "Unprocessable Entity: Idempotency-Key was already used with a different request", http.StatusUnprocessableEntity)
+	}))
+	defer upstream.Close()
+
+	s, queue := newTestServer(upstream.URL)
+	acks := &fakeAcknowledger{}
+	queue.deliveries <- testDelivery(acks, 1, retryCardPayment, "alice", 1)
+	runRetryWorker(t, s, acks, 1)
+
+	if len(queue.scheduled) != 0 {
+		t.Errorf("a reused key cannot succeed later, got %d scheduled retries", len(queue.scheduled))
+	}
+	if len(queue.deadLettered) != 1 || queue.deadLettered[0].Headers["dead_letter_reason"] != "payments service answered 422" {
+		t.Errorf("expected the retry to be dead-lettered at once, got %+v", queue.deadLettered)
+	}
+}
+
+func TestRetryGivesUpAfterMaxAttempts(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+
+	s, queue := newTestServer(upstream.URL)
+	s.config.RetryMaxAttempts = 3
+	acks := &fakeAcknowledger{}
+	queue.deliveries <- testDelivery(acks, 1, retryCardPayment, "alice", 3)
+
+	runRetryWorker(t, s, acks, 1)
+
+	if len(queue.scheduled) != 0 {
+		t.Errorf("expected no more retries, got %+v", queue.scheduled)
+	}
+	if len(queue.deadLettered) != 1 || queue.deadLettered[0].Headers["dead_letter_reason"] != "gave up after 3 attempts" {
+		t.Fatalf("expected the message to be dead-lettered, got %+v", queue.deadLettered)
+	}
+	if acked, _ := acks.counts(); acked != 1 {
+		t.Errorf("expected the message to be acked, got %d", acked)
+	}
+}
+
+func TestRetryHandlerRegistry(t *testing.T) {
+	s, queue := newTestServer("http://payments.invalid")
+	var got retryEnvelope
+	s.retryHandlers["refund"] = func(ctx context.Context, env retryEnvelope) (*http.Response, error) {
+		got = env
+		if key, _ := idempotencyKeyFromContext(ctx); key != env.IdempotencyKey {
+			t.Errorf("handler context has idempotency key %q, want %q", key, env.IdempotencyKey)
+		}
+		return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+	}
+	acks := &fakeAcknowledger{}
+	queue.deliveries <- testDelivery(acks, 1, "refund", "alice", 2)
+
+	runRetryWorker(t, s, acks, 1)
+
+	if got.Type != "refund" || got.Username != "alice" || got.Attempt != 2 || string(got.Request) != `{"amount":100,"payment_method":"MPESA"}` {
+		t.Errorf("handler got %+v", got)
+	}
+	if acked, _ := acks.counts(); acked != 1 {
+		t.Errorf("expected the message to be acked, got %d", acked)
+	}
+}
+
+func TestUnconfirmedRetriesAreRelayedFromTheOutbox(t *testing.T) {
+	s, queue := newTestServer("http://payments.invalid")
+	outbox := NewMemoryRetryOutbox()
+	s.outbox = outbox
+	s.config.OutboxInterval = time.Millisecond
+
+	queue.scheduleErr = errNotConfirmed
+	if err := s.AddToRetryQueue(context.Background(), retryCardPayment, "alice", []byte(`{"amount":100}`)); err != nil {
+		t.Fatalf("AddToRetryQueue: %v", err)
+	}
+	if outbox.Len() != 1 {
+		t.Fatalf("expected the retry to be kept in the outbox, got %d messages", outbox.Len())
+	}
+
+	queue.mu.Lock()
+	queue.scheduleErr = nil
+	queue.mu.Unlock()
+	ctx, cancel := context.WithCancel(context.Background())
+	s.StartRetryWorker(ctx)
+	deadline := time.Now().Add(5 * time.Second)
+	for outbox.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	cancel()
+	s.Drain(context.Background())
+
+	if len(queue.scheduled) != 1 || queue.scheduled[0].attempt != 1 {
+		t.Fatalf("expected the retry to be published from the outbox, got %+v", queue.scheduled)
+	}
+	if env := decodeTestEnvelope(t, queue.scheduled[0].msg.Body); env.Type != retryCardPayment || env.Username != "alice" {
+		t.Errorf("unexpected retry message %+v", env)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	s, _ := newTestServer("http://payments.invalid")
+	s.config.RetryDelay = time.Second
+	s.config.RetryMaxDelay = 10 * time.Second
+
+	for _, tc := range []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{30, 10 * time.Second},
+	} {
+		for i := 0; i < 100; i++ {
+			if d := s.retryBackoff(tc.attempt); d < tc.max/2 || d > tc.max {
+				t.Fatalf("attempt %d: backoff %v outside [%v, %v]", tc.attempt, d, tc.max/2, tc.max)
+			}
+		}
+	}
+}
+
+func TestShutdownFinishesStartedRetries(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer upstream.Close()
+
+	s, queue := newTestServer(upstream.URL)
+	acks := &fakeAcknowledger{}
+	queue.deliveries <- testDelivery(acks, 1, retryCardPayment, "alice", 1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	s.StartRetryWorker(ctx)
+	<-started
+	cancel()
+	close(release)
+
+	drainCtx, done := context.WithTimeout(context.Background(), 5*time.Second)
+	defer done()
+	if err := s.Drain(drainCtx); err != nil {
+		t.Fatalf("Drain: %v", err)
+	}
+
+	if acked, requeued := acks.counts(); acked != 1 || requeued != 0 {
+		t.Errorf("expected the started retry to finish and be acked, got %d acked and %d requeued", acked, requeued)
+	}
+}
+
+func TestShutdownSettlesStartedRetries(t *testing.T) {
+	for _, tt := range []struct {
+		status                  int
+		scheduled, deadLettered int
+	}{
+		{http.StatusServiceUnavailable, 1, 0},
+		{http.StatusBadRequest, 0, 1},
+	} {
+		started := make(chan struct{})
+		release := make(chan struct{})
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			w.WriteHeader(tt.status)
+		}))
+
+		s, queue := newTestServer(upstream.URL)
+		acks := &fakeAcknowledger{}
+		queue.deliveries <- testDelivery(acks, 1, retryCardPayment, "alice", 1)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		s.StartRetryWorker(ctx)
+		<-started
+		cancel()
+		close(release)
+
+		drainCtx, done := context.WithTimeout(context.Background(), 5*time.Second)
+		if err := s.Drain(drainCtx); err != nil {
+			t.Fatalf("Drain: %v", err)
+		}
+		done()
+		upstream.Close()
+
+		// Returning the message to the queue would make the attempt again
+		acked, requeued := acks.counts()
+		if acked != 1 || requeued != 0 || len(queue.scheduled) != tt.scheduled || len(queue.deadLettered) != tt.deadLettered {
+			t.Errorf("upstream %d: got %d acked, %d requeued, %d scheduled and %d dead-lettered",
+				tt.status, acked, requeued, len(queue.scheduled), len(queue.deadLettered))
+		}
+	}
+}
+
+func TestStopConsumingRequeuesReceivedMessages(t *testing.T) {
+	s, queue := newTestServer("http://payments.invalid")
+	acks := &fakeAcknowledger{}
+	queue.deliveries <- testDelivery(acks, 1, retryMobilePayment, "alice", 1)
+	queue.deliveries <- testDelivery(acks, 2, retryCardPayment, "bob", 1)
+
+	s.stopConsuming(queue.deliveries)
+
+	if acked, requeued := acks.counts(); acked != 0 || requeued != 2 {
+		t.Errorf("expected 2 requeued messages, got %d acked and %d requeued", acked, requeued)
+	}
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Revocations are the access tokens that must be refused before they expire. Tokens
+// are revoked one at a time by ID on logout, and all of a user's tokens issued up to a
+// time when an admin revokes their sessions.
+type Revocations struct {
+	// Tokens maps the ID of each revoked token to when it expires.
+	Tokens map[string]time.Time
+	// Sessions maps a username to the issue time at or before which its tokens are
+	// revoked.
+	Sessions map[string]time.Time
+}
+
+// revoked reports whether the token with the given claims is revoked.
+func (r Revocations) revoked(claims *Claims) bool {
+	if _, ok := r.Tokens[claims.ID]; ok && claims.ID != "" {
+		return true
+	}
+	before, ok := r.Sessions[claims.Username]
+	// A token without an issue time cannot be shown to postdate the revocation
+	return ok && (claims.IssuedAt == nil || !claims.IssuedAt.After(before))
+}
+
+// RevocationSource loads the revocations that still matter.
+type RevocationSource interface {
+	// LoadRevocations returns every revocation of a token that has not expired at now.
+	LoadRevocations(ctx context.Context, now time.Time) (Revocations, error)
+}
+
+// RevocationList is a copy of the revocations recorded by the authentication service,
+// reloaded every interval so that checking a token does not wait on the database. A
+// revocation takes effect on every gateway within one interval.
+//
+// When a reload fails the previous copy is kept, so tokens revoked since are accepted
+// until the database is back.
+type RevocationList struct {
+	source   RevocationSource
+	interval time.Duration
+	now      func() time.Time
+
+	mu      sync.RWMutex
+	current Revocations
+}
+
+func NewRevocationList(source RevocationSource, interval time.Duration, now func() time.Time) *RevocationList {
+	return &RevocationList{source: source, interval: interval, now: now}
+}
+
+// Revoked reports whether the token with the given claims was revoked when the list
+// was last loaded.
+func (l *RevocationList) Revoked(claims *Claims) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.current.revoked(claims)
+}
+
+// Reload replaces the list with the revocations in the source.
+func (l *RevocationList) Reload(ctx context.Context) error {
+	revocations, err := l.source.LoadRevocations(ctx, l.now())
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.current = revocations
+	l.mu.Unlock()
+	return nil
+}
+
+// Run reloads the list every interval until ctx is cancelled.
+func (l *RevocationList) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := l.Reload(ctx); err != nil && ctx.Err() == nil {
+				slog.Error("Failed to reload revoked tokens", "error", err)
+			}
+		}
+	}
+}
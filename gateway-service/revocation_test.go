@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// fakeRevocationSource returns revocations, or err if it is set.
+type fakeRevocationSource struct {
+	revocations Revocations
+	err         error
+}
+
+func (f *fakeRevocationSource) LoadRevocations(ctx context.Context, now time.Time) (Revocations, error) {
+	return f.revocations, f.err
+}
+
+func signTestTokenWithID(t *testing.T, s *Server, username, jti string, issuedAt time.Time) string {
+	return signTestClaims(t, &Claims{
+		Username: username,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
+			IssuedAt:  jwt.NewNumericDate(issuedAt),
+			ExpiresAt: jwt.NewNumericDate(issuedAt.Add(time.Hour)),
+		},
+	})
+}
+
+func TestAuthMiddlewareRefusesRevokedTokens(t *testing.T) {
+	revokedAt := time.Now().Truncate(time.Second)
+	source := &fakeRevocationSource{}
+	s, _ := newTestServer("")
+	s.revocations = NewRevocationList(source, time.Second, time.Now)
+
+	handler := s.authMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	status := func(token string) int {
+		req, _ := http.NewRequest("GET", "/payments/status/1", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr.Code
+	}
+
+	loggedOut := signTestTokenWithID(t, s, "testuser", "logged-out", revokedAt.Add(-time.Minute))
+	stolen := signTestTokenWithID(t, s, "phoneuser", "stolen", revokedAt.Add(-time.Minute))
+	sameSecond := signTestTokenWithID(t, s, "phoneuser", "same-second", revokedAt)
+	fresh := signTestTokenWithID(t, s, "phoneuser", "fresh", revokedAt.Add(time.Second))
+	// Issued after our clock, as when the authentication service's clock is ahead
+	ahead := signTestTokenWithID(t, s, "testuser", "ahead", time.Now().Add(time.Minute))
+
+	for _, token := range []string{loggedOut, stolen, fresh, ahead} {
+		if code := status(token); code != http.StatusOK {
+			t.Fatalf("before any revocation: got status %v want %v", code, http.StatusOK)
+		}
+	}
+
+	source.revocations = Revocations{
+		Tokens:   map[string]time.Time{"logged-out": revokedAt.Add(time.Hour)},
+		Sessions: map[string]time.Time{"phoneuser": revokedAt},
+	}
+	if err := s.revocations.Reload(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"revoked token", loggedOut, http.StatusUnauthorized},
+		{"revoked session", stolen, http.StatusUnauthorized},
+		{"issued in the second of the revocation", sameSecond, http.StatusUnauthorized},
+		{"issued after the revocation", fresh, http.StatusOK},
+		{"other token", ahead, http.StatusOK},
+	}
+	for _, tt := range tests {
+		if code := status(tt.token); code != tt.want {
+			t.Errorf("%s: got status %v want %v", tt.name, code, tt.want)
+		}
+	}
+
+	// A failed reload keeps the revocations already loaded
+	source.err = errors.New("database down")
+	if err := s.revocations.Reload(context.Background()); err == nil {
+		t.Fatal("expected the reload to fail")
+	}
+	if code := status(loggedOut); code != http.StatusUnauthorized {
+		t.Errorf("after a failed reload: got status %v want %v", code, http.StatusUnauthorized)
+	}
+}
+
+func TestServerProxiesLogout(t *testing.T) {
+	var gotPath, gotAuthorization string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath, gotAuthorization = r.URL.Path, r.Header.Get("Authorization")
+		w.WriteHeader(http.StatusForbidden)
+		io.WriteString(w, `{"status": "forbidden"}`)
+	}))
+	defer upstream.Close()
+
+	s, _ := newTestServer("")
+	s.config.AuthServiceURL = upstream.URL
+	token := "Bearer " + signTestToken(t, s, "testuser", time.Now().Add(time.Hour))
+
+	for _, tt := range []struct{ path, upstreamPath string }{
+		{"/logout", "/auth/logout"},
+		{"/admin/users/phoneuser/revoke-sessions", "/auth/admin/users/phoneuser/revoke-sessions"},
+	} {
+		req, _ := http.NewRequest("POST", tt.path, http.NoBody)
+		req.Header.Set("Authorization", token)
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusForbidden || rr.Body.String() != `{"status": "forbidden"}` {
+			t.Errorf("%s: got %v %q, want the upstream response", tt.path, rr.Code, rr.Body.String())
+		}
+		if gotPath != tt.upstreamPath || gotAuthorization != token {
+			t.Errorf("%s: forwarded to %s with %q", tt.path, gotPath, gotAuthorization)
+		}
+	}
+}
+
+func TestServerProxiesProfile(t *testing.T) {
+	var gotMethod, gotAuthorization, gotBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		gotMethod, gotAuthorization, gotBody = r.Method, r.Header.Get("Authorization"), string(body)
+		if r.URL.Path != "/auth/me" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		io.WriteString(w, `{"id":7,"username":"testuser","location":"Nairobi"}`)
+	}))
+	defer upstream.Close()
+
+	s, _ := newTestServer("")
+	s.config.AuthServiceURL = upstream.URL
+	token := "Bearer " + signTestToken(t, s, "testuser", time.Now().Add(time.Hour))
+
+	for _, tt := range []struct{ method, body string }{
+		{"GET", ""},
+		{"PATCH", `{"location":"Nairobi"}`},
+	} {
+		req, _ := http.NewRequest(tt.method, "/me", strings.NewReader(tt.body))
+		req.Header.Set("Authorization", token)
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, req)
+
+		if rr.Code != http.StatusOK || !strings.Contains(rr.Body.String(), `"username":"testuser"`) {
+			t.Errorf("%s /me: got %v %q, want the upstream response", tt.method, rr.Code, rr.Body.String())
+		}
+		if gotMethod != tt.method || gotAuthorization != token || gotBody != tt.body {
+			t.Errorf("%s /me: forwarded as %s with %q and body %q", tt.method, gotMethod, gotAuthorization, gotBody)
+		}
+	}
+
+	// The gateway checks the token before asking the authentication service
+	req, _ := http.NewRequest("GET", "/me", http.NoBody)
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Errorf("without token: got status %v want %v", rr.Code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	httpSwagger "github.com/swaggo/http-swagger"
+)
+
+// Server is the gateway: the public API in front of the authentication and payments
+// services, and the worker that retries failed payments from the queue. It holds
+// everything it depends on, so tests can build one around fakes.
+type Server struct {
+	config Config
+	client *http.Client
+	queue  RetryQueue
+	outbox RetryOutbox
+	now    func() time.Time
+
+	// keys verifies tokens with the keys the authentication service publishes.
+	keys *JWKSCache
+	// revocations lists the tokens to refuse; nil means no token is refused before it
+	// expires.
+	revocations *RevocationList
+
+	// retryHandlers makes the call for each type of queued payment.
+	retryHandlers map[string]retryHandler
+	metrics       *retryMetrics
+
+	// workers tracks the retry worker and the retries it has started.
+	workers sync.WaitGroup
+}
+
+// NewServer returns a gateway that calls the other services with client, queues failed
+// payments on queue and reads the time from now. Retries queue does not take are kept in
+// outbox, and tokens in revocations are refused; either may be nil.
+func NewServer(config Config, client *http.Client, queue RetryQueue, outbox RetryOutbox, revocations *RevocationList, now func() time.Time) *Server {
+	s := &Server{config: config, client: client, queue: queue, outbox: outbox, revocations: revocations, now: now, metrics: newRetryMetrics()}
+	s.keys = NewJWKSCache(config.JWKSURL, client)
+	s.retryHandlers = s.defaultRetryHandlers()
+	for retryType := range s.retryHandlers {
+		s.metrics.waiting(retryType, 0)
+		s.metrics.running(retryType, 0)
+	}
+	return s
+}
+
+// Handler returns the gateway's routes with request ID, logging and auth middleware.
+func (s *Server) Handler() http.Handler {
+	r := mux.NewRouter()
+
+	r.Use(requestIDMiddleware)
+	r.Use(loggingMiddleware)
+	r.Use(s.authMiddleware)
+
+	r.HandleFunc("/register", s.Register).Methods("POST")
+	r.HandleFunc("/login", s.Login).Methods("POST")
+	r.HandleFunc("/refresh", s.Refresh).Methods("POST")
+	r.HandleFunc("/logout", s.Logout).Methods("POST")
+	r.HandleFunc("/me", s.Me).Methods("GET")
+	r.HandleFunc("/me", s.UpdateMe).Methods("PATCH")
+	r.HandleFunc("/payments/initiate", s.InitiatePayment).Methods("POST")
+	r.HandleFunc("/payments/status/{id}", s.GetPaymentStatus).Methods("GET")
+	r.HandleFunc("/payments/send-to-mobile", s.SendToMobile).Methods("POST")
+	r.HandleFunc("/payments/callback", s.PaydCallback).Methods("POST")
+	r.HandleFunc("/admin/payments/{id:[0-9]+}", s.AdminGetPayment).Methods("GET")
+	r.HandleFunc("/admin/payments/provider/{reference}", s.AdminGetPaymentByProviderReference).Methods("GET")
+	r.HandleFunc("/admin/users/{username}/revoke-sessions", s.AdminRevokeSessions).Methods("POST")
+	r.PathPrefix("/swagger/").Handler(httpSwagger.WrapHandler)
+
+	return r
+}
+
+// MetricsHandler returns the routes served on metrics_addr, which is meant to be reached
+// only from inside the deployment.
+func (s *Server) MetricsHandler() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc("/metrics", s.Metrics).Methods("GET")
+	return r
+}
+
+// StartRetryWorker runs PollPayments with a pool of retry workers, and relays the outbox
+// if there is one, in the background until ctx is cancelled.
+func (s *Server) StartRetryWorker(ctx context.Context) {
+	pool := s.startRetryPool(ctx)
+	s.workers.Add(1)
+	go func() {
+		defer s.workers.Done()
+		s.PollPayments(ctx, pool)
+		pool.close()
+	}()
+	if s.outbox != nil {
+		s.workers.Add(1)
+		go func() {
+			defer s.workers.Done()
+			s.relayOutbox(ctx)
+		}()
+	}
+}
+
+// Drain waits until the retry worker and its retries have stopped after their context
+// was cancelled, or until ctx expires.
+func (s *Server) Drain(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		s.workers.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
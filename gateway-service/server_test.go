@@ -0,0 +1,454 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// fakeQueue is a RetryQueue that keeps published messages in memory and delivers
+// whatever is sent to deliveries. Like the AMQP queue, it fails to publish once ctx is
+// done.
+type fakeQueue struct {
+	mu           sync.Mutex
+	scheduled    []scheduledMessage
+	deadLettered []amqp.Publishing
+	deliveries   chan amqp.Delivery
+	// scheduleErr is returned by Schedule, which then keeps nothing.
+	scheduleErr error
+}
+
+type scheduledMessage struct {
+	msg     amqp.Publishing
+	attempt int
+	delay   time.Duration
+}
+
+func newFakeQueue() *fakeQueue {
+	return &fakeQueue{deliveries: make(chan amqp.Delivery, 10)}
+}
+
+func (q *fakeQueue) Schedule(ctx context.Context, msg amqp.Publishing, attempt int, delay time.Duration) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if q.scheduleErr != nil {
+		return q.scheduleErr
+	}
+	q.scheduled = append(q.scheduled, scheduledMessage{msg, attempt, delay})
+	return nil
+}
+
+func (q *fakeQueue) Depths() (map[string]int, error) {
+	return map[string]int{"payment_status_queue": len(q.deliveries)}, nil
+}
+
+func (q *fakeQueue) Consume() (<-chan amqp.Delivery, error) {
+	return q.deliveries, nil
+}
+
+func (q *fakeQueue) Cancel() error {
+	close(q.deliveries)
+	return nil
+}
+
+func (q *fakeQueue) DeadLetter(ctx context.Context, msg amqp.Publishing) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	q.deadLettered = append(q.deadLettered, msg)
+	return nil
+}
+
+// newTestServer returns a gateway that sends payments calls to paymentsURL, with a
+// fake queue and a fixed clock, that accepts tokens signed with testSigningKey.
+func newTestServer(paymentsURL string) (*Server, *fakeQueue) {
+	cfg := defaultConfig()
+	cfg.IdentitySigningKey = "test-identity-key"
+	cfg.PaymentsServiceURL = paymentsURL
+	queue := newFakeQueue()
+	now := func() time.Time { return time.Unix(1700000000, 0) }
+	s := NewServer(cfg, http.DefaultClient, queue, nil, nil, now)
+	trustKey(s, testKeyID, testPublicKey)
+	return s, queue
+}
+
+func TestServerQueuesRejectedPayments(t *testing.T) {
+	var identityTimestamp string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identityTimestamp = r.Header.Get(identityTimestampHeader)
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer upstream.Close()
+
+	s, queue := newTestServer(upstream.URL)
+	req, _ := http.NewRequest("POST", "/payments/initiate", strings.NewReader(`{"amount":100,"payment_method":"card"}`))
+	req.Header.Set("Authorization", "Bearer "+signTestToken(t, s, "testuser", time.Now().Add(time.Hour)))
+	req.Header.Set(idempotencyKeyHeader, "client-key-1")
+
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadGateway {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusBadGateway)
+	}
+	if rr.Header().Get(retryScheduledHeader) != "true" {
+		t.Errorf("expected the client to be told the payment will be retried, got %q", rr.Header().Get(retryScheduledHeader))
+	}
+	if identityTimestamp != "1700000000" {
+		t.Errorf("identity was not signed with the server clock, got timestamp %q", identityTimestamp)
+	}
+	if len(queue.scheduled) != 1 {
+		t.Fatalf("expected 1 queued retry, got %d", len(queue.scheduled))
+	}
+	retry := queue.scheduled[0]
+	if retry.attempt != 1 || retry.msg.MessageId == "" {
+		t.Errorf("unexpected retry %+v", retry)
+	}
+	env, err := decodeRetryEnvelope(retry.msg.Body)
+	if err != nil {
+		t.Fatalf("decoding retry message: %v", err)
+	}
+	if env.Type != retryCardPayment || env.Attempt != 1 || env.Username != "testuser" || env.IdempotencyKey != "client-key-1" {
+		t.Errorf("unexpected retry message %+v", env)
+	}
+	if env.CorrelationID == "" || !env.CreatedAt.Equal(time.Unix(1700000000, 0)) {
+		t.Errorf("retry message is missing its correlation ID or creation time: %+v", env)
+	}
+	if retry.msg.Headers[requestIDMessageHeader] != env.CorrelationID || retry.msg.CorrelationId != env.CorrelationID || retry.msg.Headers[attemptMessageHeader] != int32(1) {
+		t.Errorf("retry message headers do not carry the request ID and attempt: %+v, correlation ID %q", retry.msg.Headers, retry.msg.CorrelationId)
+	}
+	if string(env.Request) != `{"amount":100,"payment_method":"card"}` {
+		t.Errorf("retry message does not carry the original request: %s", env.Request)
+	}
+}
+
+func TestServerQueuesOnlyTransientFailures(t *testing.T) {
+	for _, tt := range []struct {
+		status int
+		queued bool
+	}{
+		{http.StatusAccepted, false},
+		{http.StatusCreated, false},
+		{http.StatusOK, false},
+		{http.StatusBadRequest, false},
+		{http.StatusNotFound, false},
+		// An Idempotency-Key reused with a different request
+		{http.StatusUnprocessableEntity, false},
+		{http.StatusTooManyRequests, true},
+		{http.StatusServiceUnavailable, true},
+	} {
+		upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tt.status)
+		}))
+
+		s, queue := newTestServer(upstream.URL)
+		token := signTestToken(t, s, "testuser", time.Now().Add(time.Hour))
+		for _, path := range []string{"/payments/initiate", "/payments/send-to-mobile"} {
+			req, _ := http.NewRequest("POST", path, strings.NewReader(`{"amount":100}`))
+			req.Header.Set("Authorization", "Bearer "+token)
+			rr := httptest.NewRecorder()
+			s.Handler().ServeHTTP(rr, req)
+
+			if rr.Code != tt.status {
+				t.Errorf("%s with upstream %d: got status %v", path, tt.status, rr.Code)
+			}
+			// Only a payment that will be retried may say so
+			_, told := rr.Header()[retryScheduledHeader]
+			if told != tt.queued {
+				t.Errorf("%s with upstream %d: %s header present=%v, want %v", path, tt.status, retryScheduledHeader, told, tt.queued)
+			}
+		}
+		want := 0
+		if tt.queued {
+			want = 2
+		}
+		if len(queue.scheduled) != want {
+			t.Errorf("upstream %d: got %d queued retries, want %d", tt.status, len(queue.scheduled), want)
+		}
+		upstream.Close()
+	}
+}
+
+func TestServerPassesAcceptedPaymentsThrough(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(PaymentResponse{Status: "Accepted", PaymentID: 7})
+	}))
+	defer upstream.Close()
+
+	s, queue := newTestServer(upstream.URL)
+	req, _ := http.NewRequest("POST", "/payments/initiate", strings.NewReader(`{"amount":100,"payment_method":"card"}`))
+	req.Header.Set("Authorization", "Bearer "+signTestToken(t, s, "testuser", time.Now().Add(time.Hour)))
+
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusAccepted {
+		t.Errorf("handler returned wrong status code: got %v want %v", rr.Code, http.StatusAccepted)
+	}
+	var response PaymentResponse
+	if err := json.NewDecoder(rr.Body).Decode(&response); err != nil || response.Status != "Accepted" || response.PaymentID != 7 {
+		t.Errorf("expected the payments service's answer, got %+v (%v)", response, err)
+	}
+	// An accepted payment is settled, so it is neither queued nor said to be
+	if _, told := rr.Header()[retryScheduledHeader]; told || len(queue.scheduled) != 0 {
+		t.Errorf("accepted payment was queued: header present=%v, %d queued retries", told, len(queue.scheduled))
+	}
+}
+
+func TestServerReportsUnqueuedRetries(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer upstream.Close()
+
+	s, queue := newTestServer(upstream.URL)
+	queue.scheduleErr = errBrokerUnavailable
+	req, _ := http.NewRequest("POST", "/payments/send-to-mobile", strings.NewReader(`{"amount":100,"phone":"254712345678"}`))
+	req.Header.Set("Authorization", "Bearer "+signTestToken(t, s, "testuser", time.Now().Add(time.Hour)))
+
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusBadGateway || rr.Header().Get(retryScheduledHeader) != "false" {
+		t.Errorf("expected the upstream status and no retry, got %v and %q", rr.Code, rr.Header().Get(retryScheduledHeader))
+	}
+}
+
+func TestServerReportsDuplicateUsers(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "User already exists", http.StatusConflict)
+	}))
+	defer upstream.Close()
+
+	s, _ := newTestServer("")
+	s.config.AuthServiceURL = upstream.URL
+	req, _ := http.NewRequest("POST", "/register", strings.NewReader(`{"username":"testuser","password":"password"}`))
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+
+	if rr.Code != http.StatusConflict || rr.Body.String() != `{"status": "user already exists"}` {
+		t.Errorf("got status %v and body %s, want %v", rr.Code, rr.Body.String(), http.StatusConflict)
+	}
+}
+
+func TestServerLogsInThroughAuthService(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/auth/login" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"status":"Login successful","token":"access","refresh_token":"refresh","expires_in":900}`))
+	}))
+	defer upstream.Close()
+
+	s, _ := newTestServer("")
+	s.config.AuthServiceURL = upstream.URL
+
+	// The gateway serves login at /login, not at the path of the authentication service
+	for _, tt := range []struct {
+		path string
+		want int
+	}{
+		{"/login", http.StatusOK},
+		{"/auth/login", http.StatusNotFound},
+	} {
+		req, _ := http.NewRequest("POST", tt.path, strings.NewReader(`{"username":"testuser","password":"password"}`))
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, req)
+
+		if rr.Code != tt.want {
+			t.Errorf("login at %s: got status %v want %v", tt.path, rr.Code, tt.want)
+			continue
+		}
+		if tt.want != http.StatusOK {
+			continue
+		}
+		var response LoginSuccessResponse
+		json.NewDecoder(rr.Body).Decode(&response)
+		if response.Token != "access" || response.RefreshToken != "refresh" {
+			t.Errorf("unexpected response %+v", response)
+		}
+	}
+}
+
+func TestServerProxiesTokenRefresh(t *testing.T) {
+	var gotBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		gotBody = string(body)
+		if r.URL.Path != "/auth/refresh" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if !strings.Contains(gotBody, `"old"`) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`{"status":"Token refreshed","token":"access","refresh_token":"new","expires_in":900}`))
+	}))
+	defer upstream.Close()
+
+	s, _ := newTestServer("")
+	s.config.AuthServiceURL = upstream.URL
+
+	for _, tt := range []struct {
+		token string
+		want  int
+	}{
+		{"old", http.StatusOK},
+		{"stolen", http.StatusUnauthorized},
+	} {
+		req, _ := http.NewRequest("POST", "/refresh", strings.NewReader(`{"refresh_token":"`+tt.token+`"}`))
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, req)
+
+		if rr.Code != tt.want {
+			t.Errorf("refresh with %q: got status %v want %v", tt.token, rr.Code, tt.want)
+			continue
+		}
+		if tt.want != http.StatusOK {
+			continue
+		}
+		var response LoginSuccessResponse
+		json.NewDecoder(rr.Body).Decode(&response)
+		if response.Token != "access" || response.RefreshToken != "new" || response.ExpiresIn != 900 {
+			t.Errorf("unexpected response %+v", response)
+		}
+	}
+	if gotBody != `{"refresh_token":"stolen"}` {
+		t.Errorf("request body was not forwarded, got %q", gotBody)
+	}
+}
+
+func TestServerForwardsPaydCallbacks(t *testing.T) {
+	var gotURL, gotSignature, gotBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		gotURL, gotSignature, gotBody = r.URL.String(), r.Header.Get(paydSignatureHeader), string(body)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer upstream.Close()
+
+	s, _ := newTestServer(upstream.URL)
+	req, _ := http.NewRequest("POST", "/payments/callback?payment_id=7", strings.NewReader(`{"transaction_reference":"TX1"}`))
+	req.Header.Set(paydSignatureHeader, "abc")
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+
+	// Payd resends callbacks that are not acknowledged, so the status must reach it
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %v want %v", rr.Code, http.StatusServiceUnavailable)
+	}
+	if gotURL != "/payments/callback?payment_id=7" || gotSignature != "abc" || gotBody != `{"transaction_reference":"TX1"}` {
+		t.Errorf("forwarded %s with signature %q and body %q", gotURL, gotSignature, gotBody)
+	}
+}
+
+func TestServersAreIndependent(t *testing.T) {
+	var hits [2]int
+	upstreams := [2]*httptest.Server{}
+	for i := range upstreams {
+		i := i
+		upstreams[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			hits[i]++
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer upstreams[i].Close()
+	}
+
+	first, _ := newTestServer(upstreams[0].URL)
+	second, _ := newTestServer(upstreams[1].URL)
+	otherKey, _, _ := ed25519.GenerateKey(rand.Reader)
+	trustKey(second, testKeyID, otherKey)
+
+	req, _ := http.NewRequest("GET", "/payments/status/1", nil)
+	req.Header.Set("Authorization", "Bearer "+signTestToken(t, first, "testuser", time.Now().Add(time.Hour)))
+
+	rr := httptest.NewRecorder()
+	first.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusOK || hits != [2]int{1, 0} {
+		t.Errorf("first server: status %v, upstream hits %v", rr.Code, hits)
+	}
+
+	rr = httptest.NewRecorder()
+	second.Handler().ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized || hits != [2]int{1, 0} {
+		t.Errorf("second server should reject a token signed with another key: status %v, upstream hits %v", rr.Code, hits)
+	}
+}
+
+func TestServerSignsIdentityForTheRequest(t *testing.T) {
+	var got http.Header
+	var gotPath, gotBody string
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		got, gotPath, gotBody = r.Header, r.URL.RequestURI(), string(body)
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer upstream.Close()
+
+	s, _ := newTestServer(upstream.URL)
+	req, _ := http.NewRequest("POST", "/payments/initiate", strings.NewReader(`{"amount":100}`))
+	req.Header.Set("Authorization", "Bearer "+signTestToken(t, s, "testuser", time.Now().Add(time.Hour)))
+	s.Handler().ServeHTTP(httptest.NewRecorder(), req)
+
+	// The payments service checks the signature over the method, path and body digest
+	digest := sha256.Sum256([]byte(gotBody))
+	mac := hmac.New(sha256.New, []byte("test-identity-key"))
+	mac.Write([]byte("testuser\n1700000000\nPOST\n" + gotPath + "\n" + hex.EncodeToString(digest[:])))
+	if gotPath != "/payments/initiate" || gotBody != `{"amount":100}` {
+		t.Fatalf("unexpected upstream request %s with body %q", gotPath, gotBody)
+	}
+	if got.Get(identitySignatureHeader) != hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("identity signature %q does not cover the request", got.Get(identitySignatureHeader))
+	}
+}
+
+func TestServerAsksForPaymentStatusAsCaller(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The payments service only shows a payment to its owner
+		if r.Header.Get(identityUserHeader) != "owner" || r.Header.Get(identitySignatureHeader) == "" {
+			http.Error(w, "Payment Not Found", http.StatusNotFound)
+			return
+		}
+		w.Write([]byte(`{"payment_id":1,"status":"PENDING"}`))
+	}))
+	defer upstream.Close()
+
+	s, _ := newTestServer(upstream.URL)
+	for _, tt := range []struct {
+		username string
+		want     int
+	}{
+		{"owner", http.StatusOK},
+		{"otheruser", http.StatusNotFound},
+	} {
+		req, _ := http.NewRequest("GET", "/payments/status/1", nil)
+		req.Header.Set("Authorization", "Bearer "+signTestToken(t, s, tt.username, time.Now().Add(time.Hour)))
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, req)
+		if rr.Code != tt.want {
+			t.Errorf("%s: got status %v want %v", tt.username, rr.Code, tt.want)
+		}
+	}
+}
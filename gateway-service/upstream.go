@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+)
+
+const paydSignatureHeader = "X-Payd-Signature"
+
+// newUpstreamRequest builds a request to another service, forwarding the request ID and
+// idempotency key from ctx.
+func newUpstreamRequest(ctx context.Context, method, url string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if id, ok := requestIDFromContext(ctx); ok {
+		req.Header.Set(requestIDHeader, id)
+	}
+	if key, ok := idempotencyKeyFromContext(ctx); ok {
+		req.Header.Set(idempotencyKeyHeader, key)
+	}
+	return req, nil
+}
+
+// post sends an anonymous JSON POST to url.
+func (s *Server) post(ctx context.Context, url string, body io.Reader) (*http.Response, error) {
+	req, err := newUpstreamRequest(ctx, "POST", url, body)
+	if err != nil {
+		return nil, err
+	}
+	return s.client.Do(req)
+}
+
+// sendWithToken sends a request to url with the caller's Authorization header, for the
+// authentication service to check the token itself.
+func (s *Server) sendWithToken(ctx context.Context, method, url, authorization string, body io.Reader) (*http.Response, error) {
+	req, err := newUpstreamRequest(ctx, method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", authorization)
+	return s.client.Do(req)
+}
+
+// postAs sends a JSON POST to url on behalf of username.
+func (s *Server) postAs(ctx context.Context, url, username string, body []byte) (*http.Response, error) {
+	req, err := newUpstreamRequest(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	s.signIdentity(req, username, body)
+	return s.client.Do(req)
+}
+
+// getAs sends a GET to url on behalf of username.
+func (s *Server) getAs(ctx context.Context, url, username string) (*http.Response, error) {
+	req, err := newUpstreamRequest(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	s.signIdentity(req, username, nil)
+	return s.client.Do(req)
+}
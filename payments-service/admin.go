@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// PaymentDetails is everything we know about a payment, for support staff.
+type PaymentDetails struct {
+	Payment
+	History  []StatusTransition  `json:"history"`
+	Attempts []PaydAttemptRecord `json:"attempts"`
+}
+
+// AdminGetPayment godoc
+// @Summary Look up a payment by ID
+// @Description Returns a payment with its status history and every call made to Payd for it. Admin only.
+// @Tags admin
+// @Produce json
+// @Param id path int true "Payment ID"
+// @Success 200 {object} PaymentDetails
+// @Failure 400 {string} string "Bad Request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 404 {string} string "Payment Not Found"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /admin/payments/{id} [get]
+func (s *Server) AdminGetPayment(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "Bad Request: invalid payment ID", http.StatusBadRequest)
+		return
+	}
+	payment, err := s.payments.GetPayment(r.Context(), id)
+	s.writePaymentDetails(w, r, payment, err)
+}
+
+// AdminGetPaymentByProviderReference godoc
+// @Summary Look up a payment by Payd reference
+// @Description Returns the payment Payd knows by the given transaction reference, with its status history and Payd calls. Admin only.
+// @Tags admin
+// @Produce json
+// @Param reference path string true "Payd transaction reference"
+// @Success 200 {object} PaymentDetails
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
+// @Failure 404 {string} string "Payment Not Found"
+// @Failure 500 {string} string "Internal Server Error"
+// @Router /admin/payments/provider/{reference} [get]
+func (s *Server) AdminGetPaymentByProviderReference(w http.ResponseWriter, r *http.Request) {
+	payment, err := s.payments.GetPaymentByProviderReference(r.Context(), mux.Vars(r)["reference"])
+	s.writePaymentDetails(w, r, payment, err)
+}
+
+func (s *Server) writePaymentDetails(w http.ResponseWriter, r *http.Request, payment Payment, err error) {
+	ctx := r.Context()
+	if err == errPaymentNotFound {
+		http.Error(w, "Payment Not Found", http.StatusNotFound)
+		return
+	}
+
+	details := PaymentDetails{Payment: payment}
+	if err == nil {
+		details.History, err = s.payments.History(ctx, payment.PaymentID)
+	}
+	if err == nil {
+		details.Attempts, err = s.payments.Attempts(ctx, payment.PaymentID)
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error loading payment details", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(details)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAdminOnly(t *testing.T) {
+	s, _, _ := newTestServer()
+	handler := s.adminOnly(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	tests := []struct {
+		username string
+		want     int
+	}{
+		{"", http.StatusUnauthorized},
+		{"testuser", http.StatusForbidden},
+		{"support", http.StatusOK},
+	}
+	for _, tt := range tests {
+		req, _ := http.NewRequest("GET", "/admin/payments/1", nil)
+		if tt.username != "" {
+			signTestIdentity(req, tt.username, time.Now())
+		}
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		if rr.Code != tt.want {
+			t.Errorf("user %q: got %d want %d", tt.username, rr.Code, tt.want)
+		}
+	}
+}
+
+func TestPaydAttemptProviderReference(t *testing.T) {
+	tests := []struct {
+		response string
+		want     string
+	}{
+		{`{"transaction_reference":"TX123","status":"pending"}`, "TX123"},
+		{`{"message":"invalid phone number"}`, ""},
+		{`<html>Bad Gateway</html>`, ""},
+		{``, ""},
+	}
+	for _, tt := range tests {
+		a := paydAttempt{Operation: operationInitiate, Response: []byte(tt.response)}
+		if got := a.providerReference(); got != tt.want {
+			t.Errorf("providerReference(%q) = %q, want %q", tt.response, got, tt.want)
+		}
+	}
+}
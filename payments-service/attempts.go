@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/tufstraka/pps/payments-service/payd"
+)
+
+// Payd operations recorded in payment_attempts.
+const (
+	operationInitiate   = "initiate"
+	operationWithdrawal = "withdrawal"
+)
+
+// Largest part of a Payd response body we keep per attempt.
+const maxResponseSnapshot = 64 << 10
+
+// paydResponse holds the fields we keep from Payd's reply to a new payment.
+type paydResponse struct {
+	TransactionReference string `json:"transaction_reference"`
+}
+
+// paydAttempt is the outcome of one call to Payd for a payment.
+type paydAttempt struct {
+	Operation  string
+	HTTPStatus int
+	Response   []byte
+	Err        error
+}
+
+// providerReference returns Payd's transaction reference from the response, if any.
+func (a paydAttempt) providerReference() string {
+	var resp paydResponse
+	if err := json.Unmarshal(a.Response, &resp); err != nil {
+		return ""
+	}
+	return resp.TransactionReference
+}
+
+// newPaydAttempt describes the outcome of a Payd call. Payd's answer is kept whether
+// it accepted the request or not.
+func newPaydAttempt(operation string, txn *payd.Transaction, err error) paydAttempt {
+	a := paydAttempt{Operation: operation, Err: err}
+	var apiErr *payd.APIError
+	switch {
+	case errors.As(err, &apiErr):
+		a.HTTPStatus, a.Response = apiErr.StatusCode, apiErr.Body
+	case txn != nil:
+		a.HTTPStatus, a.Response = txn.StatusCode, txn.Body
+	}
+	return a
+}
+
+// snapshot returns the part of the response body that is stored.
+func (a paydAttempt) snapshot() []byte {
+	if len(a.Response) > maxResponseSnapshot {
+		return a.Response[:maxResponseSnapshot]
+	}
+	return a.Response
+}
+
+// PaydAttemptRecord is a stored call to Payd as shown to admins.
+type PaydAttemptRecord struct {
+	ID                int       `json:"id"`
+	Operation         string    `json:"operation"`
+	HTTPStatus        int       `json:"http_status,omitempty"`
+	ProviderReference string    `json:"provider_reference,omitempty"`
+	Response          string    `json:"response,omitempty"`
+	Error             string    `json:"error,omitempty"`
+	CreatedAt         time.Time `json:"created_at"`
+}
+
+// paydOutcomeUnknown reports whether Payd may have acted on a request that failed with
+// err. Only an answer from Payd says it did not; a request that timed out or lost its
+// connection may have reached Payd and only the answer was lost.
+func paydOutcomeUnknown(err error) bool {
+	var apiErr *payd.APIError
+	return err != nil && !errors.As(err, &apiErr)
+}
+
+// writePending answers a request whose Payd call may have moved money but whose outcome
+// is not known or could not be recorded. It is a success, so that the idempotency key is
+// kept and a retry with it does not call Payd again.
+func writePending(w http.ResponseWriter, paymentID int) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(PaymentResponse{
+		Status:    "Pending",
+		PaymentID: paymentID,
+	})
+}
+
+// pendPaydAttempt records an attempt whose outcome is unknown. The payment stays PENDING
+// until Payd's callback settles it. Errors are only logged since the caller must still
+// answer as if Payd had accepted the request.
+func (s *Server) pendPaydAttempt(ctx context.Context, paymentID int, a paydAttempt) {
+	if err := s.payments.RecordAttempt(ctx, paymentID, a, StatusPending, "No answer from Payd"); err != nil {
+		slog.ErrorContext(ctx, "Error recording Payd attempt", "payment_id", paymentID, "error", err)
+	}
+}
+
+// failPaydAttempt records an attempt that leaves the payment FAILED. Errors are only
+// logged since the caller is already reporting a failure.
+func (s *Server) failPaydAttempt(ctx context.Context, paymentID int, a paydAttempt, reason string) {
+	if err := s.payments.RecordAttempt(ctx, paymentID, a, StatusFailed, reason); err != nil {
+		slog.ErrorContext(ctx, "Error recording Payd attempt", "payment_id", paymentID, "error", err)
+	}
+}
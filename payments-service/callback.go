@@ -0,0 +1,199 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const paydSignatureHeader = "X-Payd-Signature"
+
+// Largest callback body we are willing to read.
+const maxCallbackBodySize = 1 << 20
+
+// Seconds Payd is asked to wait before resending a callback we cannot match yet.
+const callbackRetryAfter = "5"
+
+// callbackPaymentIDParam names the payment in the callback URL sent to Payd.
+const callbackPaymentIDParam = "payment_id"
+
+var errInvalidCallbackSignature = errors.New("invalid callback signature")
+
+// PaydCallback is the notification Payd sends once a payment or payout settles.
+type PaydCallback struct {
+	TransactionReference string  `json:"transaction_reference"`
+	ResultCode           int     `json:"result_code"`
+	Remarks              string  `json:"remarks"`
+	Amount               float64 `json:"amount"`
+	Success              bool    `json:"success"`
+	Status               string  `json:"status"`
+}
+
+// paymentStatus maps a callback to the lifecycle state it moves the payment to. A status
+// Payd is not known to send is not taken as a failure, since the payment may have gone
+// through; ok is false for it.
+func (c PaydCallback) paymentStatus() (status PaymentStatus, ok bool) {
+	switch {
+	case c.Success || strings.EqualFold(c.Status, "success"):
+		return StatusSucceeded, true
+	case strings.EqualFold(c.Status, "processing"):
+		return StatusProcessing, true
+	case strings.EqualFold(c.Status, "failed"), strings.EqualFold(c.Status, "cancelled"):
+		return StatusFailed, true
+	}
+	return "", false
+}
+
+// callbackURL returns the URL Payd is asked to call back for a payment. It names the
+// payment so that the callback can be matched even if Payd's reference never reached us.
+func (s *Server) callbackURL(paymentID int) string {
+	u, err := url.Parse(s.config.PaydCallbackURL)
+	if err != nil {
+		// Checked when the config is loaded
+		return s.config.PaydCallbackURL
+	}
+	q := u.Query()
+	q.Set(callbackPaymentIDParam, strconv.Itoa(paymentID))
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// paymentFromCallbackURL returns the payment named in the callback URL, for a callback
+// whose reference we do not know because Payd's answer to the request was lost. The URL
+// is not signed, so only a PENDING payment without a reference is matched, and it keeps
+// the callback's reference from then on.
+func (s *Server) paymentFromCallbackURL(r *http.Request, reference string) (Payment, error) {
+	id, err := strconv.Atoi(r.URL.Query().Get(callbackPaymentIDParam))
+	if err != nil {
+		return Payment{}, errPaymentNotFound
+	}
+	payment, err := s.payments.GetPayment(r.Context(), id)
+	if err != nil {
+		return Payment{}, err
+	}
+	if payment.ProviderReference != "" || payment.Status != StatusPending {
+		return Payment{}, errPaymentNotFound
+	}
+	if err := s.payments.SetProviderReference(r.Context(), id, reference); err != nil {
+		return Payment{}, err
+	}
+	slog.InfoContext(r.Context(), "Matched Payd callback by payment ID", "payment_id", id, "provider_reference", reference)
+	payment.ProviderReference = reference
+	return payment, nil
+}
+
+// verifyCallbackSignature checks the hex HMAC-SHA256 of body, keyed with the webhook secret.
+func (s *Server) verifyCallbackSignature(body []byte, signature string) error {
+	if s.config.PaydWebhookSecret == "" {
+		return errInvalidCallbackSignature
+	}
+	given, err := hex.DecodeString(strings.TrimPrefix(signature, "sha256="))
+	if err != nil {
+		return errInvalidCallbackSignature
+	}
+	mac := hmac.New(sha256.New, []byte(s.config.PaydWebhookSecret))
+	mac.Write(body)
+	if !hmac.Equal(given, mac.Sum(nil)) {
+		return errInvalidCallbackSignature
+	}
+	return nil
+}
+
+// PaydCallbackHandler godoc
+// @Summary Receive a Payd payment notification
+// @Description Called by Payd when a payment settles. Moves the payment matching the transaction reference to its new status. A payment whose reference we never received from Payd is matched by the payment_id in the callback URL.
+// @Tags payments
+// @Accept json
+// @Produce json
+// @Param X-Payd-Signature header string true "Hex HMAC-SHA256 of the body keyed with the webhook secret"
+// @Param payment_id query int false "Payment the callback URL was issued for"
+// @Param callback body PaydCallback true "Payd callback"
+// @Success 200 {object} map[string]string
+// @Failure 400 {string} string "Bad Request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 409 {string} string "Conflict"
+// @Failure 500 {string} string "Internal Server Error"
+// @Failure 503 {string} string "Payment not recorded yet; Payd should resend the callback"
+// @Router /payments/callback [post]
+func (s *Server) PaydCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+
+	body, err := io.ReadAll(io.LimitReader(r.Body, maxCallbackBodySize))
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+		return
+	}
+
+	if err := s.verifyCallbackSignature(body, r.Header.Get(paydSignatureHeader)); err != nil {
+		slog.WarnContext(ctx, "Rejected Payd callback", "error", err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var callback PaydCallback
+	if err := json.Unmarshal(body, &callback); err != nil || callback.TransactionReference == "" {
+		http.Error(w, "Bad Request: invalid callback", http.StatusBadRequest)
+		return
+	}
+
+	status, ok := callback.paymentStatus()
+	if !ok {
+		slog.WarnContext(ctx, "Rejected Payd callback with unknown status",
+			"provider_reference", callback.TransactionReference, "status", callback.Status)
+		http.Error(w, "Bad Request: unknown callback status", http.StatusBadRequest)
+		return
+	}
+	payment, err := s.payments.GetPaymentByProviderReference(ctx, callback.TransactionReference)
+	if err == errPaymentNotFound {
+		payment, err = s.paymentFromCallbackURL(r, callback.TransactionReference)
+	}
+	if err == errPaymentNotFound {
+		// Payd can call back before we have stored the reference it answered with. Payd
+		// sends the callback again until it is acknowledged, by which time we have.
+		slog.WarnContext(ctx, "Payd callback for unknown payment", "provider_reference", callback.TransactionReference)
+		w.Header().Set("Retry-After", callbackRetryAfter)
+		http.Error(w, "Service Unavailable: payment not recorded yet", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error querying payment", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	paymentID := payment.PaymentID
+
+	reason := callback.Remarks
+	if reason == "" {
+		reason = "Payd callback"
+	}
+	current, err := s.payments.Transition(ctx, paymentID, status, reason)
+	if errors.Is(err, errIllegalTransition) {
+		// Payd repeats callbacks until acknowledged, so one we already applied is not an error
+		if current == status {
+			slog.InfoContext(ctx, "Ignoring repeated Payd callback", "payment_id", paymentID, "status", current)
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]PaymentStatus{"status": current})
+			return
+		}
+		slog.WarnContext(ctx, "Rejected Payd callback", "payment_id", paymentID, "error", err)
+		http.Error(w, "Conflict: payment is already "+string(current), http.StatusConflict)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(ctx, "Error updating payment status", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	slog.InfoContext(ctx, "Payment status updated from Payd callback", "payment_id", paymentID, "status", status)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]PaymentStatus{"status": status})
+}
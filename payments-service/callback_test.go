@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tufstraka/pps/payments-service/payd"
+)
+
+// fakePaydSender delivers signed callbacks the way Payd does.
+type fakePaydSender struct {
+	secret  string
+	handler http.Handler
+}
+
+func (f fakePaydSender) sign(body []byte) string {
+	mac := hmac.New(sha256.New, []byte(f.secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (f fakePaydSender) sendRaw(body []byte, signature string) *httptest.ResponseRecorder {
+	return f.post("/payments/callback", body, signature)
+}
+
+func (f fakePaydSender) post(target string, body []byte, signature string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("POST", target, bytes.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	if signature != "" {
+		req.Header.Set(paydSignatureHeader, signature)
+	}
+	rr := httptest.NewRecorder()
+	f.handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func (f fakePaydSender) send(callback PaydCallback) *httptest.ResponseRecorder {
+	return f.sendTo("/payments/callback", callback)
+}
+
+// sendTo delivers a callback to the callback URL given to Payd.
+func (f fakePaydSender) sendTo(target string, callback PaydCallback) *httptest.ResponseRecorder {
+	body, _ := json.Marshal(callback)
+	return f.post(target, body, f.sign(body))
+}
+
+func newFakePaydSender(s *Server) fakePaydSender {
+	return fakePaydSender{secret: testWebhookSecret, handler: http.HandlerFunc(s.PaydCallbackHandler)}
+}
+
+func TestPaydCallbackRejectsBadSignature(t *testing.T) {
+	s, _, _ := newTestServer()
+	payd := newFakePaydSender(s)
+	body := []byte(`{"transaction_reference":"TX1","success":true}`)
+
+	if rr := payd.sendRaw(body, ""); rr.Code != http.StatusUnauthorized {
+		t.Errorf("unsigned callback: got %d want %d", rr.Code, http.StatusUnauthorized)
+	}
+
+	forged := fakePaydSender{secret: "wrong-secret"}
+	if rr := payd.sendRaw(body, forged.sign(body)); rr.Code != http.StatusUnauthorized {
+		t.Errorf("callback signed with wrong secret: got %d want %d", rr.Code, http.StatusUnauthorized)
+	}
+
+	if rr := payd.sendRaw([]byte(`{"success":true}`), payd.sign([]byte(`{"success":true}`))); rr.Code != http.StatusBadRequest {
+		t.Errorf("callback without reference: got %d want %d", rr.Code, http.StatusBadRequest)
+	}
+}
+
+func TestPaydCallbackUpdatesPayment(t *testing.T) {
+	s, payments, _ := newTestServer()
+	payd := newFakePaydSender(s)
+	reference := "TEST-" + time.Now().Format("150405.000000")
+
+	paymentID, err := payments.CreatePayment(context.Background(), paymentRecord{
+		Direction: directionPayIn, Amount: 100, Method: "MPESA", ProviderReference: reference,
+	}, StatusPending, "Accepted by Payd")
+	if err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+
+	if rr := payd.send(PaydCallback{TransactionReference: reference, Success: true, Remarks: "Paid"}); rr.Code != http.StatusOK {
+		t.Fatalf("callback returned %d: %s", rr.Code, rr.Body.String())
+	}
+
+	payment, _ := payments.GetPayment(context.Background(), paymentID)
+	if payment.Status != StatusSucceeded {
+		t.Errorf("expected payment status SUCCEEDED, got %q", payment.Status)
+	}
+
+	// A repeated callback must not log a second transition
+	payd.send(PaydCallback{TransactionReference: reference, Success: true, Remarks: "Paid"})
+	history, _ := payments.History(context.Background(), paymentID)
+	if len(history) != 2 {
+		t.Errorf("expected 2 status history entries, got %d", len(history))
+	}
+
+	// A settled payment cannot be failed afterwards
+	if rr := payd.send(PaydCallback{TransactionReference: reference, Status: "failed"}); rr.Code != http.StatusConflict {
+		t.Errorf("conflicting callback: got %d want %d", rr.Code, http.StatusConflict)
+	}
+
+	if rr := payd.send(PaydCallback{TransactionReference: "UNKNOWN-" + reference, Success: true}); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("unknown reference: got %d want %d", rr.Code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestPaydCallbackWithUnknownStatusIsRejected(t *testing.T) {
+	s, payments, _ := newTestServer()
+	payd := newFakePaydSender(s)
+	reference := "TEST-" + time.Now().Format("150405.000000")
+
+	paymentID, err := payments.CreatePayment(context.Background(), paymentRecord{
+		Direction: directionPayIn, Amount: 100, Method: "MPESA", ProviderReference: reference,
+	}, StatusPending, "Accepted by Payd")
+	if err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+
+	for _, callback := range []PaydCallback{
+		{TransactionReference: reference, Status: "reversal_pending"},
+		{TransactionReference: reference},
+	} {
+		if rr := payd.send(callback); rr.Code != http.StatusBadRequest {
+			t.Errorf("callback %+v: got %d want %d", callback, rr.Code, http.StatusBadRequest)
+		}
+	}
+
+	// The payment may still have gone through, so it must not be failed
+	payment, _ := payments.GetPayment(context.Background(), paymentID)
+	if payment.Status != StatusPending {
+		t.Errorf("expected payment status PENDING, got %q", payment.Status)
+	}
+}
+
+func TestPaydCallbackBeforeAttemptIsRecorded(t *testing.T) {
+	s, payments, fake := newTestServer()
+	sender := newFakePaydSender(s)
+
+	paymentID, err := payments.CreatePayment(context.Background(), paymentRecord{
+		Direction: directionPayIn, Amount: 100, Method: "MPESA",
+	}, StatusCreated, "Payment requested")
+	if err != nil {
+		t.Fatalf("Failed to create payment: %v", err)
+	}
+	txn, _ := fake.CreatePayment(context.Background(), payd.PaymentRequest{Amount: 100})
+
+	// Payd answers the callback URL before the handler has stored Payd's reply
+	callback := PaydCallback{TransactionReference: txn.TransactionReference, Success: true}
+	rr := sender.send(callback)
+	if rr.Code != http.StatusServiceUnavailable || rr.Header().Get("Retry-After") == "" {
+		t.Fatalf("early callback: got %d with Retry-After %q, want %d", rr.Code, rr.Header().Get("Retry-After"), http.StatusServiceUnavailable)
+	}
+
+	if err := payments.RecordAttempt(context.Background(), paymentID, newPaydAttempt(operationInitiate, txn, nil), StatusPending, "Accepted by Payd"); err != nil {
+		t.Fatal(err)
+	}
+	if rr := sender.send(callback); rr.Code != http.StatusOK {
+		t.Fatalf("redelivered callback: got %d: %s", rr.Code, rr.Body.String())
+	}
+	if payment, _ := payments.GetPayment(context.Background(), paymentID); payment.Status != StatusSucceeded {
+		t.Errorf("expected payment status SUCCEEDED, got %q", payment.Status)
+	}
+}
+
+func TestPaydCallbackSettlesTimedOutPayment(t *testing.T) {
+	s, payments, fake := newTestServer()
+	sender := newFakePaydSender(s)
+	fake.Err = &payd.RequestError{Operation: payd.OperationCreatePayment, Err: context.DeadlineExceeded}
+
+	req, _ := http.NewRequest("POST", "/payments/initiate", strings.NewReader(`{"amount":100,"payment_method":"MPESA"}`))
+	signTestIdentity(req, "testuser", time.Now())
+	rr := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rr, req)
+	var response PaymentResponse
+	json.NewDecoder(rr.Body).Decode(&response)
+	if rr.Code != http.StatusAccepted || len(fake.Payments) != 1 {
+		t.Fatalf("timed out payment: got %d after %d Payd calls", rr.Code, len(fake.Payments))
+	}
+	callbackURL := fake.Payments[0].CallbackURL
+	if want := "https://gateway.example/payments/callback?payment_id=" + strconv.Itoa(response.PaymentID); callbackURL != want {
+		t.Fatalf("callback URL %q, want %q", callbackURL, want)
+	}
+
+	// Payd made the payment but its answer with the reference never arrived
+	reference := "LATE-" + time.Now().Format("150405.000000")
+	if rr := sender.sendTo(callbackURL, PaydCallback{TransactionReference: reference, Success: true}); rr.Code != http.StatusOK {
+		t.Fatalf("late callback: got %d: %s", rr.Code, rr.Body.String())
+	}
+	payment, _ := payments.GetPayment(context.Background(), response.PaymentID)
+	if payment.Status != StatusSucceeded || payment.ProviderReference != reference {
+		t.Errorf("payment is %s with reference %q, want %s with %q", payment.Status, payment.ProviderReference, StatusSucceeded, reference)
+	}
+
+	// Once the payment has a reference, the payment ID in the URL matches nothing else
+	if rr := sender.sendTo(callbackURL, PaydCallback{TransactionReference: "OTHER-" + reference, Status: "failed"}); rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("callback with another reference: got %d want %d", rr.Code, http.StatusServiceUnavailable)
+	}
+	if payment, _ := payments.GetPayment(context.Background(), response.PaymentID); payment.Status != StatusSucceeded {
+		t.Errorf("payment moved to %s by a callback with another reference", payment.Status)
+	}
+}
+
+func TestCallerCallbackURLIsReplaced(t *testing.T) {
+	s, _, fake := newTestServer()
+
+	for _, tt := range []struct {
+		path string
+		body string
+	}{
+		{"/payments/initiate", `{"amount":100,"payment_method":"MPESA","callback_url":"https://attacker.example/"}`},
+		{"/payments/send-to-mobile", `{"amount":100,"phone_number":"0700000000","callback_url":"https://attacker.example/"}`},
+	} {
+		req, _ := http.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+		signTestIdentity(req, "testuser", time.Now())
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, req)
+		if rr.Code != http.StatusAccepted {
+			t.Fatalf("%s: got %d: %s", tt.path, rr.Code, rr.Body.String())
+		}
+	}
+
+	for _, callbackURL := range []string{fake.Payments[0].CallbackURL, fake.Withdrawals[0].CallbackURL} {
+		if !strings.HasPrefix(callbackURL, "https://gateway.example/payments/callback?payment_id=") {
+			t.Errorf("Payd was asked to call back %q", callbackURL)
+		}
+	}
+}
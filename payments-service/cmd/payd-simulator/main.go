@@ -0,0 +1,83 @@
+// Command payd-simulator serves a simulated Payd API for running the stack without real
+// Payd credentials. See package paydsim for the supported outcomes.
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/tufstraka/pps/payments-service/payd/paydsim"
+)
+
+func main() {
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, nil)).With("service", "payd-simulator"))
+
+	config, script, err := loadConfig()
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+
+	sim := paydsim.New(config)
+	sim.Script(script...)
+
+	addr := envOr("LISTEN_ADDR", ":9090")
+	slog.Info("Payd simulator started", "addr", addr, "default_outcome", config.DefaultOutcome)
+	if err := http.ListenAndServe(addr, sim); err != nil {
+		slog.Error("Error starting server", "error", err)
+		os.Exit(1)
+	}
+}
+
+// loadConfig reads the simulator settings from the environment.
+func loadConfig() (paydsim.Config, []paydsim.Outcome, error) {
+	config := paydsim.Config{
+		Username:       os.Getenv("PAYD_USERNAME"),
+		Password:       os.Getenv("PAYD_PASSWORD"),
+		WebhookSecret:  os.Getenv("PAYD_WEBHOOK_SECRET"),
+		DefaultOutcome: paydsim.Outcome(envOr("SIMULATOR_DEFAULT_OUTCOME", string(paydsim.Success))),
+	}
+	if !config.DefaultOutcome.Valid() {
+		return config, nil, fmt.Errorf("SIMULATOR_DEFAULT_OUTCOME: unknown outcome %q", config.DefaultOutcome)
+	}
+
+	durations := map[string]*time.Duration{
+		"SIMULATOR_CALLBACK_DELAY":          &config.CallbackDelay,
+		"SIMULATOR_DELAYED_CALLBACK_DELAY":  &config.DelayedCallback,
+		"SIMULATOR_TIMEOUT":                 &config.Timeout,
+		"SIMULATOR_CALLBACK_RETRY_INTERVAL": &config.CallbackRetryInterval,
+	}
+	for env, field := range durations {
+		if value := os.Getenv(env); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return config, nil, fmt.Errorf("%s: %w", env, err)
+			}
+			*field = d
+		}
+	}
+
+	var script []paydsim.Outcome
+	for _, item := range strings.Split(os.Getenv("SIMULATOR_SCRIPT"), ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		outcome := paydsim.Outcome(item)
+		if !outcome.Valid() {
+			return config, nil, fmt.Errorf("SIMULATOR_SCRIPT: unknown outcome %q", item)
+		}
+		script = append(script, outcome)
+	}
+	return config, script, nil
+}
+
+func envOr(env, fallback string) string {
+	if value := os.Getenv(env); value != "" {
+		return value
+	}
+	return fallback
+}
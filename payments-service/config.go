@@ -0,0 +1,184 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config holds the payments service settings. Values are read from defaults, then the optional
+// YAML file named by CONFIG_FILE, then environment variables, in that order.
+type Config struct {
+	ListenAddr         string        `yaml:"listen_addr"`
+	DatabaseURI        string        `yaml:"database_uri"`
+	PaydBaseURL        string        `yaml:"payd_base_url"`
+	PaydUsername       string        `yaml:"payd_username"`
+	PaydPassword       string        `yaml:"payd_password"`
+	PaydTimeout        time.Duration `yaml:"payd_timeout"`
+	PaydWebhookSecret  string        `yaml:"payd_webhook_secret"`
+	PaydCallbackURL    string        `yaml:"payd_callback_url"`
+	IdentitySigningKey string        `yaml:"identity_signing_key"`
+	AdminUsers         []string      `yaml:"admin_users"`
+	RedactFields       []string      `yaml:"redact_fields"`
+	LogLevel           slog.Level    `yaml:"log_level"`
+	ShutdownTimeout    time.Duration `yaml:"shutdown_timeout"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		ListenAddr:      ":8082",
+		PaydBaseURL:     "https://api.mypayd.app",
+		PaydTimeout:     30 * time.Second,
+		RedactFields:    defaultRedactFields,
+		LogLevel:        slog.LevelInfo,
+		ShutdownTimeout: 20 * time.Second,
+	}
+}
+
+// loadConfig builds the effective configuration and validates it.
+func loadConfig() (Config, error) {
+	cfg := defaultConfig()
+
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return cfg, fmt.Errorf("reading config file: %w", err)
+		}
+		if err := yaml.Unmarshal(data, &cfg); err != nil {
+			return cfg, fmt.Errorf("parsing config file %s: %w", path, err)
+		}
+	}
+
+	setString(&cfg.ListenAddr, "LISTEN_ADDR")
+	setString(&cfg.DatabaseURI, "DATABASE_URI")
+	setString(&cfg.PaydBaseURL, "PAYD_BASE_URL")
+	setString(&cfg.PaydUsername, "PAYD_USERNAME")
+	setString(&cfg.PaydPassword, "PAYD_PASSWORD")
+	setString(&cfg.PaydWebhookSecret, "PAYD_WEBHOOK_SECRET")
+	setString(&cfg.PaydCallbackURL, "PAYD_CALLBACK_URL")
+	setString(&cfg.IdentitySigningKey, "IDENTITY_SIGNING_KEY")
+	setList(&cfg.AdminUsers, "ADMIN_USERS")
+	setList(&cfg.RedactFields, "REDACT_FIELDS")
+	if err := setDuration(&cfg.PaydTimeout, "PAYD_TIMEOUT"); err != nil {
+		return cfg, err
+	}
+	if err := setDuration(&cfg.ShutdownTimeout, "SHUTDOWN_TIMEOUT"); err != nil {
+		return cfg, err
+	}
+	if err := setLevel(&cfg.LogLevel, "LOG_LEVEL"); err != nil {
+		return cfg, err
+	}
+	cfg.PaydBaseURL = strings.TrimRight(cfg.PaydBaseURL, "/")
+
+	return cfg, cfg.validate()
+}
+
+func (c Config) validate() error {
+	var errs []error
+	if c.ListenAddr == "" {
+		errs = append(errs, errors.New("listen_addr is required"))
+	}
+	if c.DatabaseURI == "" {
+		errs = append(errs, errors.New("database_uri is required"))
+	}
+	if u, err := url.Parse(c.PaydBaseURL); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("payd_base_url must be an absolute URL, got %q", c.PaydBaseURL))
+	}
+	if c.PaydUsername == "" || c.PaydPassword == "" {
+		errs = append(errs, errors.New("payd_username and payd_password are required"))
+	}
+	if c.PaydWebhookSecret == "" {
+		errs = append(errs, errors.New("payd_webhook_secret is required"))
+	}
+	// Without it Payd never reports an outcome and payments stay PENDING
+	if u, err := url.Parse(c.PaydCallbackURL); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, fmt.Errorf("payd_callback_url must be an absolute URL, got %q", c.PaydCallbackURL))
+	}
+	if c.PaydTimeout <= 0 {
+		errs = append(errs, errors.New("payd_timeout must be positive"))
+	}
+	if c.IdentitySigningKey == "" {
+		errs = append(errs, errors.New("identity_signing_key is required"))
+	}
+	if len(c.RedactFields) == 0 {
+		errs = append(errs, errors.New("redact_fields must not be empty"))
+	}
+	if c.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("shutdown_timeout must be positive"))
+	}
+	return errors.Join(errs...)
+}
+
+// redacted returns a copy that is safe to log.
+func (c Config) redacted() Config {
+	c.DatabaseURI = redactURL(c.DatabaseURI)
+	c.PaydPassword = redactSecret(c.PaydPassword)
+	c.PaydWebhookSecret = redactSecret(c.PaydWebhookSecret)
+	c.IdentitySigningKey = redactSecret(c.IdentitySigningKey)
+	return c
+}
+
+func setString(field *string, env string) {
+	if value, ok := os.LookupEnv(env); ok && value != "" {
+		*field = value
+	}
+}
+
+func setList(field *[]string, env string) {
+	value, ok := os.LookupEnv(env)
+	if !ok || value == "" {
+		return
+	}
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	*field = list
+}
+
+func setDuration(field *time.Duration, env string) error {
+	value, ok := os.LookupEnv(env)
+	if !ok || value == "" {
+		return nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return fmt.Errorf("%s: %w", env, err)
+	}
+	*field = d
+	return nil
+}
+
+func setLevel(field *slog.Level, env string) error {
+	value, ok := os.LookupEnv(env)
+	if !ok || value == "" {
+		return nil
+	}
+	if err := field.UnmarshalText([]byte(value)); err != nil {
+		return fmt.Errorf("%s: %w", env, err)
+	}
+	return nil
+}
+
+func redactSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "[REDACTED]"
+}
+
+func redactURL(value string) string {
+	u, err := url.Parse(value)
+	if err != nil {
+		return redactSecret(value)
+	}
+	return u.Redacted()
+}
@@ -22,9 +22,201 @@ const docTemplate = `{
     "host": "{{.Host}}",
     "basePath": "{{.BasePath}}",
     "paths": {
+        "/admin/payments/provider/{reference}": {
+            "get": {
+                "description": "Returns the payment Payd knows by the given transaction reference, with its status history and Payd calls. Admin only.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "admin"
+                ],
+                "summary": "Look up a payment by Payd reference",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Payd transaction reference",
+                        "name": "reference",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.PaymentDetails"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "Payment Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/admin/payments/{id}": {
+            "get": {
+                "description": "Returns a payment with its status history and every call made to Payd for it. Admin only.",
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "admin"
+                ],
+                "summary": "Look up a payment by ID",
+                "parameters": [
+                    {
+                        "type": "integer",
+                        "description": "Payment ID",
+                        "name": "id",
+                        "in": "path",
+                        "required": true
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "$ref": "#/definitions/main.PaymentDetails"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "Payment Not Found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
+        "/payments/callback": {
+            "post": {
+                "description": "Called by Payd when a payment settles. Moves the payment matching the transaction reference to its new status. A payment whose reference we never received from Payd is matched by the payment_id in the callback URL.",
+                "consumes": [
+                    "application/json"
+                ],
+                "produces": [
+                    "application/json"
+                ],
+                "tags": [
+                    "payments"
+                ],
+                "summary": "Receive a Payd payment notification",
+                "parameters": [
+                    {
+                        "type": "string",
+                        "description": "Hex HMAC-SHA256 of the body keyed with the webhook secret",
+                        "name": "X-Payd-Signature",
+                        "in": "header",
+                        "required": true
+                    },
+                    {
+                        "type": "integer",
+                        "description": "Payment the callback URL was issued for",
+                        "name": "payment_id",
+                        "in": "query"
+                    },
+                    {
+                        "description": "Payd callback",
+                        "name": "callback",
+                        "in": "body",
+                        "required": true,
+                        "schema": {
+                            "$ref": "#/definitions/main.PaydCallback"
+                        }
+                    }
+                ],
+                "responses": {
+                    "200": {
+                        "description": "OK",
+                        "schema": {
+                            "type": "object",
+                            "additionalProperties": {
+                                "type": "string"
+                            }
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "500": {
+                        "description": "Internal Server Error",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "503": {
+                        "description": "Payment not recorded yet; Payd should resend the callback",
+                        "schema": {
+                            "type": "string"
+                        }
+                    }
+                }
+            }
+        },
         "/payments/initiate": {
             "post": {
-                "description": "Initiate a payment to a user",
+                "description": "Initiate a payment to a user. If Payd does not answer in time, or its answer cannot be recorded, the payment is left PENDING with status \"Pending\" until Payd's callback settles it. Payd is always asked to call back the payments service; a callback_url in the request is replaced.",
                 "consumes": [
                     "application/json"
                 ],
@@ -44,6 +236,12 @@ const docTemplate = `{
                         "schema": {
                             "$ref": "#/definitions/main.PaymentRequest"
                         }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key that makes retries of this request safe",
+                        "name": "Idempotency-Key",
+                        "in": "header"
                     }
                 ],
                 "responses": {
@@ -59,6 +257,30 @@ const docTemplate = `{
                             "type": "string"
                         }
                     },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "403": {
+                        "description": "Forbidden",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "422": {
+                        "description": "Idempotency-Key reused with a different request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
                     "500": {
                         "description": "Internal Server Error",
                         "schema": {
@@ -70,7 +292,7 @@ const docTemplate = `{
         },
         "/payments/send-to-mobile": {
             "post": {
-                "description": "Send money to a mobile number via the Payd API",
+                "description": "Send money to a mobile number via the Payd API. The payout is recorded as a payment whose status can be queried like any other. If Payd does not answer in time, or its answer cannot be recorded, the payout is left PENDING with status \"Pending\" until Payd's callback settles it. Payd is always asked to call back the payments service; a callback_url in the request is replaced.",
                 "consumes": [
                     "application/json"
                 ],
@@ -90,13 +312,19 @@ const docTemplate = `{
                         "schema": {
                             "$ref": "#/definitions/main.MobilePaymentRequest"
                         }
+                    },
+                    {
+                        "type": "string",
+                        "description": "Key that makes retries of this request safe",
+                        "name": "Idempotency-Key",
+                        "in": "header"
                     }
                 ],
                 "responses": {
                     "202": {
                         "description": "Accepted",
                         "schema": {
-                            "type": "string"
+                            "$ref": "#/definitions/main.PaymentResponse"
                         }
                     },
                     "400": {
@@ -105,6 +333,30 @@ const docTemplate = `{
                             "type": "string"
                         }
                     },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "404": {
+                        "description": "User not found",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "409": {
+                        "description": "Conflict",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "422": {
+                        "description": "Idempotency-Key reused with a different request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
                     "500": {
                         "description": "Internal Server Error",
                         "schema": {
@@ -116,7 +368,7 @@ const docTemplate = `{
         },
         "/payments/status/{id}": {
             "get": {
-                "description": "Get the status of a payment by ID",
+                "description": "Get the current status of a payment by ID together with its status history. Payments of other users are reported as not found.",
                 "produces": [
                     "application/json"
                 ],
@@ -137,10 +389,19 @@ const docTemplate = `{
                     "200": {
                         "description": "OK",
                         "schema": {
-                            "type": "object",
-                            "additionalProperties": {
-                                "type": "string"
-                            }
+                            "$ref": "#/definitions/main.PaymentStatusResponse"
+                        }
+                    },
+                    "400": {
+                        "description": "Bad Request",
+                        "schema": {
+                            "type": "string"
+                        }
+                    },
+                    "401": {
+                        "description": "Unauthorized",
+                        "schema": {
+                            "type": "string"
                         }
                     },
                     "404": {
@@ -186,12 +447,120 @@ const docTemplate = `{
                 }
             }
         },
+        "main.PaydAttemptRecord": {
+            "type": "object",
+            "properties": {
+                "created_at": {
+                    "type": "string"
+                },
+                "error": {
+                    "type": "string"
+                },
+                "http_status": {
+                    "type": "integer"
+                },
+                "id": {
+                    "type": "integer"
+                },
+                "operation": {
+                    "type": "string"
+                },
+                "provider_reference": {
+                    "type": "string"
+                },
+                "response": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.PaydCallback": {
+            "type": "object",
+            "properties": {
+                "amount": {
+                    "type": "number"
+                },
+                "remarks": {
+                    "type": "string"
+                },
+                "result_code": {
+                    "type": "integer"
+                },
+                "status": {
+                    "type": "string"
+                },
+                "success": {
+                    "type": "boolean"
+                },
+                "transaction_reference": {
+                    "type": "string"
+                }
+            }
+        },
+        "main.PaymentDetails": {
+            "type": "object",
+            "properties": {
+                "amount": {
+                    "type": "number"
+                },
+                "attempts": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.PaydAttemptRecord"
+                    }
+                },
+                "channel": {
+                    "type": "string"
+                },
+                "created_at": {
+                    "type": "string"
+                },
+                "currency": {
+                    "type": "string"
+                },
+                "direction": {
+                    "type": "string"
+                },
+                "history": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.StatusTransition"
+                    }
+                },
+                "method": {
+                    "type": "string"
+                },
+                "narration": {
+                    "type": "string"
+                },
+                "payment_id": {
+                    "type": "integer"
+                },
+                "phone": {
+                    "type": "string"
+                },
+                "provider_reference": {
+                    "type": "string"
+                },
+                "status": {
+                    "$ref": "#/definitions/main.PaymentStatus"
+                },
+                "updated_at": {
+                    "type": "string"
+                },
+                "username": {
+                    "type": "string"
+                }
+            }
+        },
         "main.PaymentRequest": {
             "type": "object",
             "properties": {
                 "amount": {
                     "type": "number"
                 },
+                "callback_url": {
+                    "type": "string"
+                },
                 "email": {
                     "type": "string"
                 },
@@ -228,6 +597,64 @@ const docTemplate = `{
                     "type": "string"
                 }
             }
+        },
+        "main.PaymentStatus": {
+            "type": "string",
+            "enum": [
+                "CREATED",
+                "PENDING",
+                "PROCESSING",
+                "SUCCEEDED",
+                "FAILED",
+                "CANCELLED",
+                "REFUNDED"
+            ],
+            "x-enum-varnames": [
+                "StatusCreated",
+                "StatusPending",
+                "StatusProcessing",
+                "StatusSucceeded",
+                "StatusFailed",
+                "StatusCancelled",
+                "StatusRefunded"
+            ]
+        },
+        "main.PaymentStatusResponse": {
+            "type": "object",
+            "properties": {
+                "direction": {
+                    "type": "string"
+                },
+                "history": {
+                    "type": "array",
+                    "items": {
+                        "$ref": "#/definitions/main.StatusTransition"
+                    }
+                },
+                "payment_id": {
+                    "type": "integer"
+                },
+                "status": {
+                    "$ref": "#/definitions/main.PaymentStatus"
+                }
+            }
+        },
+        "main.StatusTransition": {
+            "type": "object",
+            "properties": {
+                "at": {
+                    "type": "string"
+                },
+                "from": {
+                    "$ref": "#/definitions/main.PaymentStatus"
+                },
+                "reason": {
+                    "type": "string"
+                },
+                "to": {
+                    "$ref": "#/definitions/main.PaymentStatus"
+                }
+            }
         }
     }
 }`
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+)
+
+// How long a claimed key may stay without a stored response before it is considered abandoned.
+var idempotencyClaimTimeout = 5 * time.Minute
+
+// idempotent makes a handler safe to retry with the same Idempotency-Key header.
+//
+// The first request with a key claims it and runs the handler. A successful (2xx)
+// response is stored and replayed verbatim for later requests with the same key and
+// body; any other response releases the key so that the caller can try again. Reusing
+// a key with a different body is a 422, which no retry can fix; reusing it while the
+// first request is still running is a 409.
+// Keys are scoped to the user forwarded by the gateway.
+func (s *Server) idempotent(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			next(w, r)
+			return
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			http.Error(w, "Bad Request: Idempotency-Key is too long", http.StatusBadRequest)
+			return
+		}
+
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		username, _ := s.authenticatedUser(r)
+		hash := requestHash(r, body)
+		ctx := r.Context()
+
+		// An unfinished claim older than idempotencyClaimTimeout belongs to a request that
+		// died mid-flight, so a retry with the same body may take it over.
+		claimed, err := s.keys.Claim(ctx, username, key, hash, idempotencyClaimTimeout)
+		if err != nil {
+			slog.ErrorContext(ctx, "Error claiming idempotency key", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		if !claimed {
+			s.replayIdempotentResponse(w, r, username, key, hash)
+			return
+		}
+
+		rec := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+		next(rec, r)
+
+		if rec.status >= 200 && rec.status < 300 {
+			err = s.keys.Complete(ctx, username, key, storedResponse{
+				Status:      rec.status,
+				ContentType: rec.Header().Get("Content-Type"),
+				Body:        rec.body.Bytes(),
+			})
+		} else {
+			err = s.keys.Release(ctx, username, key)
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "Error saving idempotent response", "key", key, "error", err)
+		}
+	}
+}
+
+func (s *Server) replayIdempotentResponse(w http.ResponseWriter, r *http.Request, username, key, hash string) {
+	stored, err := s.keys.Get(r.Context(), username, key)
+	if err != nil {
+		if err == errIdempotencyKeyNotFound {
+			// The first request failed and released the key between our claim and this lookup
+			http.Error(w, "Conflict: request with this Idempotency-Key is still in progress", http.StatusConflict)
+			return
+		}
+		slog.ErrorContext(r.Context(), "Error loading idempotency key", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if stored.RequestHash != hash {
+		slog.WarnContext(r.Context(), "Idempotency-Key reused with a different request", "key", key)
+		http.Error(w, "Unprocessable Entity: Idempotency-Key was already used with a different request", http.StatusUnprocessableEntity)
+		return
+	}
+	if stored.Status == 0 {
+		http.Error(w, "Conflict: request with this Idempotency-Key is still in progress", http.StatusConflict)
+		return
+	}
+
+	slog.InfoContext(r.Context(), "Replaying idempotent response", "key", key, "status", stored.Status)
+	if stored.ContentType != "" {
+		w.Header().Set("Content-Type", stored.ContentType)
+	}
+	w.Header().Set(idempotentReplayedHeader, "true")
+	w.WriteHeader(stored.Status)
+	w.Write(stored.Body)
+}
+
+// requestHash identifies the request a key was first used with.
+func requestHash(r *http.Request, body []byte) string {
+	h := sha256.New()
+	h.Write([]byte(r.Method + " " + r.URL.Path + "\n"))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
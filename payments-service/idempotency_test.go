@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tufstraka/pps/payments-service/payd"
+)
+
+func TestIdempotentReplay(t *testing.T) {
+	s, _, _ := newTestServer()
+	key := "test-key"
+
+	calls := 0
+	status := http.StatusBadGateway
+	handler := s.idempotent(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		w.Write([]byte(`{"status":"Accepted","payment_id":1}`))
+	})
+
+	send := func(body string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/payments/initiate", strings.NewReader(body))
+		req.Header.Set(idempotencyKeyHeader, key)
+		signTestIdentity(req, "testuser", time.Now())
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		return rr
+	}
+
+	// A failed attempt releases the key so the retry runs the handler again
+	send(`{"amount":100}`)
+	status = http.StatusAccepted
+	first := send(`{"amount":100}`)
+	if calls != 2 || first.Code != http.StatusAccepted {
+		t.Fatalf("expected retry after failure to run the handler, calls=%d code=%d", calls, first.Code)
+	}
+
+	replay := send(`{"amount":100}`)
+	if calls != 2 {
+		t.Errorf("replay ran the handler again, calls=%d", calls)
+	}
+	if replay.Code != http.StatusAccepted || replay.Body.String() != first.Body.String() {
+		t.Errorf("replay returned %d %q, want %d %q", replay.Code, replay.Body.String(), first.Code, first.Body.String())
+	}
+	if replay.Header().Get(idempotentReplayedHeader) != "true" {
+		t.Error("replay is missing the Idempotent-Replayed header")
+	}
+
+	if mismatch := send(`{"amount":200}`); mismatch.Code != http.StatusUnprocessableEntity {
+		t.Errorf("expected 422 for a different body, got %d", mismatch.Code)
+	}
+}
+
+func TestIdempotentPaydTimeoutIsNotRetried(t *testing.T) {
+	s, payments, fake := newTestServer()
+	fake.Err = &payd.RequestError{Operation: payd.OperationCreatePayment, Err: context.DeadlineExceeded}
+
+	send := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/payments/initiate", strings.NewReader(`{"amount":100,"payment_method":"MPESA"}`))
+		req.Header.Set(idempotencyKeyHeader, "timeout-key")
+		signTestIdentity(req, "testuser", time.Now())
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, req)
+		return rr
+	}
+
+	first := send()
+	if first.Code != http.StatusAccepted {
+		t.Fatalf("timed out payment: got %d want %d", first.Code, http.StatusAccepted)
+	}
+	var response PaymentResponse
+	json.NewDecoder(first.Body).Decode(&response)
+	payment, _ := payments.GetPayment(context.Background(), response.PaymentID)
+	if response.Status != "Pending" || payment.Status != StatusPending {
+		t.Errorf("timed out payment is %q with status %q, want Pending and %s", response.Status, payment.Status, StatusPending)
+	}
+
+	// Payd may have charged the user, so a retry must not reach it again
+	if retry := send(); retry.Code != http.StatusAccepted || retry.Header().Get(idempotentReplayedHeader) != "true" {
+		t.Errorf("retry after timeout: got %d, replayed %q", retry.Code, retry.Header().Get(idempotentReplayedHeader))
+	}
+	if len(fake.Payments) != 1 {
+		t.Errorf("Payd was called %d times, want 1", len(fake.Payments))
+	}
+}
+
+// unrecordedAttempts is a PaymentRepository that cannot record Payd attempts.
+type unrecordedAttempts struct {
+	PaymentRepository
+}
+
+func (unrecordedAttempts) RecordAttempt(ctx context.Context, paymentID int, a paydAttempt, next PaymentStatus, reason string) error {
+	return errors.New("database is down")
+}
+
+func TestIdempotentUnrecordedPaydSuccessIsNotRetried(t *testing.T) {
+	base, payments, fake := newTestServer()
+	s := NewServer(base.config, base.users, unrecordedAttempts{payments}, NewMemoryIdempotencyStore(), fake, time.Now)
+
+	tests := []struct {
+		path  string
+		body  string
+		calls func() int
+	}{
+		{"/payments/initiate", `{"amount":100,"payment_method":"MPESA"}`, func() int { return len(fake.Payments) }},
+		{"/payments/send-to-mobile", `{"amount":100,"phone_number":"0700000000"}`, func() int { return len(fake.Withdrawals) }},
+	}
+	for _, tt := range tests {
+		send := func() *httptest.ResponseRecorder {
+			req, _ := http.NewRequest("POST", tt.path, strings.NewReader(tt.body))
+			req.Header.Set(idempotencyKeyHeader, "unrecorded-key"+tt.path)
+			signTestIdentity(req, "testuser", time.Now())
+			rr := httptest.NewRecorder()
+			s.Handler().ServeHTTP(rr, req)
+			return rr
+		}
+
+		first := send()
+		var response PaymentResponse
+		json.NewDecoder(first.Body).Decode(&response)
+		if first.Code != http.StatusAccepted || response.Status != "Pending" {
+			t.Errorf("%s: got %d %q, want %d Pending", tt.path, first.Code, response.Status, http.StatusAccepted)
+		}
+
+		// Payd has the money, so a retry must not reach it again
+		if retry := send(); retry.Code != http.StatusAccepted || retry.Header().Get(idempotentReplayedHeader) != "true" {
+			t.Errorf("%s: retry got %d, replayed %q", tt.path, retry.Code, retry.Header().Get(idempotentReplayedHeader))
+		}
+		if calls := tt.calls(); calls != 1 {
+			t.Errorf("%s: Payd was called %d times, want 1", tt.path, calls)
+		}
+	}
+}
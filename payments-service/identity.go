@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Headers set by the gateway once it has verified the caller's token. The signature
+// is an HMAC-SHA256 of "<username>\n<timestamp>\n<method>\n<path>\n<body digest>"
+// keyed with the identity signing key, where the path includes the query and the body
+// digest is the hex SHA-256 of the body.
+const (
+	identityUserHeader      = "X-Authenticated-User"
+	identityTimestampHeader = "X-Identity-Timestamp"
+	identitySignatureHeader = "X-Identity-Signature"
+)
+
+// How far an identity timestamp may drift from our clock before it is rejected.
+var identityMaxSkew = 5 * time.Minute
+
+var (
+	errMissingIdentity = errors.New("missing identity headers")
+	errInvalidIdentity = errors.New("invalid identity signature")
+	errExpiredIdentity = errors.New("identity timestamp outside allowed window")
+)
+
+// authenticatedUser returns the username forwarded by the gateway after checking its
+// signature. The signature covers the request, so headers taken from one request do not
+// authenticate another. The body is read and put back for the handler.
+func (s *Server) authenticatedUser(r *http.Request) (string, error) {
+	username := r.Header.Get(identityUserHeader)
+	timestamp := r.Header.Get(identityTimestampHeader)
+	signature := r.Header.Get(identitySignatureHeader)
+	if username == "" || timestamp == "" || signature == "" {
+		return "", errMissingIdentity
+	}
+
+	key := s.config.IdentitySigningKey
+	if key == "" {
+		return "", errInvalidIdentity
+	}
+
+	given, err := hex.DecodeString(signature)
+	if err != nil {
+		return "", errInvalidIdentity
+	}
+	var body []byte
+	if r.Body != nil {
+		if body, err = io.ReadAll(r.Body); err != nil {
+			return "", err
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	mac := hmac.New(sha256.New, []byte(key))
+	mac.Write(identityPayload(username, timestamp, r.Method, r.URL.RequestURI(), body))
+	if !hmac.Equal(given, mac.Sum(nil)) {
+		return "", errInvalidIdentity
+	}
+
+	unix, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", errInvalidIdentity
+	}
+	if skew := s.now().Sub(time.Unix(unix, 0)); skew > identityMaxSkew || skew < -identityMaxSkew {
+		return "", errExpiredIdentity
+	}
+
+	return username, nil
+}
+
+// identityPayload returns the string the identity signature is made over.
+func identityPayload(username, timestamp, method, uri string, body []byte) []byte {
+	digest := sha256.Sum256(body)
+	return []byte(username + "\n" + timestamp + "\n" + method + "\n" + uri + "\n" + hex.EncodeToString(digest[:]))
+}
+
+// isAdmin reports whether username is listed in the admin_users setting.
+func (s *Server) isAdmin(username string) bool {
+	for _, admin := range s.config.AdminUsers {
+		if admin == username {
+			return true
+		}
+	}
+	return false
+}
+
+// adminOnly restricts a handler to the users listed in the admin_users setting.
+func (s *Server) adminOnly(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		username, err := s.authenticatedUser(r)
+		if err != nil {
+			slog.WarnContext(r.Context(), "Rejected admin request", "error", err)
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if !s.isAdmin(username) {
+			slog.WarnContext(r.Context(), "Rejected admin request from non-admin user", "username", username)
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	}
+}
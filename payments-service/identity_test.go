@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// signTestIdentity sets the identity headers the gateway would send for username.
+func signTestIdentity(req *http.Request, username string, at time.Time) {
+	var body []byte
+	if req.Body != nil {
+		body, _ = io.ReadAll(req.Body)
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+	digest := sha256.Sum256(body)
+
+	timestamp := strconv.FormatInt(at.Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(testIdentityKey))
+	mac.Write([]byte(username + "\n" + timestamp + "\n" + req.Method + "\n" + req.URL.RequestURI() + "\n" + hex.EncodeToString(digest[:])))
+
+	req.Header.Set(identityUserHeader, username)
+	req.Header.Set(identityTimestampHeader, timestamp)
+	req.Header.Set(identitySignatureHeader, hex.EncodeToString(mac.Sum(nil)))
+}
+
+func TestAuthenticatedUser(t *testing.T) {
+	s, _, _ := newTestServer()
+
+	valid, _ := http.NewRequest("POST", "/payments/initiate", nil)
+	signTestIdentity(valid, "testuser", time.Now())
+	if username, err := s.authenticatedUser(valid); err != nil || username != "testuser" {
+		t.Errorf("expected testuser, got %q (err %v)", username, err)
+	}
+
+	tampered, _ := http.NewRequest("POST", "/payments/initiate", nil)
+	signTestIdentity(tampered, "testuser", time.Now())
+	tampered.Header.Set(identityUserHeader, "someoneelse")
+	if _, err := s.authenticatedUser(tampered); err != errInvalidIdentity {
+		t.Errorf("expected errInvalidIdentity for tampered username, got %v", err)
+	}
+
+	// The signature covers the method, path and body of the request it was made for
+	signed, _ := http.NewRequest("POST", "/payments/initiate", strings.NewReader(`{"amount":100}`))
+	signTestIdentity(signed, "testuser", time.Now())
+	if username, err := s.authenticatedUser(signed); err != nil || username != "testuser" {
+		t.Errorf("expected testuser for a request with a body, got %q (err %v)", username, err)
+	}
+	if body, _ := io.ReadAll(signed.Body); string(body) != `{"amount":100}` {
+		t.Errorf("body was not left for the handler, got %q", body)
+	}
+	for _, other := range []struct{ method, path, body string }{
+		{"PUT", "/payments/initiate", `{"amount":100}`},
+		{"POST", "/payments/send-to-mobile", `{"amount":100}`},
+		{"POST", "/payments/initiate", `{"amount":100000}`},
+	} {
+		replayed, _ := http.NewRequest(other.method, other.path, strings.NewReader(other.body))
+		replayed.Header = signed.Header
+		if _, err := s.authenticatedUser(replayed); err != errInvalidIdentity {
+			t.Errorf("expected errInvalidIdentity for headers replayed on %+v, got %v", other, err)
+		}
+	}
+
+	stale, _ := http.NewRequest("POST", "/payments/initiate", nil)
+	signTestIdentity(stale, "testuser", time.Now().Add(-time.Hour))
+	if _, err := s.authenticatedUser(stale); err != errExpiredIdentity {
+		t.Errorf("expected errExpiredIdentity for old timestamp, got %v", err)
+	}
+
+	// The window is measured against the server's clock
+	s.now = func() time.Time { return time.Now().Add(-time.Hour) }
+	if _, err := s.authenticatedUser(stale); err != nil {
+		t.Errorf("expected timestamp to be accepted by a server an hour behind, got %v", err)
+	}
+
+	missing, _ := http.NewRequest("POST", "/payments/initiate", nil)
+	if _, err := s.authenticatedUser(missing); err != errMissingIdentity {
+		t.Errorf("expected errMissingIdentity, got %v", err)
+	}
+}
+
+func TestPaymentHandlersRequireIdentity(t *testing.T) {
+	s, _, _ := newTestServer()
+	handlers := map[string]http.HandlerFunc{
+		"/payments/initiate":       s.InitiatePayment,
+		"/payments/send-to-mobile": s.SendToMobile,
+	}
+	for path, handler := range handlers {
+		req, _ := http.NewRequest("POST", path, strings.NewReader(`{"amount":100}`))
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("%s without identity: got %d want %d", path, rr.Code, http.StatusUnauthorized)
+		}
+	}
+}
+
+func TestPaymentStatusIsOnlyShownToOwner(t *testing.T) {
+	s, payments, _ := newTestServer()
+	owner, _ := s.users.UserID(context.Background(), "testuser")
+	s.users.(*MemoryUserRepository).AddUser("otheruser")
+	id, err := payments.CreatePayment(context.Background(), paymentRecord{
+		UserID: owner, Direction: directionPayIn, Amount: 100, Method: "MPESA",
+	}, StatusPending, "Seeded for tests")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := func(username string) int {
+		req, _ := http.NewRequest("GET", "/payments/status/"+strconv.Itoa(id), nil)
+		if username != "" {
+			signTestIdentity(req, username, time.Now())
+		}
+		rr := httptest.NewRecorder()
+		s.Handler().ServeHTTP(rr, req)
+		return rr.Code
+	}
+	if code := status("testuser"); code != http.StatusOK {
+		t.Errorf("owner: got %d want %d", code, http.StatusOK)
+	}
+	if code := status("otheruser"); code != http.StatusNotFound {
+		t.Errorf("other user: got %d want %d", code, http.StatusNotFound)
+	}
+	if code := status(""); code != http.StatusUnauthorized {
+		t.Errorf("without identity: got %d want %d", code, http.StatusUnauthorized)
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// captureLogs sends JSON logs at debug level to a buffer for the rest of the test.
+func captureLogs(t *testing.T) *bytes.Buffer {
+	var buf bytes.Buffer
+	previous := slog.Default()
+	handler := slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})
+	slog.SetDefault(slog.New(contextHandler{handler}))
+	t.Cleanup(func() { slog.SetDefault(previous) })
+	return &buf
+}
+
+func TestRequestIDFromGatewayIsLogged(t *testing.T) {
+	logs := captureLogs(t)
+
+	handler := requestIDMiddleware(loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+
+	req, _ := http.NewRequest("GET", "/payments/status/1", nil)
+	req.Header.Set(requestIDHeader, "req-from-gateway")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+
+	if rr.Header().Get(requestIDHeader) != "req-from-gateway" {
+		t.Errorf("expected request ID to be echoed, got %q", rr.Header().Get(requestIDHeader))
+	}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		if !strings.Contains(line, `"request_id":"req-from-gateway"`) {
+			t.Errorf("log line is missing request_id: %s", line)
+		}
+	}
+}
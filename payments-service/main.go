@@ -1,25 +1,25 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"database/sql"
-	"encoding/base64"
 	"encoding/json"
-	"io"
-	"log"
+	"errors"
+	"log/slog"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
-	httpSwagger "github.com/swaggo/http-swagger"
 	_ "github.com/tufstraka/pps/payments-service/docs"
+	"github.com/tufstraka/pps/payments-service/payd"
 )
 
-var db *sql.DB
-
 // @title Payment APIs
 // @version 0.1
 // @description This is a payment service with Payd API integration.
@@ -36,24 +36,52 @@ var db *sql.DB
 func main() {
 	godotenv.Load()
 
-	var err error
-	postgresURI := os.Getenv("DATABASE_URI")
+	config, err := loadConfig()
+	if err != nil {
+		slog.Error("Invalid configuration", "error", err)
+		os.Exit(1)
+	}
+	setupLogger(config.LogLevel)
+	redactFields = config.RedactFields
+	slog.Info("Effective config", "config", config.redacted())
 
-	db, err = sql.Open("postgres", postgresURI)
+	db, err := sql.Open("postgres", config.DatabaseURI)
 	if err != nil {
-		log.Fatal(err)
+		slog.Error("Error opening database", "error", err)
+		os.Exit(1)
 	}
 
-	r := mux.NewRouter()
-	r.HandleFunc("/payments/initiate", InitiatePayment).Methods("POST")
-	r.HandleFunc("/payments/status/{id}", GetPaymentStatus).Methods("GET")
-	r.HandleFunc("/payments/send-to-mobile", SendToMobile).Methods("POST")
-	r.HandleFunc("/payments/get-card-details", GetCardDetails).Methods("POST")
+	s := NewServer(
+		config,
+		NewPostgresUserRepository(db),
+		NewPostgresPaymentRepository(db),
+		NewPostgresIdempotencyStore(db),
+		payd.New(config.PaydBaseURL, config.PaydUsername, config.PaydPassword, config.PaydTimeout),
+		time.Now,
+	)
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	server := &http.Server{Addr: config.ListenAddr, Handler: s.Handler()}
+	go func() {
+		slog.Info("Payments service started", "addr", config.ListenAddr)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			slog.Error("Error starting server", "error", err)
+			os.Exit(1)
+		}
+	}()
 
-	r.PathPrefix("/swagger/").Handler(httpSwagger.WrapHandler)
+	<-ctx.Done()
+	slog.Info("Shutting down", "timeout", config.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), config.ShutdownTimeout)
+	defer cancel()
 
-	log.Println("Payments service started on :8082")
-	http.ListenAndServe(":8082", r)
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		slog.Error("Failed to finish in-flight requests", "error", err)
+	}
+	db.Close()
+	slog.Info("Payments service stopped")
 }
 
 type PaymentResponse struct {
@@ -71,6 +99,7 @@ type PaymentRequest struct {
 	FirstName     string  `json:"first_name"`
 	LastName      string  `json:"last_name"`
 	Reason        string  `json:"reason"`
+	CallbackURL   string  `json:"callback_url,omitempty"`
 }
 
 type MobilePaymentRequest struct {
@@ -85,82 +114,104 @@ type MobilePaymentRequest struct {
 
 // InitiatePayment godoc
 // @Summary Initiate a payment
-// @Description Initiate a payment to a user
+// @Description Initiate a payment to a user. If Payd does not answer in time, or its answer cannot be recorded, the payment is left PENDING with status "Pending" until Payd's callback settles it. Payd is always asked to call back the payments service; a callback_url in the request is replaced.
 // @Tags payments
 // @Accept json
 // @Produce json
 // @Param payment body PaymentRequest true "Payment Request"
 // @Success 202 {object} PaymentResponse "Accepted"
 // @Failure 400 {string} string "Bad Request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 403 {string} string "Forbidden"
 // @Failure 500 {string} string "Internal Server Error"
+// @Param Idempotency-Key header string false "Key that makes retries of this request safe"
+// @Failure 409 {string} string "Conflict"
+// @Failure 422 {string} string "Idempotency-Key reused with a different request"
 // @Router /payments/initiate [post]
-func InitiatePayment(w http.ResponseWriter, r *http.Request) {
-	var payment PaymentRequest
-	err := json.NewDecoder(r.Body).Decode(&payment)
+func (s *Server) InitiatePayment(w http.ResponseWriter, r *http.Request) {
+	username, err := s.authenticatedUser(r)
 	if err != nil {
-		http.Error(w, "Bad Request: invalid JSON structure", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Rejected payment request", "error", err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	// Verify user existence and get user ID
-	var userID int
-	err = db.QueryRow("SELECT id FROM users WHERE username=$1", payment.Username).Scan(&userID)
+	var payment PaymentRequest
+	err = json.NewDecoder(r.Body).Decode(&payment)
 	if err != nil {
-		log.Println(err)
-		http.Error(w, "User not found", http.StatusNotFound)
+		http.Error(w, "Bad Request: invalid JSON structure", http.StatusBadRequest)
 		return
 	}
 
-	// Prepare JSON body for Payd API request
-	jsonBody, err := json.Marshal(payment)
-	if err != nil {
-		http.Error(w, "Internal Server Error: failed to marshal JSON", http.StatusInternalServerError)
+	// The payment is always attributed to the caller, never to a username taken from the body
+	if payment.Username != "" && payment.Username != username {
+		slog.WarnContext(r.Context(), "Rejected payment request: body username does not match caller",
+			"body_username", payment.Username, "username", username)
+		http.Error(w, "Forbidden: username does not match authenticated user", http.StatusForbidden)
 		return
 	}
+	payment.Username = username
 
-	// Make request to Payd API
-	paydAPIURL := "https://api.mypayd.app/api/v1/payments"
-	req, err := http.NewRequest("POST", paydAPIURL, bytes.NewBuffer(jsonBody))
-	if err != nil {
-		http.Error(w, "Failed to create request", http.StatusInternalServerError)
+	// Verify user existence and get user ID
+	userID, err := s.users.UserID(r.Context(), username)
+	if err == errUserNotFound {
+		slog.WarnContext(r.Context(), "User not found", "username", username)
+		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.SetBasicAuth(os.Getenv("PAYD_USERNAME"), os.Getenv("PAYD_PASSWORD"))
-
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("Failed to send request: %v", err)
-		http.Error(w, "Failed to initiate payment", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error looking up user", "username", username, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	defer resp.Body.Close()
 
-	respBody, err := io.ReadAll(resp.Body)
+	// Record the payment before calling Payd so that every attempt can be traced to it
+	paymentID, err := s.payments.CreatePayment(r.Context(), paymentRecord{
+		UserID:    userID,
+		Direction: directionPayIn,
+		Amount:    payment.Amount,
+		Method:    payment.PaymentMethod,
+		Phone:     payment.Phone,
+	}, StatusCreated, "Payment requested")
 	if err != nil {
-		log.Printf("Error reading response body: %v", err)
-		http.Error(w, "Failed to read response body", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error inserting payment into db", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Response Status Code: %d", resp.StatusCode)
-	log.Printf("Response Body: %s", respBody)
+	// Payd must report the outcome to us so that the payment status gets updated
+	if payment.CallbackURL != "" {
+		slog.InfoContext(r.Context(), "Replacing callback URL from payment request", "payment_id", paymentID)
+	}
+	payment.CallbackURL = s.callbackURL(paymentID)
 
-	// Check Payd API response status
-	if resp.StatusCode != http.StatusCreated {
-		log.Printf("Failed to initiate payment. Status code: %d", resp.StatusCode)
-		http.Error(w, string(respBody), http.StatusBadRequest)
+	txn, err := s.payd.CreatePayment(r.Context(), payd.PaymentRequest(payment))
+	attempt := newPaydAttempt(operationInitiate, txn, err)
+	slog.DebugContext(r.Context(), "Payd response", "status", attempt.HTTPStatus, "body", redactBody(attempt.Response))
+
+	var apiErr *payd.APIError
+	if errors.As(err, &apiErr) {
+		slog.WarnContext(r.Context(), "Failed to initiate payment", "status", apiErr.StatusCode)
+		s.failPaydAttempt(r.Context(), paymentID, attempt, "Rejected by Payd")
+		http.Error(w, string(apiErr.Body), http.StatusBadRequest)
+		return
+	}
+	// Failing the payment here would let a retry charge the user twice
+	if paydOutcomeUnknown(err) {
+		slog.WarnContext(r.Context(), "No answer from Payd, leaving payment pending", "payment_id", paymentID, "error", err)
+		s.pendPaydAttempt(r.Context(), paymentID, attempt)
+		writePending(w, paymentID)
 		return
 	}
 
-	// Insert payment details into database and get generated ID
-	var paymentID int
-	err = db.QueryRow("INSERT INTO payments (amount, currency, method, status, user_id) VALUES ($1, $2, $3, $4, $5) RETURNING id",
-		payment.Amount, "KES", payment.PaymentMethod, "PENDING", userID).Scan(&paymentID)
-	if err != nil {
-		log.Printf("Error inserting payment into db: %v", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+	// Payd's reference is kept so that its callback can be matched to this payment
+	if txn.TransactionReference == "" {
+		slog.WarnContext(r.Context(), "Payd response has no transaction reference", "payment_id", paymentID)
+	}
+	if err := s.payments.RecordAttempt(r.Context(), paymentID, attempt, StatusPending, "Accepted by Payd"); err != nil {
+		// Payd has the payment, so failing here would let a retry make it again
+		slog.ErrorContext(r.Context(), "Error recording Payd attempt, answering pending", "payment_id", paymentID, "error", err)
+		writePending(w, paymentID)
 		return
 	}
 
@@ -176,143 +227,203 @@ func InitiatePayment(w http.ResponseWriter, r *http.Request) {
 
 // SendToMobile godoc
 // @Summary Send money to a mobile number
-// @Description Send money to a mobile number via the Payd API
+// @Description Send money to a mobile number via the Payd API. The payout is recorded as a payment whose status can be queried like any other. If Payd does not answer in time, or its answer cannot be recorded, the payout is left PENDING with status "Pending" until Payd's callback settles it. Payd is always asked to call back the payments service; a callback_url in the request is replaced.
 // @Tags payments
 // @Accept json
 // @Produce json
 // @Param mobilePayment body MobilePaymentRequest true "Mobile Payment Request"
-// @Success 202 {string} string "Accepted"
+// @Success 202 {object} PaymentResponse "Accepted"
 // @Failure 400 {string} string "Bad Request"
+// @Failure 401 {string} string "Unauthorized"
+// @Failure 404 {string} string "User not found"
 // @Failure 500 {string} string "Internal Server Error"
+// @Param Idempotency-Key header string false "Key that makes retries of this request safe"
+// @Failure 409 {string} string "Conflict"
+// @Failure 422 {string} string "Idempotency-Key reused with a different request"
 // @Router /payments/send-to-mobile [post]
-func SendToMobile(w http.ResponseWriter, r *http.Request) {
-	var mobilePayment MobilePaymentRequest
-	err := json.NewDecoder(r.Body).Decode(&mobilePayment)
+func (s *Server) SendToMobile(w http.ResponseWriter, r *http.Request) {
+	username, err := s.authenticatedUser(r)
 	if err != nil {
-		http.Error(w, "Bad Request: invalid JSON structure", http.StatusBadRequest)
+		slog.WarnContext(r.Context(), "Rejected mobile payment request", "error", err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	username := os.Getenv("PAYD_USERNAME")
-	password := os.Getenv("PAYD_PASSWORD")
-	auth := username + ":" + password
-	authEncoded := base64.StdEncoding.EncodeToString([]byte(auth))
-	jsonBody, err := json.Marshal(mobilePayment)
+	var mobilePayment MobilePaymentRequest
+	err = json.NewDecoder(r.Body).Decode(&mobilePayment)
 	if err != nil {
-		http.Error(w, "Internal Server Error: failed to marshal JSON", http.StatusInternalServerError)
+		http.Error(w, "Bad Request: invalid JSON structure", http.StatusBadRequest)
 		return
 	}
-	paydAPIURL := "https://api.mypayd.app/api/v2/withdrawal"
-
-	log.Println("Sending mobile payment request to Payd API:")
 
-	req, err := http.NewRequest("POST", paydAPIURL, bytes.NewBuffer(jsonBody))
-	if err != nil {
-		http.Error(w, "Failed to create request", http.StatusInternalServerError)
+	userID, err := s.users.UserID(r.Context(), username)
+	if err == errUserNotFound {
+		slog.WarnContext(r.Context(), "User not found", "username", username)
+		http.Error(w, "User not found", http.StatusNotFound)
 		return
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Basic "+authEncoded)
-
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
 	if err != nil {
-		log.Printf("Failed to send request: %v", err)
-		http.Error(w, "Failed to send mobile payment", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error looking up user", "username", username, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
-	defer resp.Body.Close()
 
-	respBody, err := io.ReadAll(resp.Body)
+	method := mobilePayment.PaymentMethod
+	if method == "" {
+		method = mobilePayment.Channel
+	}
+	paymentID, err := s.payments.CreatePayment(r.Context(), paymentRecord{
+		UserID:    userID,
+		Direction: directionPayOut,
+		Amount:    mobilePayment.Amount,
+		Method:    method,
+		Channel:   mobilePayment.Channel,
+		Phone:     mobilePayment.PhoneNumber,
+		Narration: mobilePayment.Narration,
+	}, StatusCreated, "Payout requested")
 	if err != nil {
-		log.Printf("Error reading response body: %v", err)
-		http.Error(w, "Failed to read response body", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error inserting payout into db", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Response Status Code: %d", resp.StatusCode)
-	log.Printf("Response Body: %s", respBody)
+	// Payd must report the outcome to us so that the payout status gets updated
+	if mobilePayment.CallbackURL != "" {
+		slog.InfoContext(r.Context(), "Replacing callback URL from payout request", "payment_id", paymentID)
+	}
+	mobilePayment.CallbackURL = s.callbackURL(paymentID)
+
+	slog.InfoContext(r.Context(), "Sending mobile payment request to Payd API")
 
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("Failed to send mobile payment. Status code: %d, body: %s", resp.StatusCode, respBody)
-		http.Error(w, "Failed to send mobile payment: "+string(respBody), http.StatusBadRequest)
+	txn, err := s.payd.Withdraw(r.Context(), payd.WithdrawalRequest(mobilePayment))
+	attempt := newPaydAttempt(operationWithdrawal, txn, err)
+	slog.DebugContext(r.Context(), "Payd response", "status", attempt.HTTPStatus, "body", redactBody(attempt.Response))
+
+	var apiErr *payd.APIError
+	if errors.As(err, &apiErr) {
+		slog.WarnContext(r.Context(), "Failed to send mobile payment", "status", apiErr.StatusCode, "body", redactBody(apiErr.Body))
+		s.failPaydAttempt(r.Context(), paymentID, attempt, "Rejected by Payd")
+		http.Error(w, "Failed to send mobile payment: "+string(apiErr.Body), http.StatusBadRequest)
+		return
+	}
+	// Failing the payment here would let a retry charge the user twice
+	if paydOutcomeUnknown(err) {
+		slog.WarnContext(r.Context(), "No answer from Payd, leaving payment pending", "payment_id", paymentID, "error", err)
+		s.pendPaydAttempt(r.Context(), paymentID, attempt)
+		writePending(w, paymentID)
+		return
+	}
+
+	if txn.TransactionReference == "" {
+		slog.WarnContext(r.Context(), "Payd response has no transaction reference", "payment_id", paymentID)
+	}
+	if err := s.payments.RecordAttempt(r.Context(), paymentID, attempt, StatusPending, "Accepted by Payd"); err != nil {
+		// Payd has the payment, so failing here would let a retry make it again
+		slog.ErrorContext(r.Context(), "Error recording Payd attempt, answering pending", "payment_id", paymentID, "error", err)
+		writePending(w, paymentID)
 		return
 	}
 
+	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(PaymentResponse{
+		Status:    "Accepted",
+		PaymentID: paymentID,
+	})
+}
+
+// PaymentStatusResponse is the current state of a payment and how it got there.
+type PaymentStatusResponse struct {
+	PaymentID int                `json:"payment_id"`
+	Direction string             `json:"direction"`
+	Status    PaymentStatus      `json:"status"`
+	History   []StatusTransition `json:"history"`
 }
 
 // GetPaymentStatus godoc
 // @Summary Get payment status
-// @Description Get the status of a payment by ID
+// @Description Get the current status of a payment by ID together with its status history. Payments of other users are reported as not found.
 // @Tags payments
 // @Produce json
 // @Param id path string true "Payment ID"
-// @Success 200 {object} map[string]string
+// @Success 200 {object} PaymentStatusResponse
+// @Failure 400 {string} string "Bad Request"
+// @Failure 401 {string} string "Unauthorized"
 // @Failure 404 {string} string "Payment Not Found"
 // @Failure 500 {string} string "Internal Server Error"
 // @Router /payments/status/{id} [get]
-func GetPaymentStatus(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	id := vars["id"]
-
-	var status string
-	err := db.QueryRow("SELECT status FROM payments WHERE id=$1", id).Scan(&status)
+func (s *Server) GetPaymentStatus(w http.ResponseWriter, r *http.Request) {
+	username, err := s.authenticatedUser(r)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			http.Error(w, "Payment Not Found", http.StatusNotFound)
-			return
-		}
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		slog.WarnContext(r.Context(), "Rejected payment status request", "error", err)
+		http.Error(w, "Unauthorized", http.StatusUnauthorized)
 		return
 	}
 
-	json.NewEncoder(w).Encode(map[string]string{"status": status})
-}
-
-func GetCardDetails(w http.ResponseWriter, r *http.Request) {
-	username := os.Getenv("PAYD_USERNAME")
-	password := os.Getenv("PAYD_PASSWORD")
-	auth := username + ":" + password
-	authEncoded := base64.StdEncoding.EncodeToString([]byte(auth))
-	paydAPIURL := "https://api.mypayd.app/api/v2/payments"
-
-	log.Println("Getting card details from Payd API:")
-	log.Printf("Authorization: Basic %s", authEncoded)
-
-	req, err := http.NewRequest("POST", paydAPIURL, nil)
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["id"])
 	if err != nil {
-		log.Printf("Failed to create request: %v", err)
-		http.Error(w, "Failed to create request", http.StatusInternalServerError)
+		http.Error(w, "Bad Request: invalid payment ID", http.StatusBadRequest)
 		return
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Basic "+authEncoded)
 
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Do(req)
+	payment, err := s.payments.GetPayment(r.Context(), id)
+	if err == errPaymentNotFound {
+		http.Error(w, "Payment Not Found", http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		log.Printf("Failed to send request: %v", err)
-		http.Error(w, "Failed to send request", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error loading payment", "payment_id", id, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	// Someone else's payment looks like a missing one, so IDs cannot be probed
+	userID, err := s.users.UserID(r.Context(), username)
+	if err != nil && err != errUserNotFound {
+		slog.ErrorContext(r.Context(), "Error looking up user", "username", username, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	if err == errUserNotFound || payment.UserID != userID {
+		slog.WarnContext(r.Context(), "Rejected status request for another user's payment", "payment_id", id, "username", username)
+		http.Error(w, "Payment Not Found", http.StatusNotFound)
 		return
 	}
-	defer resp.Body.Close()
 
-	respBody, err := io.ReadAll(resp.Body)
+	history, err := s.payments.History(r.Context(), id)
 	if err != nil {
-		log.Printf("Error reading response body: %v", err)
-		http.Error(w, "Failed to read response body", http.StatusInternalServerError)
+		slog.ErrorContext(r.Context(), "Error loading payment history", "payment_id", id, "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 
-	log.Printf("Response Status Code: %d", resp.StatusCode)
-	log.Printf("Response Body: %s", respBody)
+	response := PaymentStatusResponse{
+		PaymentID: id,
+		Direction: payment.Direction,
+		Status:    payment.Status,
+		History:   history,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func (s *Server) GetCardDetails(w http.ResponseWriter, r *http.Request) {
+	slog.InfoContext(r.Context(), "Getting card details from Payd API")
 
-	if resp.StatusCode != http.StatusOK {
-		log.Printf("Failed to initiate payment. Status code: %d", resp.StatusCode)
-		http.Error(w, "Failed to initiate payment: "+string(respBody), http.StatusBadRequest)
+	resp, err := s.payd.GetPaymentDetails(r.Context())
+	var apiErr *payd.APIError
+	if errors.As(err, &apiErr) {
+		slog.WarnContext(r.Context(), "Failed to get card details", "status", apiErr.StatusCode, "body", redactBody(apiErr.Body))
+		http.Error(w, "Failed to get card details: "+string(apiErr.Body), http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Failed to send request", "error", err)
+		http.Error(w, "Failed to send request", http.StatusInternalServerError)
 		return
 	}
 
+	slog.DebugContext(r.Context(), "Payd response", "status", resp.StatusCode, "body", redactBody(resp.Body))
 	w.WriteHeader(http.StatusAccepted)
 }
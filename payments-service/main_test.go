@@ -1,25 +1,53 @@
 package main
 
 import (
-    "database/sql"
+    "context"
     "encoding/json"
     "net/http"
     "net/http/httptest"
     "os"
     "strings"
     "testing"
+    "time"
 	"log"
 
-    _ "github.com/lib/pq"
     "github.com/gorilla/mux"
+    "github.com/tufstraka/pps/payments-service/payd"
 )
 
+// testServer serves the handler tests from in-memory storage and a fake Payd.
+var testServer *Server
+
+// Secrets the test servers are configured with.
+const (
+    testIdentityKey   = "test-identity-key"
+    testWebhookSecret = "test-webhook-secret"
+)
+
+// newTestServer returns a server backed by empty in-memory repositories and a fake Payd,
+// with "testuser" registered and "support" as an admin.
+func newTestServer() (*Server, *MemoryPaymentRepository, *payd.Fake) {
+    cfg := defaultConfig()
+    cfg.IdentitySigningKey = testIdentityKey
+    cfg.PaydWebhookSecret = testWebhookSecret
+    cfg.PaydCallbackURL = "https://gateway.example/payments/callback"
+    cfg.AdminUsers = []string{"support"}
+
+    users := NewMemoryUserRepository()
+    users.AddUser("testuser")
+    payments := NewMemoryPaymentRepository()
+    fake := &payd.Fake{}
+    return NewServer(cfg, users, payments, NewMemoryIdempotencyStore(), fake, time.Now), payments, fake
+}
 
 func TestMain(m *testing.M) {
-    var err error
-    postgresURI := os.Getenv("DATABASE_URI")
+    var payments *MemoryPaymentRepository
+    testServer, payments, _ = newTestServer()
 
-    db, err = sql.Open("postgres", postgresURI)
+    // Payment 1 is looked up by TestGetPaymentStatus
+    _, err := payments.CreatePayment(context.Background(), paymentRecord{
+        UserID: 1, Direction: directionPayIn, Amount: 100, Method: "MPESA",
+    }, StatusPending, "Seeded for tests")
     if err != nil {
         log.Fatal(err)
     }
@@ -31,9 +59,9 @@ func TestMain(m *testing.M) {
 
 func setupRouter() *mux.Router {
     r := mux.NewRouter()
-    r.HandleFunc("/payments/initiate", InitiatePayment).Methods("POST")
-    r.HandleFunc("/payments/status/{id}", GetPaymentStatus).Methods("GET")
-    r.HandleFunc("/payments/send-to-mobile", SendToMobile).Methods("POST")
+    r.HandleFunc("/payments/initiate", testServer.InitiatePayment).Methods("POST")
+    r.HandleFunc("/payments/status/{id}", testServer.GetPaymentStatus).Methods("GET")
+    r.HandleFunc("/payments/send-to-mobile", testServer.SendToMobile).Methods("POST")
     return r
 }
 
@@ -55,6 +83,7 @@ func TestInitiatePayment(t *testing.T) {
     jsonValue, _ := json.Marshal(paymentRequest)
     req, _ := http.NewRequest("POST", "/payments/initiate", strings.NewReader(string(jsonValue)))
     req.Header.Set("Content-Type", "application/json")
+    signTestIdentity(req, "testuser", time.Now())
 
     rr := httptest.NewRecorder()
     r.ServeHTTP(rr, req)
@@ -82,6 +111,7 @@ func TestSendToMobile(t *testing.T) {
     jsonValue, _ := json.Marshal(mobilePaymentRequest)
     req, _ := http.NewRequest("POST", "/payments/send-to-mobile", strings.NewReader(string(jsonValue)))
     req.Header.Set("Content-Type", "application/json")
+    signTestIdentity(req, "testuser", time.Now())
 
     rr := httptest.NewRecorder()
     r.ServeHTTP(rr, req)
@@ -97,8 +127,9 @@ func TestSendToMobile(t *testing.T) {
 func TestGetPaymentStatus(t *testing.T) {
     r := setupRouter()
 
-    // Assume a payment with ID 1 exists
+    // Payment 1 is created in TestMain
     req, _ := http.NewRequest("GET", "/payments/status/1", nil)
+    signTestIdentity(req, "testuser", time.Now())
 
     rr := httptest.NewRecorder()
     r.ServeHTTP(rr, req)
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// MemoryUserRepository is an in-memory UserRepository for tests.
+type MemoryUserRepository struct {
+	mu    sync.Mutex
+	users map[string]int
+}
+
+func NewMemoryUserRepository() *MemoryUserRepository {
+	return &MemoryUserRepository{users: map[string]int{}}
+}
+
+// AddUser registers username and returns its ID.
+func (r *MemoryUserRepository) AddUser(username string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if id, ok := r.users[username]; ok {
+		return id
+	}
+	id := len(r.users) + 1
+	r.users[username] = id
+	return id
+}
+
+func (r *MemoryUserRepository) UserID(ctx context.Context, username string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	id, ok := r.users[username]
+	if !ok {
+		return 0, errUserNotFound
+	}
+	return id, nil
+}
+
+// MemoryPaymentRepository is an in-memory PaymentRepository for tests. It does not
+// resolve usernames.
+type MemoryPaymentRepository struct {
+	mu       sync.Mutex
+	payments []Payment
+	history  map[int][]StatusTransition
+	attempts map[int][]PaydAttemptRecord
+	nextTry  int
+}
+
+func NewMemoryPaymentRepository() *MemoryPaymentRepository {
+	return &MemoryPaymentRepository{
+		history:  map[int][]StatusTransition{},
+		attempts: map[int][]PaydAttemptRecord{},
+	}
+}
+
+func (r *MemoryPaymentRepository) CreatePayment(ctx context.Context, p paymentRecord, status PaymentStatus, reason string) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if p.ProviderReference != "" && r.findReference(p.ProviderReference) >= 0 {
+		return 0, fmt.Errorf("duplicate provider reference %q", p.ProviderReference)
+	}
+
+	now := time.Now()
+	id := len(r.payments) + 1
+	r.payments = append(r.payments, Payment{
+		PaymentID:         id,
+		UserID:            p.UserID,
+		Direction:         p.Direction,
+		Amount:            p.Amount,
+		Currency:          "KES",
+		Method:            p.Method,
+		Channel:           p.Channel,
+		Phone:             p.Phone,
+		Narration:         p.Narration,
+		Status:            status,
+		ProviderReference: p.ProviderReference,
+		CreatedAt:         now,
+		UpdatedAt:         now,
+	})
+	r.history[id] = append(r.history[id], StatusTransition{To: status, Reason: reason, At: now})
+	return id, nil
+}
+
+func (r *MemoryPaymentRepository) RecordAttempt(ctx context.Context, paymentID int, a paydAttempt, next PaymentStatus, reason string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if paymentID < 1 || paymentID > len(r.payments) {
+		return errPaymentNotFound
+	}
+	reference := a.providerReference()
+	if i := r.findReference(reference); reference != "" && i >= 0 && i != paymentID-1 {
+		return fmt.Errorf("duplicate provider reference %q", reference)
+	}
+	// Check the transition first so that nothing is stored if it is not allowed
+	if current := r.payments[paymentID-1].Status; !current.CanTransition(next) {
+		return fmt.Errorf("%w: %s to %s", errIllegalTransition, current, next)
+	}
+
+	record := PaydAttemptRecord{
+		Operation:         a.Operation,
+		HTTPStatus:        a.HTTPStatus,
+		ProviderReference: reference,
+		Response:          string(a.snapshot()),
+		CreatedAt:         time.Now(),
+	}
+	if a.Err != nil {
+		record.Error = a.Err.Error()
+	}
+	r.nextTry++
+	record.ID = r.nextTry
+	r.attempts[paymentID] = append(r.attempts[paymentID], record)
+	if reference != "" {
+		r.payments[paymentID-1].ProviderReference = reference
+	}
+	_, err := r.transition(paymentID, next, reason)
+	return err
+}
+
+func (r *MemoryPaymentRepository) SetProviderReference(ctx context.Context, paymentID int, reference string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if paymentID < 1 || paymentID > len(r.payments) || r.payments[paymentID-1].ProviderReference != "" {
+		return errPaymentNotFound
+	}
+	if r.findReference(reference) >= 0 {
+		return fmt.Errorf("duplicate provider reference %q", reference)
+	}
+	r.payments[paymentID-1].ProviderReference = reference
+	return nil
+}
+
+func (r *MemoryPaymentRepository) Transition(ctx context.Context, paymentID int, next PaymentStatus, reason string) (PaymentStatus, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.transition(paymentID, next, reason)
+}
+
+func (r *MemoryPaymentRepository) transition(paymentID int, next PaymentStatus, reason string) (PaymentStatus, error) {
+	if paymentID < 1 || paymentID > len(r.payments) {
+		return "", errPaymentNotFound
+	}
+	p := &r.payments[paymentID-1]
+	current := p.Status
+	if !current.CanTransition(next) {
+		return current, fmt.Errorf("%w: %s to %s", errIllegalTransition, current, next)
+	}
+	now := time.Now()
+	p.Status = next
+	p.UpdatedAt = now
+	r.history[paymentID] = append(r.history[paymentID], StatusTransition{From: current, To: next, Reason: reason, At: now})
+	return current, nil
+}
+
+func (r *MemoryPaymentRepository) GetPayment(ctx context.Context, id int) (Payment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if id < 1 || id > len(r.payments) {
+		return Payment{}, errPaymentNotFound
+	}
+	return r.payments[id-1], nil
+}
+
+func (r *MemoryPaymentRepository) GetPaymentByProviderReference(ctx context.Context, reference string) (Payment, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i := r.findReference(reference)
+	if reference == "" || i < 0 {
+		return Payment{}, errPaymentNotFound
+	}
+	return r.payments[i], nil
+}
+
+func (r *MemoryPaymentRepository) findReference(reference string) int {
+	for i, p := range r.payments {
+		if p.ProviderReference == reference {
+			return i
+		}
+	}
+	return -1
+}
+
+func (r *MemoryPaymentRepository) History(ctx context.Context, paymentID int) ([]StatusTransition, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]StatusTransition{}, r.history[paymentID]...), nil
+}
+
+func (r *MemoryPaymentRepository) Attempts(ctx context.Context, paymentID int) ([]PaydAttemptRecord, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]PaydAttemptRecord{}, r.attempts[paymentID]...), nil
+}
+
+// MemoryIdempotencyStore is an in-memory IdempotencyStore for tests.
+type MemoryIdempotencyStore struct {
+	mu   sync.Mutex
+	keys map[[2]string]memoryIdempotencyKey
+}
+
+type memoryIdempotencyKey struct {
+	storedResponse
+	claimedAt time.Time
+}
+
+func NewMemoryIdempotencyStore() *MemoryIdempotencyStore {
+	return &MemoryIdempotencyStore{keys: map[[2]string]memoryIdempotencyKey{}}
+}
+
+func (s *MemoryIdempotencyStore) Claim(ctx context.Context, username, key, hash string, staleAfter time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := [2]string{username, key}
+	if existing, ok := s.keys[id]; ok {
+		stale := existing.Status == 0 && existing.RequestHash == hash && time.Since(existing.claimedAt) > staleAfter
+		if !stale {
+			return false, nil
+		}
+	}
+	s.keys[id] = memoryIdempotencyKey{storedResponse: storedResponse{RequestHash: hash}, claimedAt: time.Now()}
+	return true, nil
+}
+
+func (s *MemoryIdempotencyStore) Get(ctx context.Context, username, key string) (storedResponse, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	stored, ok := s.keys[[2]string{username, key}]
+	if !ok {
+		return storedResponse{}, errIdempotencyKeyNotFound
+	}
+	return stored.storedResponse, nil
+}
+
+func (s *MemoryIdempotencyStore) Complete(ctx context.Context, username, key string, resp storedResponse) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := [2]string{username, key}
+	stored := s.keys[id]
+	resp.RequestHash = stored.RequestHash
+	stored.storedResponse = resp
+	s.keys[id] = stored
+	return nil
+}
+
+func (s *MemoryIdempotencyStore) Release(ctx context.Context, username, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, [2]string{username, key})
+	return nil
+}
@@ -0,0 +1,67 @@
+package payd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Fake is an in-memory Client for tests. It accepts every request unless Err is set,
+// and records what it was asked to do, including requests it fails.
+type Fake struct {
+	// Err, if set, is returned by every call instead of a result.
+	Err error
+
+	mu          sync.Mutex
+	next        int
+	Payments    []PaymentRequest
+	Withdrawals []WithdrawalRequest
+}
+
+var _ Client = (*Fake)(nil)
+
+func (f *Fake) CreatePayment(ctx context.Context, req PaymentRequest) (*Transaction, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Payments = append(f.Payments, req)
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	return f.transaction(http.StatusCreated), nil
+}
+
+func (f *Fake) Withdraw(ctx context.Context, req WithdrawalRequest) (*Transaction, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.Withdrawals = append(f.Withdrawals, req)
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	return f.transaction(http.StatusOK), nil
+}
+
+func (f *Fake) GetPaymentDetails(ctx context.Context) (*Response, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.Err != nil {
+		return nil, f.Err
+	}
+	return &Response{StatusCode: http.StatusOK, Body: []byte(`{"status":"active"}`)}, nil
+}
+
+// transaction returns an accepted transaction with a reference that is unique across
+// test runs, since references are stored with a unique index.
+func (f *Fake) transaction(status int) *Transaction {
+	f.next++
+	txn := &Transaction{
+		TransactionReference: fmt.Sprintf("FAKE-%d-%d", time.Now().UnixNano(), f.next),
+		Status:               "pending",
+		Message:              "accepted",
+	}
+	txn.StatusCode = status
+	txn.Body, _ = json.Marshal(txn)
+	return txn
+}
@@ -0,0 +1,177 @@
+// Package payd is a client for the Payd payments API.
+package payd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Client is the part of the Payd API the payments service uses.
+type Client interface {
+	// CreatePayment asks Payd to collect a payment from a customer.
+	CreatePayment(ctx context.Context, req PaymentRequest) (*Transaction, error)
+	// Withdraw sends money from the merchant account to a mobile number.
+	Withdraw(ctx context.Context, req WithdrawalRequest) (*Transaction, error)
+	// GetPaymentDetails fetches the card payment details of the merchant account.
+	GetPaymentDetails(ctx context.Context) (*Response, error)
+}
+
+// PaymentRequest is the body of POST /api/v1/payments.
+type PaymentRequest struct {
+	Amount        float64 `json:"amount"`
+	Email         string  `json:"email"`
+	Location      string  `json:"location"`
+	Username      string  `json:"username"`
+	PaymentMethod string  `json:"payment_method"`
+	Phone         string  `json:"phone"`
+	FirstName     string  `json:"first_name"`
+	LastName      string  `json:"last_name"`
+	Reason        string  `json:"reason"`
+	CallbackURL   string  `json:"callback_url,omitempty"`
+}
+
+// WithdrawalRequest is the body of POST /api/v2/withdrawal.
+type WithdrawalRequest struct {
+	AccountID     string  `json:"account_id"`
+	PhoneNumber   string  `json:"phone_number"`
+	Amount        float64 `json:"amount"`
+	Narration     string  `json:"narration"`
+	CallbackURL   string  `json:"callback_url"`
+	Channel       string  `json:"channel"`
+	PaymentMethod string  `json:"payment_method"`
+}
+
+// Response is the HTTP answer Payd gave, kept so that callers can store it.
+type Response struct {
+	StatusCode int    `json:"-"`
+	Body       []byte `json:"-"`
+}
+
+// Transaction is Payd's answer to a payment or withdrawal it accepted.
+type Transaction struct {
+	Response
+	TransactionReference string `json:"transaction_reference"`
+	Status               string `json:"status"`
+	Message              string `json:"message"`
+}
+
+// APIError is returned when Payd answers with a non-2xx status.
+type APIError struct {
+	Response
+	Operation string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("payd: %s returned %d: %s", e.Operation, e.StatusCode, strings.TrimSpace(string(e.Body)))
+}
+
+// RequestError is returned when Payd could not be reached or its answer could not be read.
+type RequestError struct {
+	Operation string
+	Err       error
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("payd: %s: %v", e.Operation, e.Err)
+}
+
+func (e *RequestError) Unwrap() error {
+	return e.Err
+}
+
+// Timeout reports whether the request failed because Payd took too long to answer.
+func (e *RequestError) Timeout() bool {
+	var t interface{ Timeout() bool }
+	return errors.Is(e.Err, context.DeadlineExceeded) || (errors.As(e.Err, &t) && t.Timeout())
+}
+
+// Operation names used in errors.
+const (
+	OperationCreatePayment     = "create payment"
+	OperationWithdraw          = "withdraw"
+	OperationGetPaymentDetails = "get payment details"
+)
+
+// HTTPClient talks to the Payd API over HTTP with Basic authentication.
+type HTTPClient struct {
+	baseURL  string
+	username string
+	password string
+	http     *http.Client
+}
+
+// New returns a client for the Payd API at baseURL.
+func New(baseURL, username, password string, timeout time.Duration) *HTTPClient {
+	return &HTTPClient{
+		baseURL:  strings.TrimRight(baseURL, "/"),
+		username: username,
+		password: password,
+		http:     &http.Client{Timeout: timeout},
+	}
+}
+
+func (c *HTTPClient) CreatePayment(ctx context.Context, req PaymentRequest) (*Transaction, error) {
+	return c.transaction(ctx, OperationCreatePayment, "/api/v1/payments", req)
+}
+
+func (c *HTTPClient) Withdraw(ctx context.Context, req WithdrawalRequest) (*Transaction, error) {
+	return c.transaction(ctx, OperationWithdraw, "/api/v2/withdrawal", req)
+}
+
+func (c *HTTPClient) GetPaymentDetails(ctx context.Context) (*Response, error) {
+	return c.do(ctx, OperationGetPaymentDetails, "/api/v2/payments", nil)
+}
+
+func (c *HTTPClient) transaction(ctx context.Context, op, path string, body any) (*Transaction, error) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return nil, &RequestError{Operation: op, Err: err}
+	}
+	resp, err := c.do(ctx, op, path, data)
+	if err != nil {
+		return nil, err
+	}
+
+	txn := &Transaction{Response: *resp}
+	// Payd does not always answer with JSON; the raw body is still kept on the response
+	json.Unmarshal(resp.Body, txn)
+	return txn, nil
+}
+
+// do sends a POST to path and returns Payd's answer, or an *APIError if it is not 2xx.
+func (c *HTTPClient) do(ctx context.Context, op, path string, body []byte) (*Response, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+path, reader)
+	if err != nil {
+		return nil, &RequestError{Operation: op, Err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(c.username, c.password)
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, &RequestError{Operation: op, Err: err}
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, &RequestError{Operation: op, Err: err}
+	}
+
+	result := Response{StatusCode: resp.StatusCode, Body: data}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, &APIError{Response: result, Operation: op}
+	}
+	return &result, nil
+}
@@ -0,0 +1,68 @@
+package payd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCreatePayment(t *testing.T) {
+	var got PaymentRequest
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" || r.URL.Path != "/api/v1/payments" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		}
+		if user, pass, ok := r.BasicAuth(); !ok || user != "merchant" || pass != "secret" {
+			t.Errorf("unexpected basic auth %q %q", user, pass)
+		}
+		json.NewDecoder(r.Body).Decode(&got)
+		w.WriteHeader(http.StatusCreated)
+		w.Write([]byte(`{"transaction_reference":"TX1","status":"pending"}`))
+	}))
+	defer server.Close()
+
+	client := New(server.URL+"/", "merchant", "secret", time.Second)
+	txn, err := client.CreatePayment(context.Background(), PaymentRequest{Amount: 100, Username: "alice"})
+	if err != nil {
+		t.Fatalf("CreatePayment returned error: %v", err)
+	}
+	if txn.TransactionReference != "TX1" || txn.StatusCode != http.StatusCreated || len(txn.Body) == 0 {
+		t.Errorf("unexpected transaction %+v", txn)
+	}
+	if got.Username != "alice" || got.Amount != 100 {
+		t.Errorf("Payd received %+v", got)
+	}
+}
+
+func TestAPIError(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"message":"insufficient balance"}`, http.StatusBadRequest)
+	}))
+	defer server.Close()
+
+	_, err := New(server.URL, "merchant", "secret", time.Second).Withdraw(context.Background(), WithdrawalRequest{Amount: 100})
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) {
+		t.Fatalf("expected *APIError, got %v", err)
+	}
+	if apiErr.StatusCode != http.StatusBadRequest || apiErr.Operation != OperationWithdraw {
+		t.Errorf("unexpected error %+v", apiErr)
+	}
+}
+
+func TestRequestErrorTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(200 * time.Millisecond)
+	}))
+	defer server.Close()
+
+	_, err := New(server.URL, "merchant", "secret", 20*time.Millisecond).GetPaymentDetails(context.Background())
+	var reqErr *RequestError
+	if !errors.As(err, &reqErr) || !reqErr.Timeout() {
+		t.Fatalf("expected timeout *RequestError, got %v", err)
+	}
+}
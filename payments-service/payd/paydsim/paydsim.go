@@ -0,0 +1,321 @@
+// Package paydsim simulates the parts of the Payd API the payments service uses, for local
+// development and tests. Each request is answered according to a scripted outcome, and
+// accepted payments are settled by calling the request's callback_url the way Payd does.
+package paydsim
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// Outcome decides how the simulator answers a payment or withdrawal request.
+type Outcome string
+
+const (
+	// Success accepts the request and reports success in the callback.
+	Success Outcome = "success"
+	// Decline accepts the request and reports failure in the callback, as when the
+	// customer rejects the prompt on their phone.
+	Decline Outcome = "decline"
+	// Reject refuses the request with 400 and sends no callback.
+	Reject Outcome = "reject"
+	// Timeout holds the request until Config.Timeout passes or the client gives up.
+	Timeout Outcome = "timeout"
+	// ServerError answers 503 and sends no callback.
+	ServerError Outcome = "server_error"
+	// DelayedCallback accepts the request and reports success after Config.DelayedCallback.
+	DelayedCallback Outcome = "delayed_callback"
+)
+
+// Valid reports whether o is a known outcome.
+func (o Outcome) Valid() bool {
+	switch o {
+	case Success, Decline, Reject, Timeout, ServerError, DelayedCallback:
+		return true
+	}
+	return false
+}
+
+const signatureHeader = "X-Payd-Signature"
+
+// Config controls the simulator.
+type Config struct {
+	// Username and Password are required as Basic auth when set.
+	Username string
+	Password string
+	// WebhookSecret signs callbacks. Callbacks are unsigned when it is empty.
+	WebhookSecret string
+	// DefaultOutcome is used once the script is exhausted. Defaults to Success.
+	DefaultOutcome Outcome
+	// CallbackDelay is how long to wait before sending a callback.
+	CallbackDelay time.Duration
+	// DelayedCallback is how long the DelayedCallback outcome waits. Defaults to 5s.
+	DelayedCallback time.Duration
+	// Timeout is how long the Timeout outcome holds a request. Defaults to 60s.
+	Timeout time.Duration
+	// CallbackRetries is how many more times a callback that is not answered with a 2xx
+	// is sent, as Payd does. Defaults to 5; negative sends every callback once.
+	CallbackRetries int
+	// CallbackRetryInterval is how long to wait before sending a callback again.
+	// Defaults to 1s.
+	CallbackRetryInterval time.Duration
+}
+
+// Callback is the notification sent to a request's callback_url.
+type Callback struct {
+	TransactionReference string  `json:"transaction_reference"`
+	ResultCode           int     `json:"result_code"`
+	Remarks              string  `json:"remarks"`
+	Amount               float64 `json:"amount"`
+	Success              bool    `json:"success"`
+	Status               string  `json:"status"`
+}
+
+// Request is a call the simulator received.
+type Request struct {
+	Path                 string
+	Outcome              Outcome
+	TransactionReference string
+	Body                 []byte
+}
+
+// Simulator is an http.Handler serving the simulated Payd API.
+type Simulator struct {
+	config Config
+	client *http.Client
+
+	mu       sync.Mutex
+	script   []Outcome
+	next     int
+	requests []Request
+
+	callbacks sync.WaitGroup
+}
+
+// New returns a simulator with the given settings.
+func New(config Config) *Simulator {
+	if config.DefaultOutcome == "" {
+		config.DefaultOutcome = Success
+	}
+	if config.DelayedCallback == 0 {
+		config.DelayedCallback = 5 * time.Second
+	}
+	if config.Timeout == 0 {
+		config.Timeout = 60 * time.Second
+	}
+	if config.CallbackRetries == 0 {
+		config.CallbackRetries = 5
+	}
+	if config.CallbackRetryInterval == 0 {
+		config.CallbackRetryInterval = time.Second
+	}
+	return &Simulator{config: config, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Server is a simulator listening on a local httptest server.
+type Server struct {
+	*Simulator
+	URL    string
+	server *httptest.Server
+}
+
+// NewServer starts a simulator for tests. Point the Payd client at its URL.
+func NewServer(config Config) *Server {
+	sim := New(config)
+	server := httptest.NewServer(sim)
+	return &Server{Simulator: sim, URL: server.URL, server: server}
+}
+
+// Close waits for pending callbacks and shuts the server down.
+func (s *Server) Close() {
+	s.Wait()
+	s.server.Close()
+}
+
+// Script queues outcomes for the next requests, in order.
+func (s *Simulator) Script(outcomes ...Outcome) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.script = append(s.script, outcomes...)
+}
+
+// Requests returns the payment and withdrawal requests received so far.
+func (s *Simulator) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]Request(nil), s.requests...)
+}
+
+// Wait blocks until all scheduled callbacks have been sent.
+func (s *Simulator) Wait() {
+	s.callbacks.Wait()
+}
+
+func (s *Simulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == "POST" && r.URL.Path == "/_simulator/script":
+		s.handleScript(w, r)
+	case !s.authorized(r):
+		writeJSON(w, http.StatusUnauthorized, map[string]string{"message": "invalid credentials"})
+	case r.Method == "POST" && r.URL.Path == "/api/v1/payments":
+		s.handleTransaction(w, r, http.StatusCreated)
+	case r.Method == "POST" && r.URL.Path == "/api/v2/withdrawal":
+		s.handleTransaction(w, r, http.StatusOK)
+	case r.Method == "POST" && r.URL.Path == "/api/v2/payments":
+		writeJSON(w, http.StatusOK, map[string]any{"status": "active", "cards": []string{"VISA", "MASTERCARD"}})
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Simulator) authorized(r *http.Request) bool {
+	if s.config.Username == "" {
+		return true
+	}
+	username, password, ok := r.BasicAuth()
+	return ok && username == s.config.Username && password == s.config.Password
+}
+
+// handleScript lets a test running against the simulator binary queue outcomes.
+func (s *Simulator) handleScript(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Outcomes []Outcome `json:"outcomes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, "Bad Request: invalid JSON structure", http.StatusBadRequest)
+		return
+	}
+	for _, o := range body.Outcomes {
+		if !o.Valid() {
+			http.Error(w, fmt.Sprintf("Bad Request: unknown outcome %q", o), http.StatusBadRequest)
+			return
+		}
+	}
+	s.Script(body.Outcomes...)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Simulator) handleTransaction(w http.ResponseWriter, r *http.Request, acceptedStatus int) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, "Failed to read request body", http.StatusInternalServerError)
+		return
+	}
+	var req struct {
+		Amount      float64 `json:"amount"`
+		CallbackURL string  `json:"callback_url"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "invalid JSON"})
+		return
+	}
+
+	outcome, reference := s.take(r.URL.Path, body)
+	slog.InfoContext(r.Context(), "Simulated Payd request", "path", r.URL.Path, "outcome", outcome, "transaction_reference", reference)
+
+	switch outcome {
+	case Reject:
+		writeJSON(w, http.StatusBadRequest, map[string]string{"message": "request rejected by simulator"})
+		return
+	case ServerError:
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"message": "simulated outage"})
+		return
+	case Timeout:
+		select {
+		case <-time.After(s.config.Timeout):
+		case <-r.Context().Done():
+		}
+		writeJSON(w, http.StatusGatewayTimeout, map[string]string{"message": "simulated timeout"})
+		return
+	}
+
+	if req.CallbackURL != "" {
+		delay := s.config.CallbackDelay
+		if outcome == DelayedCallback {
+			delay = s.config.DelayedCallback
+		}
+		callback := Callback{
+			TransactionReference: reference,
+			Amount:               req.Amount,
+			Success:              outcome != Decline,
+			Status:               "success",
+			Remarks:              "Completed by simulator",
+		}
+		if outcome == Decline {
+			callback.ResultCode = 1032
+			callback.Status = "failed"
+			callback.Remarks = "Declined by simulator"
+		}
+		s.callbacks.Add(1)
+		go func() {
+			defer s.callbacks.Done()
+			time.Sleep(delay)
+			for retry := 0; !s.sendCallback(req.CallbackURL, callback) && retry < s.config.CallbackRetries; retry++ {
+				time.Sleep(s.config.CallbackRetryInterval)
+			}
+		}()
+	}
+
+	writeJSON(w, acceptedStatus, map[string]string{
+		"transaction_reference": reference,
+		"status":                "pending",
+		"message":               "request accepted",
+	})
+}
+
+// take picks the outcome for a request and records it.
+func (s *Simulator) take(path string, body []byte) (Outcome, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	outcome := s.config.DefaultOutcome
+	if len(s.script) > 0 {
+		outcome, s.script = s.script[0], s.script[1:]
+	}
+	s.next++
+	reference := fmt.Sprintf("SIM-%d-%d", time.Now().UnixNano(), s.next)
+	s.requests = append(s.requests, Request{Path: path, Outcome: outcome, TransactionReference: reference, Body: body})
+	return outcome, reference
+}
+
+// sendCallback delivers a callback and reports whether it was acknowledged. Invalid URLs
+// count as acknowledged since sending again cannot help.
+func (s *Simulator) sendCallback(url string, callback Callback) bool {
+	body, _ := json.Marshal(callback)
+	req, err := http.NewRequest("POST", url, bytes.NewReader(body))
+	if err != nil {
+		slog.Error("Invalid callback URL", "url", url, "error", err)
+		return true
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.config.WebhookSecret != "" {
+		mac := hmac.New(sha256.New, []byte(s.config.WebhookSecret))
+		mac.Write(body)
+		req.Header.Set(signatureHeader, hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		slog.Error("Failed to send callback", "url", url, "error", err)
+		return false
+	}
+	resp.Body.Close()
+	slog.Info("Sent callback", "url", url, "transaction_reference", callback.TransactionReference, "status", resp.StatusCode)
+	return resp.StatusCode >= 200 && resp.StatusCode < 300
+}
+
+func writeJSON(w http.ResponseWriter, status int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
@@ -0,0 +1,109 @@
+package paydsim
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tufstraka/pps/payments-service/payd"
+)
+
+func TestScriptedOutcomes(t *testing.T) {
+	sim := NewServer(Config{Username: "merchant", Password: "secret", Timeout: time.Second})
+	defer sim.Close()
+	sim.Script(Success, Reject, ServerError, Timeout)
+
+	client := payd.New(sim.URL, "merchant", "secret", 100*time.Millisecond)
+	ctx := context.Background()
+
+	txn, err := client.CreatePayment(ctx, payd.PaymentRequest{Amount: 100})
+	if err != nil || txn.TransactionReference == "" {
+		t.Fatalf("success: got %+v, %v", txn, err)
+	}
+
+	var apiErr *payd.APIError
+	if _, err := client.CreatePayment(ctx, payd.PaymentRequest{Amount: 100}); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusBadRequest {
+		t.Errorf("reject: got %v", err)
+	}
+	if _, err := client.Withdraw(ctx, payd.WithdrawalRequest{Amount: 100}); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("server error: got %v", err)
+	}
+	var reqErr *payd.RequestError
+	if _, err := client.Withdraw(ctx, payd.WithdrawalRequest{Amount: 100}); !errors.As(err, &reqErr) || !reqErr.Timeout() {
+		t.Errorf("timeout: got %v", err)
+	}
+
+	if _, err := payd.New(sim.URL, "merchant", "wrong", time.Second).GetPaymentDetails(ctx); !errors.As(err, &apiErr) || apiErr.StatusCode != http.StatusUnauthorized {
+		t.Errorf("bad credentials: got %v", err)
+	}
+
+	if got := len(sim.Requests()); got != 4 {
+		t.Errorf("expected 4 recorded requests, got %d", got)
+	}
+}
+
+func TestCallbacks(t *testing.T) {
+	received := make(chan Callback, 2)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mac := hmac.New(sha256.New, []byte("webhook-secret"))
+		mac.Write(body)
+		if r.Header.Get(signatureHeader) != hex.EncodeToString(mac.Sum(nil)) {
+			t.Error("callback signature does not match")
+		}
+		var callback Callback
+		json.Unmarshal(body, &callback)
+		received <- callback
+	}))
+	defer receiver.Close()
+
+	sim := NewServer(Config{WebhookSecret: "webhook-secret", DelayedCallback: 50 * time.Millisecond})
+	sim.Script(Decline, DelayedCallback)
+	client := payd.New(sim.URL, "", "", time.Second)
+
+	declined, _ := client.CreatePayment(context.Background(), payd.PaymentRequest{Amount: 10, CallbackURL: receiver.URL})
+	delayed, _ := client.Withdraw(context.Background(), payd.WithdrawalRequest{Amount: 20, CallbackURL: receiver.URL})
+	sim.Close()
+	close(received)
+
+	callbacks := map[string]Callback{}
+	for c := range received {
+		callbacks[c.TransactionReference] = c
+	}
+	if c := callbacks[declined.TransactionReference]; c.Success || c.Status != "failed" {
+		t.Errorf("declined payment callback: %+v", c)
+	}
+	if c := callbacks[delayed.TransactionReference]; !c.Success || c.Amount != 20 {
+		t.Errorf("delayed payout callback: %+v", c)
+	}
+}
+
+func TestCallbacksAreResentUntilAcknowledged(t *testing.T) {
+	var deliveries atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if deliveries.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer receiver.Close()
+
+	sim := NewServer(Config{CallbackRetryInterval: time.Millisecond})
+	client := payd.New(sim.URL, "", "", time.Second)
+	if _, err := client.CreatePayment(context.Background(), payd.PaymentRequest{Amount: 10, CallbackURL: receiver.URL}); err != nil {
+		t.Fatal(err)
+	}
+	sim.Close()
+
+	if n := deliveries.Load(); n != 3 {
+		t.Errorf("callback was delivered %d times, want 3", n)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/tufstraka/pps/payments-service/payd"
+)
+
+func TestGetCardDetails(t *testing.T) {
+	s, _, fake := newTestServer()
+
+	tests := []struct {
+		err  error
+		want int
+	}{
+		{nil, http.StatusAccepted},
+		{&payd.APIError{Operation: payd.OperationGetPaymentDetails, Response: payd.Response{StatusCode: http.StatusUnauthorized}}, http.StatusBadRequest},
+		{&payd.RequestError{Operation: payd.OperationGetPaymentDetails, Err: errors.New("connection refused")}, http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		fake.Err = tt.err
+		req, _ := http.NewRequest("POST", "/payments/get-card-details", nil)
+		rr := httptest.NewRecorder()
+		s.GetCardDetails(rr, req)
+		if rr.Code != tt.want {
+			t.Errorf("Payd error %v: got %d want %d", tt.err, rr.Code, tt.want)
+		}
+	}
+}
+
+func TestNewPaydAttempt(t *testing.T) {
+	rejected := &payd.APIError{Operation: payd.OperationCreatePayment, Response: payd.Response{StatusCode: 422, Body: []byte(`{"message":"bad phone"}`)}}
+	a := newPaydAttempt(operationInitiate, nil, rejected)
+	if a.HTTPStatus != 422 || string(a.Response) != `{"message":"bad phone"}` || a.Err == nil {
+		t.Errorf("rejected attempt: %+v", a)
+	}
+
+	txn, _ := (&payd.Fake{}).CreatePayment(context.Background(), payd.PaymentRequest{})
+	a = newPaydAttempt(operationInitiate, txn, nil)
+	if a.HTTPStatus != http.StatusCreated || a.providerReference() != txn.TransactionReference {
+		t.Errorf("accepted attempt: %+v", a)
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+// Direction of the money movement a payment row records.
+const (
+	directionPayIn  = "payin"
+	directionPayOut = "payout"
+)
+
+// paymentRecord holds the columns of a new payments row.
+type paymentRecord struct {
+	UserID            int
+	Direction         string
+	Amount            float64
+	Method            string
+	Channel           string
+	Phone             string
+	Narration         string
+	ProviderReference string
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// PostgresUserRepository reads users from the users table.
+type PostgresUserRepository struct {
+	db *sql.DB
+}
+
+func NewPostgresUserRepository(db *sql.DB) *PostgresUserRepository {
+	return &PostgresUserRepository{db: db}
+}
+
+func (r *PostgresUserRepository) UserID(ctx context.Context, username string) (int, error) {
+	var id int
+	err := r.db.QueryRowContext(ctx, "SELECT id FROM users WHERE username=$1", username).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, errUserNotFound
+	}
+	return id, err
+}
+
+// PostgresPaymentRepository stores payments in the payments, payment_logs and
+// payment_attempts tables.
+type PostgresPaymentRepository struct {
+	db *sql.DB
+}
+
+func NewPostgresPaymentRepository(db *sql.DB) *PostgresPaymentRepository {
+	return &PostgresPaymentRepository{db: db}
+}
+
+func (r *PostgresPaymentRepository) CreatePayment(ctx context.Context, p paymentRecord, status PaymentStatus, reason string) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var paymentID int
+	err = tx.QueryRowContext(ctx, `INSERT INTO payments
+		(amount, currency, method, status, user_id, provider_reference, direction, channel, phone, narration)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10) RETURNING id`,
+		p.Amount, "KES", p.Method, status, nullInt(p.UserID), nullString(p.ProviderReference),
+		p.Direction, nullString(p.Channel), nullString(p.Phone), nullString(p.Narration)).Scan(&paymentID)
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO payment_logs (payment_id, from_status, status, message) VALUES ($1, NULL, $2, $3)",
+		paymentID, status, reason)
+	if err != nil {
+		return 0, err
+	}
+	return paymentID, tx.Commit()
+}
+
+func (r *PostgresPaymentRepository) RecordAttempt(ctx context.Context, paymentID int, a paydAttempt, next PaymentStatus, reason string) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var errMessage string
+	if a.Err != nil {
+		errMessage = a.Err.Error()
+	}
+	reference := a.providerReference()
+
+	_, err = tx.ExecContext(ctx, `INSERT INTO payment_attempts (payment_id, operation, http_status, provider_reference, response_body, error)
+		VALUES ($1, $2, $3, $4, $5, $6)`,
+		paymentID, a.Operation, nullInt(a.HTTPStatus), nullString(reference), a.snapshot(), nullString(errMessage))
+	if err != nil {
+		return err
+	}
+	if reference != "" {
+		_, err = tx.ExecContext(ctx, "UPDATE payments SET provider_reference=$1 WHERE id=$2", reference, paymentID)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := transition(ctx, tx, paymentID, next, reason); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (r *PostgresPaymentRepository) SetProviderReference(ctx context.Context, paymentID int, reference string) error {
+	result, err := r.db.ExecContext(ctx, "UPDATE payments SET provider_reference=$2 WHERE id=$1 AND provider_reference IS NULL",
+		paymentID, reference)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return errPaymentNotFound
+	}
+	return nil
+}
+
+func (r *PostgresPaymentRepository) Transition(ctx context.Context, paymentID int, next PaymentStatus, reason string) (PaymentStatus, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	current, err := transition(ctx, tx, paymentID, next, reason)
+	if err != nil {
+		return current, err
+	}
+	return current, tx.Commit()
+}
+
+// transition moves a payment to the next state and records the change in payment_logs,
+// both within tx. The payment row is locked for the duration of tx so that concurrent
+// transitions are applied one after another.
+func transition(ctx context.Context, tx *sql.Tx, paymentID int, next PaymentStatus, reason string) (PaymentStatus, error) {
+	var current PaymentStatus
+	err := tx.QueryRowContext(ctx, "SELECT status FROM payments WHERE id=$1 FOR UPDATE", paymentID).Scan(&current)
+	if err == sql.ErrNoRows {
+		return "", errPaymentNotFound
+	}
+	if err != nil {
+		return "", err
+	}
+	if !current.CanTransition(next) {
+		return current, fmt.Errorf("%w: %s to %s", errIllegalTransition, current, next)
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE payments SET status=$1, updated_at=now() WHERE id=$2", next, paymentID)
+	if err != nil {
+		return current, err
+	}
+	_, err = tx.ExecContext(ctx, "INSERT INTO payment_logs (payment_id, from_status, status, message) VALUES ($1, $2, $3, $4)",
+		paymentID, current, next, reason)
+	if err != nil {
+		return current, err
+	}
+	return current, nil
+}
+
+func (r *PostgresPaymentRepository) GetPayment(ctx context.Context, id int) (Payment, error) {
+	return r.getPayment(ctx, "p.id=$1", id)
+}
+
+func (r *PostgresPaymentRepository) GetPaymentByProviderReference(ctx context.Context, reference string) (Payment, error) {
+	return r.getPayment(ctx, "p.provider_reference=$1", reference)
+}
+
+// getPayment finds a single payment with the given condition on payments p.
+func (r *PostgresPaymentRepository) getPayment(ctx context.Context, where string, arg any) (Payment, error) {
+	var p Payment
+	var userID sql.NullInt64
+	var username, channel, phone, narration, reference sql.NullString
+	err := r.db.QueryRowContext(ctx, `SELECT p.id, p.user_id, u.username, p.direction, p.amount, p.currency, p.method,
+			p.channel, p.phone, p.narration, p.status, p.provider_reference, p.created_at, p.updated_at
+		FROM payments p LEFT JOIN users u ON u.id = p.user_id WHERE `+where, arg).
+		Scan(&p.PaymentID, &userID, &username, &p.Direction, &p.Amount, &p.Currency, &p.Method,
+			&channel, &phone, &narration, &p.Status, &reference, &p.CreatedAt, &p.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return p, errPaymentNotFound
+	}
+	if err != nil {
+		return p, err
+	}
+	p.UserID = int(userID.Int64)
+	p.Username = username.String
+	p.Channel = channel.String
+	p.Phone = phone.String
+	p.Narration = narration.String
+	p.ProviderReference = reference.String
+	return p, nil
+}
+
+func (r *PostgresPaymentRepository) History(ctx context.Context, paymentID int) ([]StatusTransition, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT from_status, status, message, logged_at FROM payment_logs
+		WHERE payment_id=$1 ORDER BY logged_at, id`, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := []StatusTransition{}
+	for rows.Next() {
+		var from, reason sql.NullString
+		var entry StatusTransition
+		if err := rows.Scan(&from, &entry.To, &reason, &entry.At); err != nil {
+			return nil, err
+		}
+		entry.From = PaymentStatus(from.String)
+		entry.Reason = reason.String
+		history = append(history, entry)
+	}
+	return history, rows.Err()
+}
+
+func (r *PostgresPaymentRepository) Attempts(ctx context.Context, paymentID int) ([]PaydAttemptRecord, error) {
+	rows, err := r.db.QueryContext(ctx, `SELECT id, operation, http_status, provider_reference, response_body, error, created_at
+		FROM payment_attempts WHERE payment_id=$1 ORDER BY created_at, id`, paymentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []PaydAttemptRecord{}
+	for rows.Next() {
+		var a PaydAttemptRecord
+		var status sql.NullInt64
+		var reference, errMessage sql.NullString
+		var response []byte
+		if err := rows.Scan(&a.ID, &a.Operation, &status, &reference, &response, &errMessage, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		a.HTTPStatus = int(status.Int64)
+		a.ProviderReference = reference.String
+		a.Response = string(response)
+		a.Error = errMessage.String
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
+
+// PostgresIdempotencyStore keeps idempotency keys in the idempotency_keys table.
+type PostgresIdempotencyStore struct {
+	db *sql.DB
+}
+
+func NewPostgresIdempotencyStore(db *sql.DB) *PostgresIdempotencyStore {
+	return &PostgresIdempotencyStore{db: db}
+}
+
+func (s *PostgresIdempotencyStore) Claim(ctx context.Context, username, key, hash string, staleAfter time.Duration) (bool, error) {
+	result, err := s.db.ExecContext(ctx, `INSERT INTO idempotency_keys (username, key, request_hash) VALUES ($1, $2, $3)
+		ON CONFLICT (username, key) DO UPDATE SET created_at = now()
+		WHERE idempotency_keys.completed_at IS NULL
+		AND idempotency_keys.request_hash = EXCLUDED.request_hash
+		AND idempotency_keys.created_at < now() - $4::interval`,
+		username, key, hash, fmt.Sprintf("%d seconds", int(staleAfter.Seconds())))
+	if err != nil {
+		return false, err
+	}
+	claimed, err := result.RowsAffected()
+	return claimed > 0, err
+}
+
+func (s *PostgresIdempotencyStore) Get(ctx context.Context, username, key string) (storedResponse, error) {
+	var resp storedResponse
+	var status sql.NullInt64
+	var contentType sql.NullString
+	err := s.db.QueryRowContext(ctx, `SELECT request_hash, response_status, response_content_type, response_body
+		FROM idempotency_keys WHERE username=$1 AND key=$2`, username, key).Scan(&resp.RequestHash, &status, &contentType, &resp.Body)
+	if err == sql.ErrNoRows {
+		return resp, errIdempotencyKeyNotFound
+	}
+	resp.Status = int(status.Int64)
+	resp.ContentType = contentType.String
+	return resp, err
+}
+
+func (s *PostgresIdempotencyStore) Complete(ctx context.Context, username, key string, resp storedResponse) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE idempotency_keys SET response_status=$1, response_content_type=$2, response_body=$3, completed_at=now()
+		WHERE username=$4 AND key=$5`, resp.Status, resp.ContentType, resp.Body, username, key)
+	return err
+}
+
+func (s *PostgresIdempotencyStore) Release(ctx context.Context, username, key string) error {
+	_, err := s.db.ExecContext(ctx, "DELETE FROM idempotency_keys WHERE username=$1 AND key=$2", username, key)
+	return err
+}
+
+func nullString(s string) sql.NullString {
+	return sql.NullString{String: s, Valid: s != ""}
+}
+
+func nullInt(i int) sql.NullInt64 {
+	return sql.NullInt64{Int64: int64(i), Valid: i != 0}
+}
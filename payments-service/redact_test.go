@@ -0,0 +1,47 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRedactPaydResponse(t *testing.T) {
+	redactFields = defaultRedactFields
+
+	body := []byte(`{"status":"success","transaction_reference":"TX123",` +
+		`"customer":{"phone_number":"0700000000","email":"test@example.com"},"card_last4":"1111"}`)
+
+	got := redactBody(body)
+
+	for _, secret := range []string{"0700000000", "test@example.com", "1111"} {
+		if strings.Contains(got, secret) {
+			t.Errorf("redacted body still contains %q: %s", secret, got)
+		}
+	}
+	if !strings.Contains(got, `"transaction_reference":"TX123"`) {
+		t.Errorf("redacted body lost the transaction reference: %s", got)
+	}
+}
+
+func TestLoggingMiddlewareRedacts(t *testing.T) {
+	redactFields = defaultRedactFields
+
+	logs := captureLogs(t)
+
+	handler := loggingMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusAccepted)
+	}))
+
+	body := `{"account_id":"12345","phone_number":"0700000000","amount":100}`
+	req, _ := http.NewRequest("POST", "/payments/send-to-mobile", strings.NewReader(body))
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	if strings.Contains(logs.String(), "0700000000") {
+		t.Errorf("logs contain the phone number:\n%s", logs.String())
+	}
+	if !strings.Contains(logs.String(), `"status":202`) {
+		t.Errorf("logs do not record the response status:\n%s", logs.String())
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+var (
+	errUserNotFound           = errors.New("user not found")
+	errPaymentNotFound        = errors.New("payment not found")
+	errIdempotencyKeyNotFound = errors.New("idempotency key not found")
+)
+
+// UserRepository looks up the users payments are made for.
+type UserRepository interface {
+	// UserID returns the ID of the user, or errUserNotFound.
+	UserID(ctx context.Context, username string) (int, error)
+}
+
+// PaymentRepository stores payments, their status history and the calls made to Payd
+// for them. Status changes are only made through the payment lifecycle.
+type PaymentRepository interface {
+	// CreatePayment stores a new payment in the given status and logs how it got there.
+	CreatePayment(ctx context.Context, p paymentRecord, status PaymentStatus, reason string) (int, error)
+	// RecordAttempt stores a Payd call, keeps its provider reference on the payment and
+	// moves the payment to next, atomically.
+	RecordAttempt(ctx context.Context, paymentID int, a paydAttempt, next PaymentStatus, reason string) error
+	// Transition moves a payment to next and logs the change. It returns the status the
+	// payment was in, and errIllegalTransition if the lifecycle does not allow the move.
+	Transition(ctx context.Context, paymentID int, next PaymentStatus, reason string) (PaymentStatus, error)
+	// SetProviderReference keeps Payd's reference on a payment that has none yet, e.g.
+	// because Payd's answer to the request timed out. It returns errPaymentNotFound if
+	// there is no such payment without a reference.
+	SetProviderReference(ctx context.Context, paymentID int, reference string) error
+	// GetPayment returns a payment by ID, or errPaymentNotFound.
+	GetPayment(ctx context.Context, id int) (Payment, error)
+	// GetPaymentByProviderReference returns the payment Payd knows by reference, or errPaymentNotFound.
+	GetPaymentByProviderReference(ctx context.Context, reference string) (Payment, error)
+	// History returns the status transitions of a payment, oldest first.
+	History(ctx context.Context, paymentID int) ([]StatusTransition, error)
+	// Attempts returns the Payd calls made for a payment, oldest first.
+	Attempts(ctx context.Context, paymentID int) ([]PaydAttemptRecord, error)
+}
+
+// IdempotencyStore keeps the responses of requests made with an Idempotency-Key.
+// Keys are scoped to a user.
+type IdempotencyStore interface {
+	// Claim reserves key for a request with the given hash. It returns false if the key
+	// is already taken, unless it is an unfinished claim for the same request that is
+	// older than staleAfter, which is taken over.
+	Claim(ctx context.Context, username, key, hash string, staleAfter time.Duration) (bool, error)
+	// Get returns what is stored for key, or errIdempotencyKeyNotFound.
+	Get(ctx context.Context, username, key string) (storedResponse, error)
+	// Complete stores the response for a claimed key.
+	Complete(ctx context.Context, username, key string, resp storedResponse) error
+	// Release frees a claimed key so that the request can be retried.
+	Release(ctx context.Context, username, key string) error
+}
+
+// Payment is a stored payment or payout.
+type Payment struct {
+	PaymentID         int           `json:"payment_id"`
+	UserID            int           `json:"-"`
+	Username          string        `json:"username,omitempty"`
+	Direction         string        `json:"direction"`
+	Amount            float64       `json:"amount"`
+	Currency          string        `json:"currency"`
+	Method            string        `json:"method"`
+	Channel           string        `json:"channel,omitempty"`
+	Phone             string        `json:"phone,omitempty"`
+	Narration         string        `json:"narration,omitempty"`
+	Status            PaymentStatus `json:"status"`
+	ProviderReference string        `json:"provider_reference,omitempty"`
+	CreatedAt         time.Time     `json:"created_at"`
+	UpdatedAt         time.Time     `json:"updated_at"`
+}
+
+// storedResponse is what an IdempotencyStore holds for a key. Status is zero while the
+// first request with the key is still running.
+type storedResponse struct {
+	RequestHash string
+	Status      int
+	ContentType string
+	Body        []byte
+}
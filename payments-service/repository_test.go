@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	_ "github.com/lib/pq"
+)
+
+// openTestDB returns the database named by DATABASE_URI, skipping the test if there is none.
+func openTestDB(t *testing.T) *sql.DB {
+	uri := os.Getenv("DATABASE_URI")
+	if uri == "" {
+		t.Skip("DATABASE_URI not set")
+	}
+	db, err := sql.Open("postgres", uri)
+	if err != nil || db.Ping() != nil {
+		t.Skip("database not available")
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func TestMemoryPaymentRepository(t *testing.T) {
+	testPaymentRepository(t, NewMemoryPaymentRepository())
+}
+
+func TestPostgresPaymentRepository(t *testing.T) {
+	testPaymentRepository(t, NewPostgresPaymentRepository(openTestDB(t)))
+}
+
+func testPaymentRepository(t *testing.T, repo PaymentRepository) {
+	ctx := context.Background()
+	reference := fmt.Sprintf("REPO-%d", time.Now().UnixNano())
+
+	id, err := repo.CreatePayment(ctx, paymentRecord{
+		Direction: directionPayOut, Amount: 250, Method: "MPESA", Channel: "MPESA", Phone: "0700000000", Narration: "rent",
+	}, StatusCreated, "Payout requested")
+	if err != nil {
+		t.Fatalf("CreatePayment: %v", err)
+	}
+
+	accepted := paydAttempt{Operation: operationWithdrawal, HTTPStatus: 200, Response: []byte(`{"transaction_reference":"` + reference + `"}`)}
+	if err := repo.RecordAttempt(ctx, id, accepted, StatusPending, "Accepted by Payd"); err != nil {
+		t.Fatalf("RecordAttempt: %v", err)
+	}
+
+	payment, err := repo.GetPaymentByProviderReference(ctx, reference)
+	if err != nil || payment.PaymentID != id || payment.Status != StatusPending || payment.Direction != directionPayOut {
+		t.Fatalf("GetPaymentByProviderReference: got %+v, %v", payment, err)
+	}
+
+	if _, err := repo.Transition(ctx, id, StatusRefunded, "not allowed"); !errors.Is(err, errIllegalTransition) {
+		t.Errorf("PENDING -> REFUNDED: expected errIllegalTransition, got %v", err)
+	}
+	if from, err := repo.Transition(ctx, id, StatusSucceeded, "Paid"); err != nil || from != StatusPending {
+		t.Errorf("PENDING -> SUCCEEDED: got %s, %v", from, err)
+	}
+
+	history, err := repo.History(ctx, id)
+	if err != nil || len(history) != 3 {
+		t.Fatalf("History: got %+v, %v", history, err)
+	}
+	if last := history[2]; last.From != StatusPending || last.To != StatusSucceeded || last.Reason != "Paid" {
+		t.Errorf("unexpected last transition %+v", last)
+	}
+
+	attempts, err := repo.Attempts(ctx, id)
+	if err != nil || len(attempts) != 1 || attempts[0].HTTPStatus != 200 || attempts[0].ProviderReference != reference {
+		t.Errorf("Attempts: got %+v, %v", attempts, err)
+	}
+
+	if err := repo.SetProviderReference(ctx, id, "OTHER-"+reference); err != errPaymentNotFound {
+		t.Errorf("SetProviderReference on a payment with a reference: expected errPaymentNotFound, got %v", err)
+	}
+	unanswered, err := repo.CreatePayment(ctx, paymentRecord{Direction: directionPayIn, Amount: 10, Method: "MPESA"}, StatusPending, "No answer from Payd")
+	if err != nil {
+		t.Fatalf("CreatePayment: %v", err)
+	}
+	if err := repo.SetProviderReference(ctx, unanswered, "LATE-"+reference); err != nil {
+		t.Errorf("SetProviderReference: %v", err)
+	}
+	if payment, err := repo.GetPaymentByProviderReference(ctx, "LATE-"+reference); err != nil || payment.PaymentID != unanswered {
+		t.Errorf("GetPaymentByProviderReference after SetProviderReference: got %+v, %v", payment, err)
+	}
+
+	if _, err := repo.GetPayment(ctx, 1<<30); err != errPaymentNotFound {
+		t.Errorf("GetPayment of unknown ID: expected errPaymentNotFound, got %v", err)
+	}
+}
+
+func TestMemoryIdempotencyStore(t *testing.T) {
+	testIdempotencyStore(t, NewMemoryIdempotencyStore())
+}
+
+func TestPostgresIdempotencyStore(t *testing.T) {
+	testIdempotencyStore(t, NewPostgresIdempotencyStore(openTestDB(t)))
+}
+
+func testIdempotencyStore(t *testing.T, store IdempotencyStore) {
+	ctx := context.Background()
+	key := fmt.Sprintf("store-test-%d", time.Now().UnixNano())
+	defer store.Release(ctx, "testuser", key)
+
+	if claimed, err := store.Claim(ctx, "testuser", key, "hash", time.Minute); !claimed || err != nil {
+		t.Fatalf("first claim: %v, %v", claimed, err)
+	}
+	if claimed, _ := store.Claim(ctx, "testuser", key, "hash", time.Minute); claimed {
+		t.Error("second claim of an in-flight key succeeded")
+	}
+	if claimed, _ := store.Claim(ctx, "otheruser", key, "hash", time.Minute); !claimed {
+		t.Error("keys are not scoped to the user")
+	}
+	store.Release(ctx, "otheruser", key)
+
+	if err := store.Complete(ctx, "testuser", key, storedResponse{Status: 202, ContentType: "application/json", Body: []byte(`{}`)}); err != nil {
+		t.Fatalf("Complete: %v", err)
+	}
+	stored, err := store.Get(ctx, "testuser", key)
+	if err != nil || stored.Status != 202 || stored.RequestHash != "hash" || string(stored.Body) != `{}` {
+		t.Errorf("Get: got %+v, %v", stored, err)
+	}
+
+	store.Release(ctx, "testuser", key)
+	if _, err := store.Get(ctx, "testuser", key); err != errIdempotencyKeyNotFound {
+		t.Errorf("Get after Release: expected errIdempotencyKeyNotFound, got %v", err)
+	}
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	httpSwagger "github.com/swaggo/http-swagger"
+	"github.com/tufstraka/pps/payments-service/payd"
+)
+
+// Server is the payments service. Storage, the Payd API and the clock are reached
+// through the dependencies given to NewServer, so tests can build one around the
+// in-memory repositories and payd.Fake.
+type Server struct {
+	config   Config
+	users    UserRepository
+	payments PaymentRepository
+	keys     IdempotencyStore
+	payd     payd.Client
+	now      func() time.Time
+}
+
+func NewServer(config Config, users UserRepository, payments PaymentRepository, keys IdempotencyStore, client payd.Client, now func() time.Time) *Server {
+	return &Server{config: config, users: users, payments: payments, keys: keys, payd: client, now: now}
+}
+
+// Handler returns the service's routes with request ID and logging middleware.
+func (s *Server) Handler() http.Handler {
+	r := mux.NewRouter()
+	r.Use(requestIDMiddleware)
+	r.Use(loggingMiddleware)
+
+	r.HandleFunc("/payments/initiate", s.idempotent(s.InitiatePayment)).Methods("POST")
+	r.HandleFunc("/payments/status/{id}", s.GetPaymentStatus).Methods("GET")
+	r.HandleFunc("/payments/send-to-mobile", s.idempotent(s.SendToMobile)).Methods("POST")
+	r.HandleFunc("/payments/get-card-details", s.GetCardDetails).Methods("POST")
+	r.HandleFunc("/payments/callback", s.PaydCallbackHandler).Methods("POST")
+	r.HandleFunc("/admin/payments/{id:[0-9]+}", s.adminOnly(s.AdminGetPayment)).Methods("GET")
+	r.HandleFunc("/admin/payments/provider/{reference}", s.adminOnly(s.AdminGetPaymentByProviderReference)).Methods("GET")
+
+	r.PathPrefix("/swagger/").Handler(httpSwagger.WrapHandler)
+
+	return r
+}
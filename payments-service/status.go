@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// PaymentStatus is a state in the payment lifecycle.
+type PaymentStatus string
+
+const (
+	StatusCreated    PaymentStatus = "CREATED"
+	StatusPending    PaymentStatus = "PENDING"
+	StatusProcessing PaymentStatus = "PROCESSING"
+	StatusSucceeded  PaymentStatus = "SUCCEEDED"
+	StatusFailed     PaymentStatus = "FAILED"
+	StatusCancelled  PaymentStatus = "CANCELLED"
+	StatusRefunded   PaymentStatus = "REFUNDED"
+)
+
+// paymentTransitions lists the states each state may move to. States without an
+// entry are final.
+var paymentTransitions = map[PaymentStatus][]PaymentStatus{
+	StatusCreated:    {StatusPending, StatusFailed, StatusCancelled},
+	StatusPending:    {StatusProcessing, StatusSucceeded, StatusFailed, StatusCancelled},
+	StatusProcessing: {StatusSucceeded, StatusFailed},
+	StatusSucceeded:  {StatusRefunded},
+}
+
+var errIllegalTransition = errors.New("illegal payment status transition")
+
+// Valid reports whether s is one of the known lifecycle states.
+func (s PaymentStatus) Valid() bool {
+	switch s {
+	case StatusCreated, StatusPending, StatusProcessing, StatusSucceeded, StatusFailed, StatusCancelled, StatusRefunded:
+		return true
+	}
+	return false
+}
+
+// Final reports whether no further transitions are allowed from s.
+func (s PaymentStatus) Final() bool {
+	return len(paymentTransitions[s]) == 0
+}
+
+// CanTransition reports whether a payment in state s may move to next.
+func (s PaymentStatus) CanTransition(next PaymentStatus) bool {
+	for _, allowed := range paymentTransitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// StatusTransition is one entry of a payment's status history.
+type StatusTransition struct {
+	From   PaymentStatus `json:"from,omitempty"`
+	To     PaymentStatus `json:"to"`
+	Reason string        `json:"reason,omitempty"`
+	At     time.Time     `json:"at"`
+}
@@ -0,0 +1,62 @@
+package main
+
+import "testing"
+
+func TestPaymentStatusTransitions(t *testing.T) {
+	tests := []struct {
+		from, to PaymentStatus
+		allowed  bool
+	}{
+		{StatusCreated, StatusPending, true},
+		{StatusCreated, StatusSucceeded, false},
+		{StatusPending, StatusProcessing, true},
+		{StatusPending, StatusSucceeded, true},
+		{StatusPending, StatusCancelled, true},
+		{StatusProcessing, StatusFailed, true},
+		{StatusProcessing, StatusCancelled, false},
+		{StatusSucceeded, StatusRefunded, true},
+		{StatusSucceeded, StatusFailed, false},
+		{StatusFailed, StatusSucceeded, false},
+		{StatusRefunded, StatusSucceeded, false},
+		{StatusPending, StatusPending, false},
+		{PaymentStatus("SUCCESS"), StatusRefunded, false},
+	}
+	for _, tt := range tests {
+		if got := tt.from.CanTransition(tt.to); got != tt.allowed {
+			t.Errorf("%s -> %s: got allowed=%v, want %v", tt.from, tt.to, got, tt.allowed)
+		}
+	}
+
+	for _, s := range []PaymentStatus{StatusFailed, StatusCancelled, StatusRefunded} {
+		if !s.Final() {
+			t.Errorf("expected %s to be final", s)
+		}
+	}
+	if StatusPending.Final() {
+		t.Error("expected PENDING not to be final")
+	}
+	if PaymentStatus("SUCCESS").Valid() || !StatusProcessing.Valid() {
+		t.Error("Valid does not match the lifecycle states")
+	}
+}
+
+func TestPaydCallbackPaymentStatus(t *testing.T) {
+	tests := []struct {
+		callback PaydCallback
+		want     PaymentStatus
+		ok       bool
+	}{
+		{PaydCallback{Success: true}, StatusSucceeded, true},
+		{PaydCallback{Status: "SUCCESS"}, StatusSucceeded, true},
+		{PaydCallback{Status: "processing"}, StatusProcessing, true},
+		{PaydCallback{Status: "failed", ResultCode: 1}, StatusFailed, true},
+		{PaydCallback{Status: "cancelled"}, StatusFailed, true},
+		{PaydCallback{}, "", false},
+		{PaydCallback{Status: "reversal_pending"}, "", false},
+	}
+	for _, tt := range tests {
+		if got, ok := tt.callback.paymentStatus(); got != tt.want || ok != tt.ok {
+			t.Errorf("paymentStatus(%+v) = %s, %v, want %s, %v", tt.callback, got, ok, tt.want, tt.ok)
+		}
+	}
+}